@@ -27,44 +27,88 @@ func main() {
 		Copyright: "© 2021-2022 weisdd",
 		HelpName:  "lfgw",
 		Usage:     "A reverse proxy aimed at PromQL / MetricsQL metrics filtering based on OIDC roles",
-		UsageText: "lfgw [flags]",
+		UsageText: "lfgw [flags] [command]",
 		// UseShortOptionHandling: true,
 		// EnableBashCompletion:   true,
 		HideHelpCommand: true,
-		Action:          lfgw.Run,
-		Before: func(c *cli.Context) error {
-			nonEmptyStrings := []string{"upstream-url", "oidc-realm-url", "oidc-client-id"}
-
-			for _, key := range nonEmptyStrings {
-				if c.String(key) == "" {
-					return fmt.Errorf("%s cannot be empty", key)
-				}
-			}
-
-			if c.String("acl-path") == "" && !c.Bool("assumed-roles") {
-				return fmt.Errorf("the app cannot run without at least one configuration source: defined acl-path or assumed-roles set to true")
+		Action: func(c *cli.Context) error {
+			err := validateServerFlags(c)
+			if err != nil {
+				return err
 			}
 
-			return nil
+			return lfgw.Run(c)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "acl",
+				Usage: "tools for files with ACL definitions",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "validate",
+						Usage:     "validate a file with ACL definitions, reports all invalid roles and warns about suspicious ones",
+						ArgsUsage: "[path (defaults to acl-path)]",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "strict",
+								Usage: "whether to treat warnings as errors",
+								Value: false,
+							},
+						},
+						Action: lfgw.ValidateACL,
+					},
+					{
+						Name:      "test",
+						Usage:     "run test cases (roles, queries, expected results) against a file with ACL definitions",
+						ArgsUsage: "<tests path> [acl path (defaults to acl-path)]",
+						Action:    lfgw.RunACLTests,
+					},
+				},
+			},
+			{
+				Name:      "explain",
+				Usage:     "show how a query would be rewritten for a user with the specified roles (ACLs, assumed roles, deduplication and optimization settings are taken from the global flags)",
+				ArgsUsage: "<query>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "roles",
+						Usage:    "comma-separated list of OIDC-roles of the user",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "whether to print the result as JSON",
+						Value: false,
+					},
+				},
+				Action: lfgw.Explain,
+			},
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:     "upstream-url",
 				Usage:    "Prometheus URL, e.g. http://prometheus.localhost",
 				EnvVars:  []string{"UPSTREAM_URL"},
-				Required: true,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "upstream-flavor",
+				Usage:    "upstream flavor: auto (detected by probing the upstream), prometheus, victoriametrics, victoriametrics-cluster, thanos, mimir, alertmanager",
+				EnvVars:  []string{"UPSTREAM_FLAVOR"},
+				Value:    "auto",
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "oidc-realm-url",
 				Usage:    "OIDC Realm URL, e.g. `https://keycloak.localhost/auth/realms/monitoring",
 				EnvVars:  []string{"OIDC_REALM_URL"},
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "oidc-client-id",
 				Usage:    "OIDC Client ID (used for token audience validation)",
 				EnvVars:  []string{"OIDC_CLIENT_ID"},
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "acl-path",
@@ -73,6 +117,20 @@ func main() {
 				Value:    "./acl.yaml",
 				Required: false,
 			},
+			&cli.DurationFlag{
+				Name:     "acl-reload-interval",
+				Usage:    "how often to check the file with ACL definitions for changes, 0 disables the checks (ACLs can still be reloaded through SIGHUP)",
+				EnvVars:  []string{"ACL_RELOAD_INTERVAL"},
+				Value:    30 * time.Second,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "roles-claims",
+				Usage:    "comma-separated list of claim paths to extract roles from (e.g. realm_access.roles, resource_access.\"my.client\".roles, groups), values of all claims are merged",
+				EnvVars:  []string{"ROLES_CLAIMS"},
+				Value:    cli.NewStringSlice("roles"),
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "assumed-roles",
 				Usage:    "whether to treat unknown OIDC-role names as acl definitions (also known as autoconfiguration)",
@@ -80,6 +138,37 @@ func main() {
 				Value:    false,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-allow",
+				Usage:    "regular expression (fully anchored) for OIDC-role names eligible for assumption, all names are eligible if empty",
+				EnvVars:  []string{"ASSUMED_ROLES_ALLOW"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-deny",
+				Usage:    "regular expression (fully anchored) for OIDC-role names that must never be assumed",
+				EnvVars:  []string{"ASSUMED_ROLES_DENY"},
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "assumed-roles-literal",
+				Usage:    "whether to treat assumed roles as literal namespace names instead of regular expressions",
+				EnvVars:  []string{"ASSUMED_ROLES_LITERAL"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-strip-prefix",
+				Usage:    "prefix to strip from assumed roles (e.g. ns-), roles without the prefix are not assumed",
+				EnvVars:  []string{"ASSUMED_ROLES_STRIP_PREFIX"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-strip-suffix",
+				Usage:    "suffix to strip from assumed roles, roles without the suffix are not assumed",
+				EnvVars:  []string{"ASSUMED_ROLES_STRIP_SUFFIX"},
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "enable-deduplication",
 				Usage:    "whether to enable deduplication, which leaves some of the requests unmodified if they match the target policy",
@@ -94,13 +183,73 @@ func main() {
 				Value:    true,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "query-dialect",
+				Usage:    "dialect used for parsing and rewriting expressions (auto, metricsql, promql). With auto, promql is used for Prometheus, Thanos and Mimir upstreams",
+				EnvVars:  []string{"QUERY_DIALECT"},
+				Value:    "auto",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "enforcement-mode",
+				Usage:    "how label filters are applied to requests (rewrite, extra-filters). With extra-filters, expressions are left untouched and label filters are passed to VictoriaMetrics through extra_filters[]",
+				EnvVars:  []string{"ENFORCEMENT_MODE"},
+				Value:    "rewrite",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "client-extra-filters",
+				Usage:    "how client-supplied extra_label / extra_filters[] parameters are handled (strip, rewrite). With rewrite, extra_filters[] selectors are rewritten according to an ACL and extra_label is validated",
+				EnvVars:  []string{"CLIENT_EXTRA_FILTERS"},
+				Value:    "strip",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "write-mode",
+				Usage:    "how remote write and import requests are handled (off, reject, rewrite). With reject, series not matching an ACL are dropped; with rewrite, labels restricted to a single value are set to that value first. If off, write endpoints are treated as unsafe",
+				EnvVars:  []string{"WRITE_MODE"},
+				Value:    "off",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "inspect-responses",
+				Usage:    "whether to check series in responses of query, series, federate and label values endpoints against an ACL and drop those that violate it (defense in depth against rewrite gaps)",
+				EnvVars:  []string{"INSPECT_RESPONSES"},
+				Value:    false,
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "safe-mode",
-				Usage:    "whether to block requests to sensitive endpoints (tsdb admin, insert)",
+				Usage:    "whether to block requests to sensitive endpoints (tsdb admin, insert, reload, etc.)",
 				EnvVars:  []string{"SAFE_MODE"},
 				Value:    true,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "safe-mode-flavor",
+				Usage:    "which built-in safe mode rules to use: auto (based on the upstream flavor), prometheus, victoriametrics, victoriametrics-cluster, thanos, mimir, alertmanager, all",
+				EnvVars:  []string{"SAFE_MODE_FLAVOR"},
+				Value:    "auto",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "safe-mode-allow",
+				Usage:    "comma-separated list of rules (\"[METHOD ]pattern\", e.g. \"GET /api/v1/admin/tsdb/snapshot\") for requests that are never blocked in safe mode",
+				EnvVars:  []string{"SAFE_MODE_ALLOW"},
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "safe-mode-deny",
+				Usage:    "comma-separated list of rules (\"[METHOD ]pattern\", e.g. \"POST /api/v1/custom/*\") for requests to block in safe mode in addition to the built-in rules",
+				EnvVars:  []string{"SAFE_MODE_DENY"},
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "safe-mode-exempt-roles",
+				Usage:    "comma-separated list of OIDC-roles, which are not affected by safe mode (e.g. admins)",
+				EnvVars:  []string{"SAFE_MODE_EXEMPT_ROLES"},
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "set-proxy-headers",
 				Usage:    "whether to set proxy headers (X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host)",
@@ -108,6 +257,13 @@ func main() {
 				Value:    false,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "tenant-header",
+				Usage:    "header to set to tenants of the user joined with | (e.g. X-Scope-OrgID for Mimir, Cortex and Loki), client-provided values are always overwritten. Disabled if empty",
+				EnvVars:  []string{"TENANT_HEADER"},
+				Value:    "",
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "set-gomax-procs",
 				Usage:    "automatically set GOMAXPROCS to match Linux container CPU quota",
@@ -179,3 +335,20 @@ func main() {
 		fmt.Printf("\n%+v: %+v\n", os.Args[0], err)
 	}
 }
+
+// validateServerFlags checks the flags needed to run the proxy. Flags are not marked as required, since the checks would also apply to commands, which don't need them.
+func validateServerFlags(c *cli.Context) error {
+	nonEmptyStrings := []string{"upstream-url", "oidc-realm-url", "oidc-client-id"}
+
+	for _, key := range nonEmptyStrings {
+		if c.String(key) == "" {
+			return fmt.Errorf("%s cannot be empty", key)
+		}
+	}
+
+	if c.String("acl-path") == "" && !c.Bool("assumed-roles") {
+		return fmt.Errorf("the app cannot run without at least one configuration source: defined acl-path or assumed-roles set to true")
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package lfgw
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+var (
+	aclReloadsSuccessTotal        = metrics.NewCounter(`acl_reloads_total{status="success"}`)
+	aclReloadsFailureTotal        = metrics.NewCounter(`acl_reloads_total{status="failure"}`)
+	aclLastReloadSuccessful       atomic.Bool
+	aclLastReloadSuccessTimestamp atomic.Int64
+	_                             = metrics.NewGauge("acl_last_reload_successful", aclLastReloadSuccessfulValue)
+	_                             = metrics.NewGauge("acl_last_reload_success_timestamp_seconds", aclLastReloadSuccessTimestampValue)
+)
+
+// aclLastReloadSuccessfulValue returns 1 if the last ACL reload was successful, 0 otherwise.
+func aclLastReloadSuccessfulValue() float64 {
+	if aclLastReloadSuccessful.Load() {
+		return 1
+	}
+	return 0
+}
+
+// aclLastReloadSuccessTimestampValue returns unix time of the last successful ACL reload.
+func aclLastReloadSuccessTimestampValue() float64 {
+	return float64(aclLastReloadSuccessTimestamp.Load())
+}
+
+// aclStore holds ACLs, which can be atomically replaced while requests are being served.
+type aclStore struct {
+	acls atomic.Pointer[querymodifier.ACLs]
+	// checksum of the file the current ACLs were loaded from, only accessed by the goroutine that reloads ACLs
+	checksum [sha256.Size]byte
+	// failedChecksum of the last file content that failed to load, so that the same errors are not reported on every check
+	failedChecksum [sha256.Size]byte
+}
+
+// newACLStore returns an aclStore containing the specified ACLs.
+func newACLStore(acls querymodifier.ACLs) *aclStore {
+	s := &aclStore{}
+	s.Store(acls)
+	return s
+}
+
+// Load returns the current ACLs. It's safe to call on a nil store, an empty ACLs instance is returned then.
+func (s *aclStore) Load() querymodifier.ACLs {
+	if s == nil {
+		return querymodifier.ACLs{}
+	}
+
+	acls := s.acls.Load()
+	if acls == nil {
+		return querymodifier.ACLs{}
+	}
+
+	return *acls
+}
+
+// Store atomically replaces the current ACLs.
+func (s *aclStore) Store(acls querymodifier.ACLs) {
+	s.acls.Store(&acls)
+}
+
+// loadACLs reads and validates app.ACLPath. Unless force is true, the file is not parsed if its content hasn't changed since the last load, be it successful or not. It returns true if the ACLs got replaced.
+func (app *application) loadACLs(force bool) (bool, error) {
+	content, err := os.ReadFile(app.ACLPath)
+	if err != nil {
+		return false, err
+	}
+
+	checksum := sha256.Sum256(content)
+	if !force && app.ACLs != nil && (checksum == app.ACLs.checksum || checksum == app.ACLs.failedChecksum) {
+		return false, nil
+	}
+
+	acls, err := querymodifier.NewACLsFromYAML(content)
+	// Otherwise, nobody would be able to access the upstream
+	if err == nil && len(acls.Roles) == 0 && len(acls.Patterns) == 0 && !app.AssumedRolesEnabled {
+		err = fmt.Errorf("no roles defined in %s, while assumed roles mode is off", app.ACLPath)
+	}
+	if err != nil {
+		if app.ACLs != nil {
+			app.ACLs.failedChecksum = checksum
+		}
+		return false, err
+	}
+
+	if app.ACLs == nil {
+		app.ACLs = newACLStore(acls)
+	} else {
+		app.ACLs.Store(acls)
+	}
+	app.ACLs.checksum = checksum
+	app.ACLs.failedChecksum = [sha256.Size]byte{}
+
+	aclLastReloadSuccessful.Store(true)
+	aclLastReloadSuccessTimestamp.Store(time.Now().Unix())
+
+	return true, nil
+}
+
+// reloadACLs reloads app.ACLPath and updates the respective metrics. In case of any errors, the previously loaded ACLs are kept.
+func (app *application) reloadACLs(force bool) {
+	reloaded, err := app.loadACLs(force)
+	if err != nil {
+		aclReloadsFailureTotal.Inc()
+		aclLastReloadSuccessful.Store(false)
+		app.logger.Error().Caller().
+			Err(err).Msgf("Failed to reload ACL, the previously loaded ACL is kept")
+		return
+	}
+
+	if !reloaded {
+		return
+	}
+
+	aclReloadsSuccessTotal.Inc()
+
+	app.logger.Info().Caller().
+		Msgf("Reloaded ACL from %s", app.ACLPath)
+	app.logACLs()
+}
+
+// watchACLs reloads ACLs on SIGHUP and, if app.ACLReloadInterval is not zero, whenever the content of app.ACLPath changes. It returns once ctx is done.
+func (app *application) watchACLs(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// A nil channel blocks forever, so the file is not checked when the interval is not set
+	var tick <-chan time.Time
+	if app.ACLReloadInterval > 0 {
+		ticker := time.NewTicker(app.ACLReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			app.logger.Info().Caller().
+				Msg("Caught SIGHUP signal, reloading ACL")
+			app.reloadACLs(true)
+		case <-tick:
+			app.reloadACLs(false)
+		}
+	}
+}
+
+// logACLs logs all loaded role definitions.
+func (app *application) logACLs() {
+	now := time.Now()
+	acls := app.ACLs.Load()
+	for role, acl := range acls.Roles {
+		app.logger.Info().Caller().
+			Msgf("Loaded role definition for %s: %q (converted to %s)", role, acl.RawACLs, acl.LabelFiltersString())
+
+		if acl.IsExpired(now) {
+			app.logger.Warn().Caller().
+				Msgf("Role %s expired at %s, it will be ignored", role, acl.Expires)
+		}
+	}
+
+	for _, p := range acls.Patterns {
+		app.logger.Info().Caller().
+			Msgf("Loaded role pattern %s: %q", p.Name, p.RawACLs)
+	}
+
+	if len(acls.Deny) > 0 {
+		app.logger.Info().Caller().
+			Msgf("Loaded global deny rules: %q", acls.Deny)
+	}
+}
+
+// logInvalidRoles logs roles, to which a matching role pattern cannot be applied (see querymodifier.ACLs.CheckRole). Such roles are skipped, other roles of the user are still considered.
+func (app *application) logInvalidRoles(r *http.Request, roles []string, acls querymodifier.ACLs) {
+	for _, role := range roles {
+		if err := acls.CheckRole(role); err != nil {
+			hlog.FromRequest(r).Warn().Caller().
+				Err(err).Msgf("Skipped role %q", role)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package lfgw
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func TestACLStore(t *testing.T) {
+	t.Run("nil store", func(t *testing.T) {
+		var s *aclStore
+		assert.Equal(t, querymodifier.ACLs{}, s.Load())
+	})
+
+	t.Run("Store replaces ACLs", func(t *testing.T) {
+		acl, err := querymodifier.NewACL("minio")
+		assert.Nil(t, err)
+
+		s := newACLStore(querymodifier.ACLs{})
+		assert.Equal(t, querymodifier.ACLs{}, s.Load())
+
+		acls := querymodifier.NewACLs(map[string]querymodifier.ACL{"minio": acl})
+		s.Store(acls)
+		assert.Equal(t, acls, s.Load())
+	})
+}
+
+func TestApp_reloadACLs(t *testing.T) {
+	logger := zerolog.New(nil)
+	aclPath := filepath.Join(t.TempDir(), "acl.yaml")
+
+	writeACL := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(aclPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := &application{
+		logger:  &logger,
+		ACLPath: aclPath,
+	}
+
+	writeACL("editor: minio")
+	app.reloadACLs(true)
+	assert.Contains(t, app.ACLs.Load().Roles, "editor")
+
+	t.Run("Valid file replaces ACLs", func(t *testing.T) {
+		writeACL("viewer: stolon")
+		successBefore := aclReloadsSuccessTotal.Get()
+
+		app.reloadACLs(false)
+		acls := app.ACLs.Load().Roles
+		assert.Contains(t, acls, "viewer")
+		assert.NotContains(t, acls, "editor")
+		assert.Equal(t, successBefore+1, aclReloadsSuccessTotal.Get())
+		assert.True(t, aclLastReloadSuccessful.Load())
+	})
+
+	t.Run("Unchanged file is not reloaded", func(t *testing.T) {
+		successBefore := aclReloadsSuccessTotal.Get()
+
+		app.reloadACLs(false)
+		assert.Equal(t, successBefore, aclReloadsSuccessTotal.Get())
+
+		// Forced reload (SIGHUP)
+		app.reloadACLs(true)
+		assert.Equal(t, successBefore+1, aclReloadsSuccessTotal.Get())
+	})
+
+	t.Run("Invalid file is rejected, old ACLs are kept", func(t *testing.T) {
+		failureBefore := aclReloadsFailureTotal.Get()
+
+		for _, content := range []string{"viewer: a b", "version: 2\nroles:\n  viewer:\n    lables: {}", ""} {
+			writeACL(content)
+			app.reloadACLs(false)
+			assert.Contains(t, app.ACLs.Load().Roles, "viewer")
+			assert.False(t, aclLastReloadSuccessful.Load())
+		}
+
+		assert.Equal(t, failureBefore+3, aclReloadsFailureTotal.Get())
+	})
+
+	t.Run("Unchanged invalid file is not reloaded", func(t *testing.T) {
+		failureBefore := aclReloadsFailureTotal.Get()
+
+		app.reloadACLs(false)
+		assert.Equal(t, failureBefore, aclReloadsFailureTotal.Get())
+		assert.False(t, aclLastReloadSuccessful.Load())
+
+		// Forced reload (SIGHUP)
+		app.reloadACLs(true)
+		assert.Equal(t, failureBefore+1, aclReloadsFailureTotal.Get())
+	})
+
+	t.Run("Missing file is rejected, old ACLs are kept", func(t *testing.T) {
+		failureBefore := aclReloadsFailureTotal.Get()
+
+		app := &application{
+			logger:  &logger,
+			ACLPath: filepath.Join(t.TempDir(), "missing.yaml"),
+			ACLs:    app.ACLs,
+		}
+		app.reloadACLs(true)
+		assert.Contains(t, app.ACLs.Load().Roles, "viewer")
+		assert.Equal(t, failureBefore+1, aclReloadsFailureTotal.Get())
+	})
+}
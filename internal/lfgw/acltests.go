@@ -0,0 +1,198 @@
+package lfgw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/urfave/cli/v2"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+	"gopkg.in/yaml.v3"
+)
+
+// aclTestFile describes a file with test cases for ACL definitions
+type aclTestFile struct {
+	Tests []aclTestCase `yaml:"tests"`
+}
+
+// aclTestCase describes a query expected to be either rewritten in a certain way or rejected for a user with the specified roles. A rejection means that the roles don't give access at all, unless Error is set, then any error containing Error is expected.
+type aclTestCase struct {
+	Name     string   `yaml:"name"`
+	Roles    []string `yaml:"roles"`
+	Query    string   `yaml:"query"`
+	Expected string   `yaml:"expected"`
+	Rejected bool     `yaml:"rejected"`
+	Error    string   `yaml:"error"`
+}
+
+// aclTestResult contains the outcome of a test case, Err is nil if the test case has passed
+type aclTestResult struct {
+	Name string
+	Err  error
+}
+
+// readACLTestFile reads and validates a file with test cases. Unknown fields are treated as errors to catch typos.
+func readACLTestFile(path string) (aclTestFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return aclTestFile{}, err
+	}
+
+	var f aclTestFile
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(&f)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return aclTestFile{}, err
+	}
+
+	if len(f.Tests) == 0 {
+		return aclTestFile{}, fmt.Errorf("%s does not contain any test cases", path)
+	}
+
+	for i, tc := range f.Tests {
+		if tc.Name == "" {
+			return aclTestFile{}, fmt.Errorf("test case #%d: name cannot be empty", i+1)
+		}
+
+		if tc.Query == "" {
+			return aclTestFile{}, fmt.Errorf("%s test case: query cannot be empty", tc.Name)
+		}
+
+		if (tc.Expected == "") == !tc.Rejected {
+			return aclTestFile{}, fmt.Errorf("%s test case: either expected or rejected has to be set", tc.Name)
+		}
+
+		if tc.Error != "" && !tc.Rejected {
+			return aclTestFile{}, fmt.Errorf("%s test case: error can be set only along with rejected", tc.Name)
+		}
+	}
+
+	return f, nil
+}
+
+// run executes the test case against the ACLs.
+func (tc aclTestCase) run(app *application, acls querymodifier.ACLs) error {
+	e, err := app.explain(acls, tc.Roles, tc.Query)
+
+	if tc.Rejected {
+		if err == nil {
+			return fmt.Errorf("expected the query to be rejected, got %s", e.ModifiedQuery)
+		}
+		if tc.Error != "" {
+			if !strings.Contains(err.Error(), tc.Error) {
+				return fmt.Errorf("expected an error containing %q, got: %s", tc.Error, err)
+			}
+			return nil
+		}
+		// Otherwise, e.g. a typo in the query would make the test case pass
+		var aclErr userACLError
+		if !errors.As(err, &aclErr) {
+			return fmt.Errorf("expected the roles to be rejected, got an error in the query: %s", err)
+		}
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("expected %s, got an error: %s", tc.Expected, err)
+	}
+
+	// Both expressions are formatted the same way, so that the test cases are not affected by whitespaces, quotes, etc. Queries of users with full access are not modified, thus they need to be formatted as well.
+	want, err := formatQuery(tc.Expected)
+	if err != nil {
+		return fmt.Errorf("failed to parse the expected query: %s", err)
+	}
+
+	got, err := formatQuery(e.ModifiedQuery)
+	if err != nil {
+		return fmt.Errorf("failed to parse the modified query: %s", err)
+	}
+
+	if want != got {
+		return fmt.Errorf("expected %s, got %s", want, got)
+	}
+
+	return nil
+}
+
+// formatQuery returns the query in the canonical form produced by metricsql.
+func formatQuery(query string) (string, error) {
+	expr, err := metricsql.Parse(query)
+	if err != nil {
+		return "", err
+	}
+
+	return string(expr.AppendString(nil)), nil
+}
+
+// runACLTests executes all test cases and returns their results in the order they're defined.
+func (app *application) runACLTests(acls querymodifier.ACLs, f aclTestFile) []aclTestResult {
+	results := make([]aclTestResult, 0, len(f.Tests))
+
+	for _, tc := range f.Tests {
+		results = append(results, aclTestResult{
+			Name: tc.Name,
+			Err:  tc.run(app, acls),
+		})
+	}
+
+	return results
+}
+
+// RunACLTests is used as an entrypoint for the "acl test" command. It runs test cases from a file (the first argument) against ACL definitions (the second argument or acl-path) and exits with a non-zero code if any of the test cases fail. Assumed roles, deduplication and optimization settings are taken from the global flags.
+func RunACLTests(c *cli.Context) error {
+	testsPath := c.Args().Get(0)
+	if testsPath == "" {
+		return cli.Exit("path to a file with test cases is not specified", 2)
+	}
+
+	app, err := newApplication(c)
+	if err != nil {
+		return cli.Exit(err, 2)
+	}
+
+	if aclPath := c.Args().Get(1); aclPath != "" {
+		app.ACLPath = aclPath
+	}
+
+	f, err := readACLTestFile(testsPath)
+	if err != nil {
+		return cli.Exit(err, 2)
+	}
+
+	w := c.App.Writer
+
+	acls, err := app.readACLs()
+	if err != nil {
+		for _, e := range unwrapErrors(err) {
+			fmt.Fprintf(w, "ERROR: %s\n", e)
+		}
+		return cli.Exit(fmt.Sprintf("%s is invalid", app.ACLPath), 1)
+	}
+
+	results := app.runACLTests(acls, f)
+
+	failed := []string{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Name)
+			fmt.Fprintf(w, "FAIL: %s: %s\n", r.Name, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS: %s\n", r.Name)
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(results)-len(failed), len(failed))
+
+	if len(failed) > 0 {
+		return cli.Exit(fmt.Sprintf("failed test cases: %s", strings.Join(failed, ", ")), 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package lfgw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func Test_readACLTestFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    aclTestFile
+		fail    bool
+	}{
+		{
+			name:    "Valid file",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expected: up\n  - name: b\n    roles: [team-b]\n    query: up\n    rejected: true\n",
+			want: aclTestFile{
+				Tests: []aclTestCase{
+					{Name: "a", Roles: []string{"team-a"}, Query: "up", Expected: "up"},
+					{Name: "b", Roles: []string{"team-b"}, Query: "up", Rejected: true},
+				},
+			},
+		},
+		{
+			name:    "Empty file",
+			content: "",
+			fail:    true,
+		},
+		{
+			name:    "Unknown field",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expect: up\n",
+			fail:    true,
+		},
+		{
+			name:    "No name",
+			content: "tests:\n  - roles: [team-a]\n    query: up\n    expected: up\n",
+			fail:    true,
+		},
+		{
+			name:    "No query",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    expected: up\n",
+			fail:    true,
+		},
+		{
+			name:    "Neither expected nor rejected",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n",
+			fail:    true,
+		},
+		{
+			name:    "Both expected and rejected",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expected: up\n    rejected: true\n",
+			fail:    true,
+		},
+		{
+			name:    "Error without rejected",
+			content: "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expected: up\n    error: cannot parse\n",
+			fail:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, "acl_test.yaml", tt.content)
+
+			got, err := readACLTestFile(path)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplication_runACLTests(t *testing.T) {
+	path := writeTestFile(t, "acl.yaml", "admin: .*\nteam-a: minio, stolon\n")
+
+	app := application{ACLPath: path, EnableDeduplication: true, OptimizeExpressions: true}
+	acls, err := app.readACLs()
+	assert.Nil(t, err)
+
+	f := aclTestFile{
+		Tests: []aclTestCase{
+			{Name: "rewritten", Roles: []string{"team-a"}, Query: "up", Expected: `up{namespace=~'minio|stolon'}`},
+			{Name: "full access", Roles: []string{"admin"}, Query: `up{ job = "a" }`, Expected: `up{job="a"}`},
+			{Name: "rejected", Roles: []string{"nobody"}, Query: "up", Rejected: true},
+			{Name: "not rejected", Roles: []string{"team-a"}, Query: "up", Rejected: true},
+			{Name: "query error is not a rejection", Roles: []string{"team-a"}, Query: "up{", Rejected: true},
+			{Name: "query error", Roles: []string{"team-a"}, Query: "up{", Rejected: true, Error: "unexpected token"},
+			{Name: "wrong error", Roles: []string{"nobody"}, Query: "up", Rejected: true, Error: "unexpected token"},
+			{Name: "wrong expectation", Roles: []string{"team-a"}, Query: "up", Expected: "up"},
+			{Name: "unexpected rejection", Roles: []string{"nobody"}, Query: "up", Expected: "up"},
+		},
+	}
+
+	results := app.runACLTests(acls, f)
+	assert.Len(t, results, len(f.Tests))
+
+	failed := []string{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Name)
+		}
+	}
+	assert.Equal(t, []string{"not rejected", "query error is not a rejection", "wrong error", "wrong expectation", "unexpected rejection"}, failed)
+}
+
+func TestRunACLTests(t *testing.T) {
+	aclPath := writeTestFile(t, "acl.yaml", "team-a: minio\n")
+
+	t.Run("Passed", func(t *testing.T) {
+		testsPath := writeTestFile(t, "acl_test.yaml", "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expected: 'up{namespace=\"minio\"}'\n")
+
+		c, out := newCommandContext(t, []string{testsPath, aclPath})
+		err := RunACLTests(c)
+		assert.Nil(t, err)
+		assert.Contains(t, out.String(), "PASS: a")
+		assert.Contains(t, out.String(), "1 passed, 0 failed")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		testsPath := writeTestFile(t, "acl_test.yaml", "tests:\n  - name: a\n    roles: [team-a]\n    query: up\n    expected: up\n")
+
+		c, out := newCommandContext(t, []string{testsPath, aclPath})
+		err := RunACLTests(c)
+		assert.NotNil(t, err)
+
+		exitErr, ok := err.(cli.ExitCoder)
+		assert.True(t, ok)
+		assert.Equal(t, 1, exitErr.ExitCode())
+		assert.Contains(t, out.String(), "FAIL: a")
+		assert.Contains(t, out.String(), "0 passed, 1 failed")
+	})
+}
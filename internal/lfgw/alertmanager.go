@@ -0,0 +1,351 @@
+package lfgw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// alertmanagerSilenceRe matches paths of Alertmanager API v2 endpoints for a single silence
+var alertmanagerSilenceRe = regexp.MustCompile(`^/api/v2/silence/([^/]+)$`)
+
+// alertmanagerMaxSize limits the size of requests to Alertmanager API and of silences fetched from the upstream
+const alertmanagerMaxSize = 1024 * 1024
+
+// alertmanagerFetchTimeout limits the time of fetching a silence from the upstream
+const alertmanagerFetchTimeout = 10 * time.Second
+
+// alertmanagerAlert describes the part of an Alertmanager alert used for filtering
+type alertmanagerAlert struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// alertmanagerSilence describes the part of an Alertmanager silence used for filtering
+type alertmanagerSilence struct {
+	ID       string                       `json:"id"`
+	Matchers []alertmanagerSilenceMatcher `json:"matchers"`
+}
+
+// alertmanagerSilenceMatcher describes a matcher of an Alertmanager silence. IsEqual is not set by older versions of Alertmanager, it's treated as true then.
+type alertmanagerSilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual"`
+}
+
+// labelFilters returns matchers of the silence as label filters.
+func (s alertmanagerSilence) labelFilters() []metricsql.LabelFilter {
+	filters := make([]metricsql.LabelFilter, 0, len(s.Matchers))
+
+	for _, m := range s.Matchers {
+		filters = append(filters, metricsql.LabelFilter{
+			Label:      m.Name,
+			Value:      m.Value,
+			IsRegexp:   m.IsRegex,
+			IsNegative: m.IsEqual != nil && !*m.IsEqual,
+		})
+	}
+
+	return filters
+}
+
+// handleAlertmanager limits requests to Alertmanager API v2 according to the ACL: alerts and silences in responses are filtered, silences can be created, updated and expired only if their matchers are confined to the ACL (see querymodifier.ACL.IsConfined), alerts can be posted only if their labels are allowed by the ACL. Other endpoints except for status and receivers are blocked.
+func (app *application) handleAlertmanager(w http.ResponseWriter, r *http.Request, acl querymodifier.ACL, next http.Handler) {
+	p := normalizeRoutePath(r.URL.Path)
+	silenceID := ""
+	if m := alertmanagerSilenceRe.FindStringSubmatch(p); m != nil {
+		silenceID = m[1]
+	}
+
+	e, err := querymodifier.NewSeriesEnforcer(acl, false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && p == "/api/v2/alerts":
+		r = withResponseFilter(r, func(body []byte) ([]byte, error) {
+			return filterAlertmanagerAlerts(body, e)
+		})
+	case r.Method == http.MethodGet && p == "/api/v2/alerts/groups":
+		r = withResponseFilter(r, func(body []byte) ([]byte, error) {
+			return filterAlertmanagerAlertGroups(body, e)
+		})
+	case r.Method == http.MethodGet && p == "/api/v2/silences":
+		r = withResponseFilter(r, func(body []byte) ([]byte, error) {
+			return filterAlertmanagerSilences(body, acl)
+		})
+	case r.Method == http.MethodGet && silenceID != "":
+		app.getAlertmanagerSilence(w, r, acl, silenceID)
+		return
+	case r.Method == http.MethodDelete && silenceID != "":
+		if err := app.checkAlertmanagerSilence(r, acl, silenceID); err != nil {
+			app.alertmanagerForbidden(w, r, err)
+			return
+		}
+	case r.Method == http.MethodPost && p == "/api/v2/silences":
+		if err := app.checkPostedAlertmanagerSilence(r, acl); err != nil {
+			app.alertmanagerForbidden(w, r, err)
+			return
+		}
+	case r.Method == http.MethodPost && p == "/api/v2/alerts":
+		if err := checkPostedAlertmanagerAlerts(r, e); err != nil {
+			app.alertmanagerForbidden(w, r, err)
+			return
+		}
+	case r.Method == http.MethodGet && (p == "/api/v2/status" || p == "/api/v2/receivers"):
+	default:
+		app.alertmanagerForbidden(w, r, fmt.Errorf("the endpoint is not allowed"))
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// alertmanagerForbidden logs the reason and sends 403 Forbidden to the user.
+func (app *application) alertmanagerForbidden(w http.ResponseWriter, r *http.Request, err error) {
+	hlog.FromRequest(r).Error().Caller().
+		Err(err).Msgf("Blocked a %s request to %s", r.Method, r.URL.Path)
+	app.clientErrorMessage(w, http.StatusForbidden, err)
+}
+
+// filterAlertmanagerAlerts returns a list of alerts without alerts not allowed by the ACL. Fields of the remaining alerts are kept as is.
+func filterAlertmanagerAlerts(body []byte, e *querymodifier.SeriesEnforcer) ([]byte, error) {
+	var alerts []json.RawMessage
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		return nil, err
+	}
+
+	filtered, err := filterAlertList(alerts, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(filtered)
+}
+
+// filterAlertList returns raw alerts (of Alertmanager or Prometheus) allowed by the ACL.
+func filterAlertList(alerts []json.RawMessage, e *querymodifier.SeriesEnforcer) ([]json.RawMessage, error) {
+	filtered := make([]json.RawMessage, 0, len(alerts))
+
+	for _, raw := range alerts {
+		var alert alertmanagerAlert
+		if err := json.Unmarshal(raw, &alert); err != nil {
+			return nil, err
+		}
+		if alert.Labels == nil {
+			alert.Labels = make(map[string]string)
+		}
+
+		if e.Enforce(alert.Labels) {
+			filtered = append(filtered, raw)
+		}
+	}
+
+	return filtered, nil
+}
+
+// filterAlertmanagerAlertGroups returns a list of alert groups with alerts not allowed by the ACL removed, groups without alerts are dropped.
+func filterAlertmanagerAlertGroups(body []byte, e *querymodifier.SeriesEnforcer) ([]byte, error) {
+	var groups []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &groups); err != nil {
+		return nil, err
+	}
+
+	filtered := make([]map[string]json.RawMessage, 0, len(groups))
+	for _, group := range groups {
+		var alerts []json.RawMessage
+		if raw, ok := group["alerts"]; ok {
+			if err := json.Unmarshal(raw, &alerts); err != nil {
+				return nil, err
+			}
+		}
+
+		alerts, err := filterAlertList(alerts, e)
+		if err != nil {
+			return nil, err
+		}
+		if len(alerts) == 0 {
+			continue
+		}
+
+		group["alerts"], err = json.Marshal(alerts)
+		if err != nil {
+			return nil, err
+		}
+		filtered = append(filtered, group)
+	}
+
+	return json.Marshal(filtered)
+}
+
+// filterAlertmanagerSilences returns a list of silences without silences, which are not confined to the ACL.
+func filterAlertmanagerSilences(body []byte, acl querymodifier.ACL) ([]byte, error) {
+	var silences []json.RawMessage
+	if err := json.Unmarshal(body, &silences); err != nil {
+		return nil, err
+	}
+
+	filtered := make([]json.RawMessage, 0, len(silences))
+	for _, raw := range silences {
+		var silence alertmanagerSilence
+		if err := json.Unmarshal(raw, &silence); err != nil {
+			return nil, err
+		}
+
+		if acl.IsConfined(silence.labelFilters()) {
+			filtered = append(filtered, raw)
+		}
+	}
+
+	return json.Marshal(filtered)
+}
+
+// fetchAlertmanagerSilence requests the silence from the upstream on behalf of the user. The raw response body is returned along with the status code.
+func (app *application) fetchAlertmanagerSilence(r *http.Request, id string) ([]byte, int, error) {
+	u := app.UpstreamURL.JoinPath("/api/v2/silence", id)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The same headers as for proxied requests (e.g. authorization, tenant)
+	req.Header = r.Header.Clone()
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+
+	client := &http.Client{
+		Transport: app.upstreamTransport(),
+		Timeout:   alertmanagerFetchTimeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, alertmanagerMaxSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, resp.StatusCode, nil
+}
+
+// checkAlertmanagerSilence returns an error if the existing silence is not confined to the ACL. Missing silences are not treated as errors, so that the upstream responds accordingly.
+func (app *application) checkAlertmanagerSilence(r *http.Request, acl querymodifier.ACL, id string) error {
+	body, status, err := app.fetchAlertmanagerSilence(r, id)
+	if err != nil {
+		return fmt.Errorf("failed to fetch silence %s: %s", id, err)
+	}
+
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("failed to fetch silence %s: upstream returned %d", id, status)
+	}
+
+	var silence alertmanagerSilence
+	if err := json.Unmarshal(body, &silence); err != nil {
+		return fmt.Errorf("failed to parse silence %s: %s", id, err)
+	}
+
+	if !acl.IsConfined(silence.labelFilters()) {
+		return fmt.Errorf("silence %s is not confined to the user's ACL", id)
+	}
+
+	return nil
+}
+
+// getAlertmanagerSilence responds with the silence if it's confined to the ACL, 404 Not Found is returned otherwise, so that other silences are not exposed.
+func (app *application) getAlertmanagerSilence(w http.ResponseWriter, r *http.Request, acl querymodifier.ACL, id string) {
+	body, status, err := app.fetchAlertmanagerSilence(r, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if status == http.StatusOK {
+		var silence alertmanagerSilence
+		if err := json.Unmarshal(body, &silence); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if !acl.IsConfined(silence.labelFilters()) {
+			hlog.FromRequest(r).Error().Caller().
+				Msgf("Silence %s is not confined to the user's ACL", id)
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// checkPostedAlertmanagerSilence returns an error if matchers of the posted silence are not confined to the ACL. If an existing silence is updated, then it has to be confined as well, as Alertmanager expires the original silence if matchers change. The request body is restored afterwards.
+func (app *application) checkPostedAlertmanagerSilence(r *http.Request, acl querymodifier.ACL) error {
+	body, err := readRequestBody(r, alertmanagerMaxSize)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	var silence alertmanagerSilence
+	if err := json.Unmarshal(body, &silence); err != nil {
+		return fmt.Errorf("failed to parse silence: %s", err)
+	}
+
+	if len(silence.Matchers) == 0 || !acl.IsConfined(silence.labelFilters()) {
+		return fmt.Errorf("silence matchers are not confined to the user's ACL")
+	}
+
+	if silence.ID != "" {
+		return app.checkAlertmanagerSilence(r, acl, silence.ID)
+	}
+
+	return nil
+}
+
+// checkPostedAlertmanagerAlerts returns an error if labels of any of the posted alerts are not allowed by the ACL. The request body is restored afterwards.
+func checkPostedAlertmanagerAlerts(r *http.Request, e *querymodifier.SeriesEnforcer) error {
+	body, err := readRequestBody(r, alertmanagerMaxSize)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	var alerts []json.RawMessage
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		return fmt.Errorf("failed to parse alerts: %s", err)
+	}
+
+	allowed, err := filterAlertList(alerts, e)
+	if err != nil {
+		return fmt.Errorf("failed to parse alerts: %s", err)
+	}
+
+	if len(allowed) != len(alerts) {
+		return fmt.Errorf("%d out of %d alerts are not allowed by the user's ACL", len(alerts)-len(allowed), len(alerts))
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package lfgw
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+const (
+	testAlerts = `[
+{"labels":{"alertname":"A","namespace":"minio"},"status":{"state":"active"}},
+{"labels":{"alertname":"B","namespace":"stolon"},"status":{"state":"active"}}
+]`
+	testAlertGroups = `[
+{"labels":{"alertname":"A"},"receiver":{"name":"team"},"alerts":[{"labels":{"alertname":"A","namespace":"minio"}},{"labels":{"alertname":"A","namespace":"stolon"}}]},
+{"labels":{"alertname":"B"},"receiver":{"name":"team"},"alerts":[{"labels":{"alertname":"B","namespace":"stolon"}}]}
+]`
+	testSilenceMinio  = `{"id":"1","matchers":[{"name":"namespace","value":"minio","isRegex":false,"isEqual":true}],"comment":"minio"}`
+	testSilenceStolon = `{"id":"2","matchers":[{"name":"namespace","value":"minio|stolon","isRegex":true}],"comment":"stolon"}`
+)
+
+// alertmanagerUpstreamServer returns a server responding with test silences on /api/v2/silence/<id>.
+func alertmanagerUpstreamServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	silences := map[string]string{
+		"1": testSilenceMinio,
+		"2": testSilenceStolon,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		silence, ok := silences[strings.TrimPrefix(r.URL.Path, "/api/v2/silence/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(silence))
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func Test_filterAlertmanagerAlerts(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := querymodifier.NewSeriesEnforcer(acl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := filterAlertmanagerAlerts([]byte(testAlerts), e)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[{"labels":{"alertname":"A","namespace":"minio"},"status":{"state":"active"}}]`, string(got))
+
+	got, err = filterAlertmanagerAlertGroups([]byte(testAlertGroups), e)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[{"labels":{"alertname":"A"},"receiver":{"name":"team"},"alerts":[{"labels":{"alertname":"A","namespace":"minio"}}]}]`, string(got))
+
+	_, err = filterAlertmanagerAlerts([]byte(`{"error":"not a list"}`), e)
+	assert.NotNil(t, err)
+}
+
+func Test_filterAlertmanagerSilences(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := filterAlertmanagerSilences([]byte("["+testSilenceMinio+","+testSilenceStolon+"]"), acl)
+	assert.Nil(t, err)
+	assert.JSONEq(t, "["+testSilenceMinio+"]", string(got))
+
+	acl, err = querymodifier.NewACL("minio, stolon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = filterAlertmanagerSilences([]byte("["+testSilenceMinio+","+testSilenceStolon+"]"), acl)
+	assert.Nil(t, err)
+	assert.JSONEq(t, "["+testSilenceMinio+","+testSilenceStolon+"]", string(got))
+}
+
+func TestApplication_fetchAlertmanagerSilence(t *testing.T) {
+	upstream := alertmanagerUpstreamServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Silences are fetched through the transport of the reverse proxy
+	var proxied []string
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		proxied = append(proxied, r.URL.Path)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	app := &application{
+		UpstreamURL: upstreamURL,
+		proxy:       proxy,
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v2/silence/1", nil)
+	body, status, err := app.fetchAlertmanagerSilence(r, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, testSilenceMinio, string(body))
+	assert.Equal(t, []string{"/api/v2/silence/1"}, proxied)
+}
+
+// roundTripperFunc is an adapter to use a function as http.RoundTripper.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip calls f(r).
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestApplication_handleAlertmanager(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	upstream := alertmanagerUpstreamServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger:         &logger,
+		UpstreamURL:    upstreamURL,
+		UpstreamFlavor: flavorAlertmanager,
+	}
+
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantFilter bool
+		wantBody   string
+	}{
+		{
+			name:       "Alerts are filtered",
+			method:     http.MethodGet,
+			path:       "/api/v2/alerts",
+			wantStatus: http.StatusOK,
+			wantFilter: true,
+		},
+		{
+			name:       "Alert groups are filtered",
+			method:     http.MethodGet,
+			path:       "/api/v2/alerts/groups",
+			wantStatus: http.StatusOK,
+			wantFilter: true,
+		},
+		{
+			name:       "Silences are filtered",
+			method:     http.MethodGet,
+			path:       "/api/v2/silences",
+			wantStatus: http.StatusOK,
+			wantFilter: true,
+		},
+		{
+			name:       "Status",
+			method:     http.MethodGet,
+			path:       "/api/v2/status",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Confined silence",
+			method:     http.MethodGet,
+			path:       "/api/v2/silence/1",
+			wantStatus: http.StatusOK,
+			wantBody:   testSilenceMinio,
+		},
+		{
+			name:       "Silence that is not confined is hidden",
+			method:     http.MethodGet,
+			path:       "/api/v2/silence/2",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Expire a confined silence",
+			method:     http.MethodDelete,
+			path:       "/api/v2/silence/1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Expire a silence that is not confined",
+			method:     http.MethodDelete,
+			path:       "/api/v2/silence/2",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Create a confined silence",
+			method:     http.MethodPost,
+			path:       "/api/v2/silences",
+			body:       `{"matchers":[{"name":"alertname","value":"A","isRegex":false},{"name":"namespace","value":"minio","isRegex":false}],"startsAt":"2023-01-01T00:00:00Z","endsAt":"2023-01-02T00:00:00Z","createdBy":"user","comment":"test"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Create a silence that is not confined",
+			method:     http.MethodPost,
+			path:       "/api/v2/silences",
+			body:       `{"matchers":[{"name":"alertname","value":"A","isRegex":false}],"comment":"test"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Update a silence that is not confined",
+			method:     http.MethodPost,
+			path:       "/api/v2/silences",
+			body:       `{"id":"2","matchers":[{"name":"namespace","value":"minio","isRegex":false}],"comment":"test"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Post allowed alerts",
+			method:     http.MethodPost,
+			path:       "/api/v2/alerts",
+			body:       `[{"labels":{"alertname":"A","namespace":"minio"}}]`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Post alerts that are not allowed",
+			method:     http.MethodPost,
+			path:       "/api/v2/alerts",
+			body:       `[{"labels":{"alertname":"A","namespace":"minio"}},{"labels":{"alertname":"B"}}]`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Unknown endpoint",
+			method:     http.MethodGet,
+			path:       "/api/v2/unknown",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(tt.method, "http://lfgw"+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyACL, acl))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, ok := r.Context().Value(contextKeyResponseFilter).(responseFilter)
+				assert.Equal(t, tt.wantFilter, ok)
+
+				// The body has to be restored after checks
+				body, err := io.ReadAll(r.Body)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.body, string(body))
+
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, rs.StatusCode)
+
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(rs.Body)
+				assert.Nil(t, err)
+				assert.True(t, json.Valid(body))
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
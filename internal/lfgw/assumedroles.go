@@ -0,0 +1,144 @@
+package lfgw
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// Reasons for rejecting assumed roles, used in logs and as metric labels
+const (
+	assumedRoleNotAllowed = "not_allowed"
+	assumedRoleDenied     = "denied"
+	assumedRoleNoPrefix   = "no_prefix"
+	assumedRoleNoSuffix   = "no_suffix"
+	assumedRoleEmpty      = "empty"
+	assumedRoleKnownRole  = "known_role"
+	assumedRoleInvalid    = "invalid"
+)
+
+var (
+	assumedRolesRejectedNotAllowed = metrics.NewCounter(`assumed_roles_rejected_total{reason="not_allowed"}`)
+	assumedRolesRejectedDenied     = metrics.NewCounter(`assumed_roles_rejected_total{reason="denied"}`)
+	assumedRolesRejectedNoPrefix   = metrics.NewCounter(`assumed_roles_rejected_total{reason="no_prefix"}`)
+	assumedRolesRejectedNoSuffix   = metrics.NewCounter(`assumed_roles_rejected_total{reason="no_suffix"}`)
+	assumedRolesRejectedEmpty      = metrics.NewCounter(`assumed_roles_rejected_total{reason="empty"}`)
+	assumedRolesRejectedKnownRole  = metrics.NewCounter(`assumed_roles_rejected_total{reason="known_role"}`)
+	assumedRolesRejectedInvalid    = metrics.NewCounter(`assumed_roles_rejected_total{reason="invalid"}`)
+)
+
+// assumedRolesRejectedCounters maps rejection reasons to the respective counters
+var assumedRolesRejectedCounters = map[string]*metrics.Counter{
+	assumedRoleNotAllowed: assumedRolesRejectedNotAllowed,
+	assumedRoleDenied:     assumedRolesRejectedDenied,
+	assumedRoleNoPrefix:   assumedRolesRejectedNoPrefix,
+	assumedRoleNoSuffix:   assumedRolesRejectedNoSuffix,
+	assumedRoleEmpty:      assumedRolesRejectedEmpty,
+	assumedRoleKnownRole:  assumedRolesRejectedKnownRole,
+	assumedRoleInvalid:    assumedRolesRejectedInvalid,
+}
+
+// compileAnchoredRegexp compiles a fully anchored regexp, nil is returned for an empty expression.
+func compileAnchoredRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// assumeRole returns a role name, which can be used as an ACL definition, or a reason why the role cannot be assumed. Allow and deny lists are checked against the original role name, a prefix and a suffix are stripped afterwards.
+func (app *application) assumeRole(role string, acls querymodifier.ACLs) (string, string) {
+	if app.AssumedRolesAllow != nil && !app.AssumedRolesAllow.MatchString(role) {
+		return "", assumedRoleNotAllowed
+	}
+
+	if app.AssumedRolesDeny != nil && app.AssumedRolesDeny.MatchString(role) {
+		return "", assumedRoleDenied
+	}
+
+	assumed := role
+
+	if app.AssumedRolesStripPrefix != "" {
+		if !strings.HasPrefix(assumed, app.AssumedRolesStripPrefix) {
+			return "", assumedRoleNoPrefix
+		}
+		assumed = strings.TrimPrefix(assumed, app.AssumedRolesStripPrefix)
+	}
+
+	if app.AssumedRolesStripSuffix != "" {
+		if !strings.HasSuffix(assumed, app.AssumedRolesStripSuffix) {
+			return "", assumedRoleNoSuffix
+		}
+		assumed = strings.TrimSuffix(assumed, app.AssumedRolesStripSuffix)
+	}
+
+	if assumed == "" {
+		return "", assumedRoleEmpty
+	}
+
+	// Otherwise, e.g. ns-grafana-admin would turn into a known role after stripping the prefix
+	if assumed != role && acls.IsKnownRole(assumed) {
+		return "", assumedRoleKnownRole
+	}
+
+	if app.AssumedRolesLiteral {
+		// NOTE: QuoteMeta doesn't escape commas, so a role like "a,b" would give access to both namespaces. Anchors and parentheses are trimmed from ACL definitions, so an escaped "a$" would lose the anchor, but keep the backslash
+		if strings.ContainsAny(assumed, ", \t\r\n^$()") {
+			return "", assumedRoleInvalid
+		}
+		assumed = regexp.QuoteMeta(assumed)
+	}
+
+	return assumed, ""
+}
+
+// rejectedRole describes an OIDC-role that cannot be assumed
+type rejectedRole struct {
+	Role   string `json:"role"`
+	Reason string `json:"reason"`
+}
+
+// assumeRoles returns roles with unknown roles transformed according to the assumed roles settings, the roles that cannot be assumed are returned separately along with the reasons. Known roles are returned as is.
+func (app *application) assumeRoles(roles []string, acls querymodifier.ACLs) ([]string, []rejectedRole) {
+	filtered := make([]string, 0, len(roles))
+	rejected := []rejectedRole{}
+
+	for _, role := range roles {
+		if acls.IsKnownRole(role) {
+			filtered = append(filtered, role)
+			continue
+		}
+
+		assumed, reason := app.assumeRole(role, acls)
+		if reason != "" {
+			rejected = append(rejected, rejectedRole{Role: role, Reason: reason})
+			continue
+		}
+
+		filtered = append(filtered, assumed)
+	}
+
+	return filtered, rejected
+}
+
+// filterAssumedRoles returns roles with unknown roles either transformed according to the assumed roles settings or dropped (see assumeRoles). Rejections are logged and counted.
+func (app *application) filterAssumedRoles(r *http.Request, roles []string, acls querymodifier.ACLs) []string {
+	filtered, rejected := app.assumeRoles(roles, acls)
+
+	rejectedNames := make([]string, 0, len(rejected))
+	for _, rr := range rejected {
+		assumedRolesRejectedCounters[rr.Reason].Inc()
+		rejectedNames = append(rejectedNames, rr.Role)
+		hlog.FromRequest(r).Info().Caller().
+			Msgf("Rejected assumed role %q (%s)", rr.Role, rr.Reason)
+	}
+
+	app.enrichLogContext(r, "rejected_assumed_roles", strings.Join(rejectedNames, ", "))
+
+	return filtered
+}
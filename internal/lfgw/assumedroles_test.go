@@ -0,0 +1,163 @@
+package lfgw
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func TestApp_assumeRole(t *testing.T) {
+	aclAdmin, err := querymodifier.NewACL(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acls := querymodifier.NewACLs(map[string]querymodifier.ACL{
+		"grafana-admin": aclAdmin,
+	})
+
+	tests := []struct {
+		name   string
+		app    application
+		role   string
+		want   string
+		reason string
+	}{
+		{
+			name: "No restrictions",
+			app:  application{},
+			role: "minio.*",
+			want: "minio.*",
+		},
+		{
+			name:   "Not in the allowlist",
+			app:    application{AssumedRolesAllow: regexp.MustCompile("^(?:ns-.+)$")},
+			role:   ".*",
+			reason: assumedRoleNotAllowed,
+		},
+		{
+			name:   "In the denylist",
+			app:    application{AssumedRolesDeny: regexp.MustCompile("^(?:ns-kube-.*)$")},
+			role:   "ns-kube-system",
+			reason: assumedRoleDenied,
+		},
+		{
+			name: "Prefix and suffix are stripped",
+			app:  application{AssumedRolesStripPrefix: "ns-", AssumedRolesStripSuffix: "-viewer"},
+			role: "ns-minio-viewer",
+			want: "minio",
+		},
+		{
+			name:   "No prefix",
+			app:    application{AssumedRolesStripPrefix: "ns-"},
+			role:   "minio",
+			reason: assumedRoleNoPrefix,
+		},
+		{
+			name:   "No suffix",
+			app:    application{AssumedRolesStripSuffix: "-viewer"},
+			role:   "minio",
+			reason: assumedRoleNoSuffix,
+		},
+		{
+			name:   "Nothing left after stripping",
+			app:    application{AssumedRolesStripPrefix: "ns-"},
+			role:   "ns-",
+			reason: assumedRoleEmpty,
+		},
+		{
+			name:   "Stripped name matches a known role",
+			app:    application{AssumedRolesStripPrefix: "ns-"},
+			role:   "ns-grafana-admin",
+			reason: assumedRoleKnownRole,
+		},
+		{
+			name: "Literal",
+			app:  application{AssumedRolesLiteral: true, AssumedRolesStripPrefix: "ns-"},
+			role: "ns-.*",
+			want: `\.\*`,
+		},
+		{
+			name: "Literal with special symbols",
+			app:  application{AssumedRolesLiteral: true},
+			role: "team.a|b*",
+			want: `team\.a\|b\*`,
+		},
+		{
+			name:   "Literal with anchors",
+			app:    application{AssumedRolesLiteral: true},
+			role:   "^(team.a)$",
+			reason: assumedRoleInvalid,
+		},
+		{
+			name:   "Literal with a trailing dollar sign",
+			app:    application{AssumedRolesLiteral: true},
+			role:   "ab$",
+			reason: assumedRoleInvalid,
+		},
+		{
+			name:   "Literal with parentheses",
+			app:    application{AssumedRolesLiteral: true},
+			role:   "a(b)",
+			reason: assumedRoleInvalid,
+		},
+		{
+			name:   "Literal with a comma",
+			app:    application{AssumedRolesLiteral: true},
+			role:   "minio,kube-system",
+			reason: assumedRoleInvalid,
+		},
+		{
+			name:   "Literal with whitespace",
+			app:    application{AssumedRolesLiteral: true},
+			role:   "minio kube-system",
+			reason: assumedRoleInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.app.assumeRole(tt.role, acls)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.reason, reason)
+
+			if tt.app.AssumedRolesLiteral && reason == "" {
+				acl, err := querymodifier.NewACL(got)
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]string{"namespace": got}, acl.RawACLs)
+			}
+		})
+	}
+}
+
+func TestApp_filterAssumedRoles(t *testing.T) {
+	aclAdmin, err := querymodifier.NewACL(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acls := querymodifier.NewACLs(map[string]querymodifier.ACL{
+		"grafana-admin": aclAdmin,
+	})
+
+	app := application{
+		AssumedRolesAllow: regexp.MustCompile("^(?:ns-.+)$"),
+		AssumedRolesDeny:  regexp.MustCompile("^(?:ns-kube-.*)$"),
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAllowedBefore := assumedRolesRejectedNotAllowed.Get()
+	deniedBefore := assumedRolesRejectedDenied.Get()
+
+	got := app.filterAssumedRoles(r, []string{"grafana-admin", "ns-minio", ".*", "ns-kube-system", "offline_access"}, acls)
+	assert.Equal(t, []string{"grafana-admin", "ns-minio"}, got)
+	assert.Equal(t, notAllowedBefore+2, assumedRolesRejectedNotAllowed.Get())
+	assert.Equal(t, deniedBefore+1, assumedRolesRejectedDenied.Get())
+}
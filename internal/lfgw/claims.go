@@ -0,0 +1,153 @@
+package lfgw
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultRolesClaim is used when no claim paths are configured
+const defaultRolesClaim = "roles"
+
+// claimPath is a parsed path to a claim in an access token, e.g. realm_access.roles -> ["realm_access", "roles"].
+type claimPath []string
+
+// parseClaimPath parses a dotted claim path. Segments containing dots have to be double-quoted, e.g. resource_access."my.client".roles.
+func parseClaimPath(s string) (claimPath, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("claim path cannot be empty")
+	}
+
+	path := claimPath{}
+	for len(s) > 0 {
+		var segment string
+
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote in claim path %q", s)
+			}
+			segment = s[1 : end+1]
+			s = s[end+2:]
+			if s != "" && s[0] != '.' {
+				return nil, fmt.Errorf("quoted segment has to be followed by a dot in claim path %q", s)
+			}
+		} else {
+			end := strings.IndexByte(s, '.')
+			if end == -1 {
+				end = len(s)
+			}
+			segment = s[:end]
+			s = s[end:]
+		}
+
+		if segment == "" {
+			return nil, fmt.Errorf("claim path contains an empty segment")
+		}
+		path = append(path, segment)
+
+		if s != "" {
+			// Skip the dot
+			s = s[1:]
+			if s == "" {
+				return nil, fmt.Errorf("claim path cannot end with a dot")
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// parseClaimPaths parses a list of claim paths.
+func parseClaimPaths(paths []string) ([]claimPath, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]claimPath, 0, len(paths))
+	for _, p := range paths {
+		path, err := parseClaimPath(p)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, path)
+	}
+
+	return parsed, nil
+}
+
+// String returns the claim path in the dotted notation, segments containing dots are quoted.
+func (p claimPath) String() string {
+	segments := make([]string, 0, len(p))
+	for _, s := range p {
+		if strings.Contains(s, ".") {
+			s = `"` + s + `"`
+		}
+		segments = append(segments, s)
+	}
+	return strings.Join(segments, ".")
+}
+
+// lookup returns the value the path points to. The second value is false if any of the segments is missing.
+func (p claimPath) lookup(claims map[string]interface{}) (interface{}, bool) {
+	var value interface{} = claims
+
+	for _, segment := range p {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		value, ok = m[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// extractRoles returns de-duplicated roles found by the specified claim paths (or by the default "roles" claim if no paths are specified). A claim can be either an array of strings or a space-separated string (like scope). Missing claims are skipped, claims of other types are treated as errors.
+func extractRoles(claims map[string]interface{}, paths []claimPath) ([]string, error) {
+	if len(paths) == 0 {
+		paths = []claimPath{{defaultRolesClaim}}
+	}
+
+	roles := []string{}
+	seen := make(map[string]struct{})
+	add := func(role string) {
+		if role == "" {
+			return
+		}
+		if _, ok := seen[role]; !ok {
+			seen[role] = struct{}{}
+			roles = append(roles, role)
+		}
+	}
+
+	for _, path := range paths {
+		value, ok := path.lookup(claims)
+		if !ok || value == nil {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			for _, role := range strings.Fields(v) {
+				add(role)
+			}
+		case []interface{}:
+			for _, item := range v {
+				role, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("claim %s contains a non-string value (%v)", path, item)
+				}
+				add(role)
+			}
+		default:
+			return nil, fmt.Errorf("claim %s has to be either an array of strings or a space-separated string, got %T", path, value)
+		}
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,143 @@
+package lfgw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseClaimPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want claimPath
+		fail bool
+	}{
+		{
+			name: "Single segment",
+			path: "roles",
+			want: claimPath{"roles"},
+		},
+		{
+			name: "Nested claim",
+			path: "realm_access.roles",
+			want: claimPath{"realm_access", "roles"},
+		},
+		{
+			name: "Quoted segment with dots",
+			path: `resource_access."my.client".roles`,
+			want: claimPath{"resource_access", "my.client", "roles"},
+		},
+		{
+			name: "Quoted last segment",
+			path: `claims."https://example.com/roles"`,
+			want: claimPath{"claims", "https://example.com/roles"},
+		},
+		{
+			name: "Empty path",
+			path: " ",
+			fail: true,
+		},
+		{
+			name: "Empty segment",
+			path: "realm_access..roles",
+			fail: true,
+		},
+		{
+			name: "Trailing dot",
+			path: "realm_access.",
+			fail: true,
+		},
+		{
+			name: "Unterminated quote",
+			path: `resource_access."my.client.roles`,
+			fail: true,
+		},
+		{
+			name: "Quoted segment is not followed by a dot",
+			path: `resource_access."my.client"roles`,
+			fail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseClaimPath(tt.path)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.path, got.String())
+		})
+	}
+}
+
+func Test_extractRoles(t *testing.T) {
+	claims := map[string]interface{}{
+		"roles": []interface{}{"role1", "role2"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"role2", "role3"},
+		},
+		"resource_access": map[string]interface{}{
+			"my.client": map[string]interface{}{
+				"roles": []interface{}{"role4"},
+			},
+		},
+		"scope":  "openid  email profile",
+		"groups": nil,
+		"exp":    float64(123),
+		"mixed":  []interface{}{"role1", float64(1)},
+	}
+
+	tests := []struct {
+		name  string
+		paths []claimPath
+		want  []string
+		fail  bool
+	}{
+		{
+			name:  "Default claim",
+			paths: nil,
+			want:  []string{"role1", "role2"},
+		},
+		{
+			name:  "Multiple claims are merged and de-duplicated",
+			paths: []claimPath{{"roles"}, {"realm_access", "roles"}, {"resource_access", "my.client", "roles"}},
+			want:  []string{"role1", "role2", "role3", "role4"},
+		},
+		{
+			name:  "Space-separated string",
+			paths: []claimPath{{"scope"}},
+			want:  []string{"openid", "email", "profile"},
+		},
+		{
+			name:  "Missing and null claims are skipped",
+			paths: []claimPath{{"groups"}, {"realm_access", "missing"}, {"scope", "nested"}, {"realm_access", "roles"}},
+			want:  []string{"role2", "role3"},
+		},
+		{
+			name:  "Unsupported type",
+			paths: []claimPath{{"exp"}},
+			fail:  true,
+		},
+		{
+			name:  "Non-string array items",
+			paths: []claimPath{{"mixed"}},
+			fail:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractRoles(claims, tt.paths)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
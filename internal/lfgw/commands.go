@@ -0,0 +1,202 @@
+package lfgw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// ValidateACL is used as an entrypoint for the "acl validate" command. It loads a file with ACL definitions (the first argument or acl-path), prints all errors and warnings, and exits with a non-zero code if the file is invalid (or, in strict mode, if there are any warnings).
+func ValidateACL(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		path = c.String("acl-path")
+	}
+	if path == "" {
+		return cli.Exit("path to a file with ACL definitions is not specified", 2)
+	}
+
+	w := c.App.Writer
+
+	acls, err := querymodifier.NewACLsFromFile(path)
+	if err != nil {
+		for _, e := range unwrapErrors(err) {
+			fmt.Fprintf(w, "ERROR: %s\n", e)
+		}
+		return cli.Exit(fmt.Sprintf("%s is invalid", path), 1)
+	}
+
+	warnings := acls.Lint(time.Now())
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+
+	if c.Bool("strict") && len(warnings) > 0 {
+		return cli.Exit(fmt.Sprintf("%s contains %d warning(s)", path, len(warnings)), 1)
+	}
+
+	fmt.Fprintf(w, "%s is valid: %d role(s), %d role pattern(s)\n", path, len(acls.Roles), len(acls.Patterns))
+
+	return nil
+}
+
+// explanation describes how a query would be rewritten for a user with the specified roles
+type explanation struct {
+	Roles                []string          `json:"roles"`
+	EffectiveRoles       []string          `json:"effective_roles"`
+	RejectedAssumedRoles []rejectedRole    `json:"rejected_assumed_roles"`
+	Fullaccess           bool              `json:"fullaccess"`
+	RawACLs              map[string]string `json:"raw_acls"`
+	LabelFilter          string            `json:"label_filter"`
+	EnableDeduplication  bool              `json:"enable_deduplication"`
+	OptimizeExpressions  bool              `json:"optimize_expressions"`
+	QueryDialect         string            `json:"query_dialect"`
+	Query                string            `json:"query"`
+	ModifiedQuery        string            `json:"modified_query"`
+	ExtraFilter          string            `json:"extra_filter,omitempty"`
+}
+
+// Explain is used as an entrypoint for the "explain" command. It shows how the query (the first argument) would be rewritten for a user with the specified roles. ACLs, assumed roles, deduplication and optimization settings are taken from the global flags, so the result is the same as for the proxy.
+func Explain(c *cli.Context) error {
+	query := c.Args().First()
+	if query == "" {
+		return cli.Exit("query is not specified", 2)
+	}
+
+	app, err := newApplication(c)
+	if err != nil {
+		return cli.Exit(err, 2)
+	}
+
+	acls, err := app.readACLs()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	e, err := app.explain(acls, c.StringSlice("roles"), query)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	w := c.App.Writer
+
+	if c.Bool("json") {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(e)
+	}
+
+	rejected := make([]string, 0, len(e.RejectedAssumedRoles))
+	for _, rr := range e.RejectedAssumedRoles {
+		rejected = append(rejected, fmt.Sprintf("%s (%s)", rr.Role, rr.Reason))
+	}
+
+	fmt.Fprintf(w, "Roles: %s\n", strings.Join(e.Roles, ", "))
+	if app.AssumedRolesEnabled {
+		fmt.Fprintf(w, "Effective roles: %s\n", strings.Join(e.EffectiveRoles, ", "))
+		fmt.Fprintf(w, "Rejected assumed roles: %s\n", strings.Join(rejected, ", "))
+	}
+	fmt.Fprintf(w, "Full access: %t\n", e.Fullaccess)
+	fmt.Fprintf(w, "Label filter: %s\n", e.LabelFilter)
+	fmt.Fprintf(w, "Deduplication: %t\n", e.EnableDeduplication)
+	fmt.Fprintf(w, "Optimization: %t\n", e.OptimizeExpressions)
+	fmt.Fprintf(w, "Query dialect: %s\n", e.QueryDialect)
+	fmt.Fprintf(w, "Query: %s\n", e.Query)
+	fmt.Fprintf(w, "Modified query: %s\n", e.ModifiedQuery)
+	if e.ExtraFilter != "" {
+		fmt.Fprintf(w, "Extra filter: %s\n", e.ExtraFilter)
+	}
+
+	return nil
+}
+
+// readACLs loads ACLs from app.ACLPath for commands, empty ACLs are returned if the path is not set.
+func (app *application) readACLs() (querymodifier.ACLs, error) {
+	if app.ACLPath == "" {
+		return querymodifier.NewACLs(make(map[string]querymodifier.ACL)), nil
+	}
+
+	return querymodifier.NewACLsFromFile(app.ACLPath)
+}
+
+// userACLError is returned by explain if no ACL can be constructed for the roles, as opposed to errors in the query
+type userACLError struct {
+	err error
+}
+
+// Error returns the message of the underlying error.
+func (e userACLError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error, so that it can be inspected with errors.Is and errors.As.
+func (e userACLError) Unwrap() error {
+	return e.err
+}
+
+// explain returns an explanation of how the query would be rewritten for a user with the roles. The same steps are performed as in oidcMiddleware and rewriteRequestMiddleware.
+func (app *application) explain(acls querymodifier.ACLs, roles []string, query string) (explanation, error) {
+	e := explanation{
+		Roles:                roles,
+		EffectiveRoles:       roles,
+		RejectedAssumedRoles: []rejectedRole{},
+		Query:                query,
+	}
+
+	if app.AssumedRolesEnabled {
+		e.EffectiveRoles, e.RejectedAssumedRoles = app.assumeRoles(roles, acls)
+	}
+
+	acl, err := acls.GetUserACL(e.EffectiveRoles, app.AssumedRolesEnabled)
+	if err != nil {
+		return explanation{}, userACLError{err: err}
+	}
+
+	qm := acl.QueryModifier(app.EnableDeduplication, app.OptimizeExpressions)
+	qm.StrictPromQL = app.queryDialect() == dialectPromQL
+	qm.ExtraFilters = app.useExtraFilters()
+
+	e.Fullaccess = acl.Fullaccess
+	e.RawACLs = acl.RawACLs
+	e.LabelFilter = acl.LabelFiltersString()
+	e.EnableDeduplication = qm.EnableDeduplication
+	e.OptimizeExpressions = qm.OptimizeExpressions
+	e.QueryDialect = app.queryDialect()
+
+	// Requests of users with full access are not modified
+	if acl.Fullaccess {
+		e.ModifiedQuery = query
+		return e, nil
+	}
+
+	encoded, err := qm.GetModifiedEncodedURLValues(url.Values{"query": {query}})
+	if err != nil {
+		return explanation{}, err
+	}
+
+	params, err := url.ParseQuery(encoded)
+	if err != nil {
+		return explanation{}, err
+	}
+	e.ModifiedQuery = params.Get("query")
+
+	if qm.ExtraFilters {
+		e.ExtraFilter = acl.ExtraFilter()
+	}
+
+	return e, nil
+}
+
+// unwrapErrors returns errors joined through errors.Join or a slice with the error itself.
+func unwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+
+	return []error{err}
+}
@@ -0,0 +1,226 @@
+package lfgw
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// newCommandContext returns a cli context for commands with the specified arguments and bool flags. The output is written to the returned buffer.
+func newCommandContext(t *testing.T, args []string, boolFlags ...string) (*cli.Context, *bytes.Buffer) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	app := &cli.App{Writer: &buf}
+
+	set := flag.NewFlagSet("test", 0)
+	for _, f := range boolFlags {
+		set.Bool(f, true, "doc")
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return cli.NewContext(app, set, nil), &buf
+}
+
+// writeTestFile writes content to a temporary file and returns its path.
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestValidateACL(t *testing.T) {
+	t.Run("Valid file", func(t *testing.T) {
+		path := writeTestFile(t, "acl.yaml", "admin: .*\nteam-a: team-a\n")
+
+		c, out := newCommandContext(t, []string{path})
+		err := ValidateACL(c)
+		assert.Nil(t, err)
+		assert.Contains(t, out.String(), "WARNING: admin role: gives full access")
+		assert.Contains(t, out.String(), "is valid: 2 role(s), 0 role pattern(s)")
+	})
+
+	t.Run("Warnings in strict mode", func(t *testing.T) {
+		path := writeTestFile(t, "acl.yaml", "admin: .*\n")
+
+		c, _ := newCommandContext(t, []string{path}, "strict")
+		err := ValidateACL(c)
+		assert.NotNil(t, err)
+
+		exitErr, ok := err.(cli.ExitCoder)
+		assert.True(t, ok)
+		assert.Equal(t, 1, exitErr.ExitCode())
+	})
+
+	t.Run("Invalid file", func(t *testing.T) {
+		path := writeTestFile(t, "acl.yaml", "team-a: a b\nteam-b: \"[\"\n")
+
+		c, out := newCommandContext(t, []string{path})
+		err := ValidateACL(c)
+		assert.NotNil(t, err)
+
+		exitErr, ok := err.(cli.ExitCoder)
+		assert.True(t, ok)
+		assert.Equal(t, 1, exitErr.ExitCode())
+		assert.Contains(t, out.String(), "ERROR: team-a role (line 1)")
+		assert.Contains(t, out.String(), "ERROR: team-b role (line 2)")
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		c, _ := newCommandContext(t, []string{filepath.Join(t.TempDir(), "missing.yaml")})
+		err := ValidateACL(c)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestApplication_explain(t *testing.T) {
+	path := writeTestFile(t, "acl.yaml", "admin: .*\nteam-a: minio, stolon\nteam-b: \"!kube-system\"\n")
+
+	tests := []struct {
+		name  string
+		app   application
+		roles []string
+		query string
+		want  explanation
+		fail  bool
+	}{
+		{
+			name:  "Limited role",
+			app:   application{ACLPath: path, EnableDeduplication: true, OptimizeExpressions: true},
+			roles: []string{"team-a"},
+			query: `up{namespace="kube-system"}`,
+			want: explanation{
+				Roles:                []string{"team-a"},
+				EffectiveRoles:       []string{"team-a"},
+				RejectedAssumedRoles: []rejectedRole{},
+				RawACLs:              map[string]string{"namespace": "minio, stolon"},
+				LabelFilter:          `namespace=~"minio|stolon"`,
+				EnableDeduplication:  true,
+				OptimizeExpressions:  true,
+				QueryDialect:         dialectMetricsQL,
+				Query:                `up{namespace="kube-system"}`,
+				ModifiedQuery:        `up{namespace="kube-system", namespace=~"minio|stolon"}`,
+			},
+		},
+		{
+			name:  "Full access",
+			app:   application{ACLPath: path},
+			roles: []string{"team-a", "admin"},
+			query: `up`,
+			want: explanation{
+				Roles:                []string{"team-a", "admin"},
+				EffectiveRoles:       []string{"team-a", "admin"},
+				RejectedAssumedRoles: []rejectedRole{},
+				Fullaccess:           true,
+				RawACLs:              map[string]string{"namespace": ".*"},
+				LabelFilter:          `namespace=~".*"`,
+				QueryDialect:         dialectMetricsQL,
+				Query:                `up`,
+				ModifiedQuery:        `up`,
+			},
+		},
+		{
+			name: "Assumed roles",
+			app: application{
+				ACLPath:             path,
+				AssumedRolesEnabled: true,
+				AssumedRolesDeny:    regexp.MustCompile(`^(?:x.*)$`),
+			},
+			roles: []string{"team-b", "xyz", "ns1"},
+			query: `up`,
+			want: explanation{
+				Roles:                []string{"team-b", "xyz", "ns1"},
+				EffectiveRoles:       []string{"team-b", "ns1"},
+				RejectedAssumedRoles: []rejectedRole{{Role: "xyz", Reason: assumedRoleDenied}},
+				RawACLs:              map[string]string{"namespace": ".*, !kube-system"},
+				LabelFilter:          `namespace!~"kube-system"`,
+				QueryDialect:         dialectMetricsQL,
+				Query:                `up`,
+				ModifiedQuery:        `up{namespace!~"kube-system"}`,
+			},
+		},
+		{
+			name:  "PromQL dialect for Prometheus",
+			app:   application{ACLPath: path, UpstreamFlavor: flavorPrometheus, QueryDialect: flavorAuto},
+			roles: []string{"team-a"},
+			query: `rate(up[5m])`,
+			want: explanation{
+				Roles:                []string{"team-a"},
+				EffectiveRoles:       []string{"team-a"},
+				RejectedAssumedRoles: []rejectedRole{},
+				RawACLs:              map[string]string{"namespace": "minio, stolon"},
+				LabelFilter:          `namespace=~"minio|stolon"`,
+				QueryDialect:         dialectPromQL,
+				Query:                `rate(up[5m])`,
+				ModifiedQuery:        `rate(up{namespace=~"minio|stolon"}[5m])`,
+			},
+		},
+		{
+			name:  "Extra filters for VictoriaMetrics",
+			app:   application{ACLPath: path, UpstreamFlavor: flavorVictoriaMetrics, EnforcementMode: enforcementExtraFilters},
+			roles: []string{"team-a"},
+			query: `up{namespace="kube-system"}`,
+			want: explanation{
+				Roles:                []string{"team-a"},
+				EffectiveRoles:       []string{"team-a"},
+				RejectedAssumedRoles: []rejectedRole{},
+				RawACLs:              map[string]string{"namespace": "minio, stolon"},
+				LabelFilter:          `namespace=~"minio|stolon"`,
+				QueryDialect:         dialectMetricsQL,
+				Query:                `up{namespace="kube-system"}`,
+				ModifiedQuery:        `up{namespace="kube-system"}`,
+				ExtraFilter:          `{namespace=~"minio|stolon"}`,
+			},
+		},
+		{
+			name:  "MetricsQL extension with PromQL dialect",
+			app:   application{ACLPath: path, QueryDialect: dialectPromQL},
+			roles: []string{"team-a"},
+			query: `rate(up)`,
+			fail:  true,
+		},
+		{
+			name:  "Unknown role",
+			app:   application{ACLPath: path},
+			roles: []string{"team-c"},
+			query: `up`,
+			fail:  true,
+		},
+		{
+			name:  "Invalid query",
+			app:   application{ACLPath: path},
+			roles: []string{"team-a"},
+			query: `up{`,
+			fail:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acls, err := tt.app.readACLs()
+			assert.Nil(t, err)
+
+			got, err := tt.app.explain(acls, tt.roles, tt.query)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
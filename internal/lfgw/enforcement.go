@@ -0,0 +1,89 @@
+package lfgw
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// Enforcement modes, which determine how label filters of an ACL are applied to requests
+const (
+	// enforcementRewrite means that metric expressions are rewritten
+	enforcementRewrite = "rewrite"
+	// enforcementExtraFilters means that metric expressions are left untouched, label filters are passed to VictoriaMetrics through extra_filters[]
+	enforcementExtraFilters = "extra-filters"
+)
+
+// extraFiltersFlavors lists flavors supporting extra_filters[]
+var extraFiltersFlavors = []string{flavorVictoriaMetrics, flavorVictoriaMetricsCluster}
+
+// validateEnforcementMode returns an error if the mode is not known or if it's not supported by the explicitly set upstream flavor. An empty mode is treated as enforcementRewrite.
+func validateEnforcementMode(mode string, upstreamFlavor string) error {
+	switch mode {
+	case "", enforcementRewrite:
+		return nil
+	case enforcementExtraFilters:
+		if upstreamFlavor != "" && upstreamFlavor != flavorAuto && !containsString(extraFiltersFlavors, upstreamFlavor) {
+			return fmt.Errorf("%s mode is not supported by %s", mode, upstreamFlavor)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q (supported: %s, %s)", mode, enforcementExtraFilters, enforcementRewrite)
+	}
+}
+
+// useExtraFilters returns true if label filters have to be passed through extra_filters[]. Expressions are rewritten until the upstream flavor is known to support extra_filters[], so that ACLs are enforced regardless of the upstream.
+func (app *application) useExtraFilters() bool {
+	return app.EnforcementMode == enforcementExtraFilters && containsString(extraFiltersFlavors, app.upstreamFlavor())
+}
+
+// Client extra filters policies, which determine how client-supplied extra_label / extra_filters[] are handled
+const (
+	// clientExtraFiltersStrip means that client-supplied extra filters are removed from requests
+	clientExtraFiltersStrip = "strip"
+	// clientExtraFiltersRewrite means that selectors in client-supplied extra_filters[] are rewritten according to an ACL, extra_label is validated
+	clientExtraFiltersRewrite = "rewrite"
+)
+
+var (
+	clientExtraFiltersStripped  = metrics.NewCounter(`client_extra_filters_total{action="strip"}`)
+	clientExtraFiltersRewritten = metrics.NewCounter(`client_extra_filters_total{action="rewrite"}`)
+)
+
+// validateClientExtraFilters returns an error if the policy is not known. An empty policy is treated as clientExtraFiltersStrip.
+func validateClientExtraFilters(policy string) error {
+	switch policy {
+	case "", clientExtraFiltersStrip, clientExtraFiltersRewrite:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q (supported: %s, %s)", policy, clientExtraFiltersRewrite, clientExtraFiltersStrip)
+	}
+}
+
+// logClientExtraFilters logs and counts client-supplied extra filters in the request, which are about to be stripped or rewritten. r.ParseForm is expected to be called beforehand.
+func (app *application) logClientExtraFilters(r *http.Request) {
+	var found []string
+	for _, p := range querymodifier.ExtraFilterParams {
+		for _, v := range r.Form[p] {
+			found = append(found, fmt.Sprintf("%s=%s", p, v))
+		}
+	}
+
+	if len(found) == 0 {
+		return
+	}
+
+	action := "stripped"
+	if app.ClientExtraFilters == clientExtraFiltersRewrite {
+		action = "rewritten"
+		clientExtraFiltersRewritten.Inc()
+	} else {
+		clientExtraFiltersStripped.Inc()
+	}
+
+	hlog.FromRequest(r).Warn().Caller().
+		Strs("extra_filters", found).Msgf("Client-supplied extra filters are %s", action)
+}
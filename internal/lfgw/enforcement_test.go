@@ -0,0 +1,56 @@
+package lfgw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateEnforcementMode(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           string
+		upstreamFlavor string
+		fail           bool
+	}{
+		{name: "Empty", mode: ""},
+		{name: "Rewrite", mode: enforcementRewrite, upstreamFlavor: flavorPrometheus},
+		{name: "Extra filters, auto flavor", mode: enforcementExtraFilters, upstreamFlavor: flavorAuto},
+		{name: "Extra filters, VictoriaMetrics cluster", mode: enforcementExtraFilters, upstreamFlavor: flavorVictoriaMetricsCluster},
+		{name: "Extra filters, Prometheus", mode: enforcementExtraFilters, upstreamFlavor: flavorPrometheus, fail: true},
+		{name: "Unknown", mode: "extra-label", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEnforcementMode(tt.mode, tt.upstreamFlavor)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestApplication_useExtraFilters(t *testing.T) {
+	app := &application{EnforcementMode: enforcementExtraFilters, UpstreamFlavor: flavorAuto}
+	assert.False(t, app.useExtraFilters(), "Flavor is not detected yet")
+
+	app.detectedFlavor = &flavorStore{}
+	app.detectedFlavor.Store(flavorThanos)
+	assert.False(t, app.useExtraFilters(), "Flavor doesn't support extra_filters[]")
+
+	app.detectedFlavor.Store(flavorVictoriaMetrics)
+	assert.True(t, app.useExtraFilters())
+
+	app.EnforcementMode = enforcementRewrite
+	assert.False(t, app.useExtraFilters())
+}
+
+func Test_validateClientExtraFilters(t *testing.T) {
+	assert.Nil(t, validateClientExtraFilters(""))
+	assert.Nil(t, validateClientExtraFilters(clientExtraFiltersStrip))
+	assert.Nil(t, validateClientExtraFilters(clientExtraFiltersRewrite))
+	assert.NotNil(t, validateClientExtraFilters("drop"))
+}
@@ -8,4 +8,5 @@ var (
 	errUpstreamNotInitialized = errors.New("UpstreamURL is not initialized")
 	errVerifierNotInitialized = errors.New("OIDC verifier is not initialized")
 	errACLNotSetInContext     = errors.New("ACL is not set in the context")
+	errNoMatchSelector        = errors.New("match[] has to be specified")
 )
@@ -0,0 +1,239 @@
+package lfgw
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Backend flavors, which determine built-in safe mode rules, parser strictness and endpoint handling
+const (
+	flavorPrometheus             = "prometheus"
+	flavorVictoriaMetrics        = "victoriametrics"
+	flavorVictoriaMetricsCluster = "victoriametrics-cluster"
+	flavorThanos                 = "thanos"
+	flavorMimir                  = "mimir"
+	flavorAlertmanager           = "alertmanager"
+	// flavorAll combines safe mode rules for all flavors
+	flavorAll = "all"
+	// flavorAuto means that the flavor is detected by probing the upstream
+	flavorAuto = "auto"
+)
+
+// upstreamFlavors lists flavors, which can be set explicitly or detected
+var upstreamFlavors = []string{flavorAlertmanager, flavorMimir, flavorPrometheus, flavorThanos, flavorVictoriaMetrics, flavorVictoriaMetricsCluster}
+
+// Query dialects, which determine the parser used for rewriting expressions
+const (
+	dialectPromQL    = "promql"
+	dialectMetricsQL = "metricsql"
+)
+
+// promQLFlavors lists flavors, which don't support MetricsQL extensions, so expressions are rewritten with the PromQL parser in auto mode
+var promQLFlavors = []string{flavorMimir, flavorPrometheus, flavorThanos}
+
+// flavorDetectionTimeout limits the time of a single detection attempt
+const flavorDetectionTimeout = 10 * time.Second
+
+// flavorDetectionMaxInterval limits the interval between detection attempts
+const flavorDetectionMaxInterval = time.Minute
+
+// validateUpstreamFlavor returns an error if the flavor is not known. An empty flavor is treated as flavorAuto.
+func validateUpstreamFlavor(flavor string) error {
+	if flavor == "" || flavor == flavorAuto {
+		return nil
+	}
+
+	if containsString(upstreamFlavors, flavor) {
+		return nil
+	}
+
+	return fmt.Errorf("unknown flavor %q (supported: %s, %s)", flavor, flavorAuto, strings.Join(upstreamFlavors, ", "))
+}
+
+// validateQueryDialect returns an error if the dialect is not known. An empty dialect is treated as flavorAuto.
+func validateQueryDialect(dialect string) error {
+	switch dialect {
+	case "", flavorAuto, dialectPromQL, dialectMetricsQL:
+		return nil
+	default:
+		return fmt.Errorf("unknown dialect %q (supported: %s, %s, %s)", dialect, flavorAuto, dialectMetricsQL, dialectPromQL)
+	}
+}
+
+// flavorStore holds the detected upstream flavor, which is set by a background goroutine while requests are being served.
+type flavorStore struct {
+	flavor atomic.Pointer[string]
+}
+
+// Load returns the detected flavor or an empty string if it's not known yet. It's safe to call on a nil store.
+func (s *flavorStore) Load() string {
+	if s == nil {
+		return ""
+	}
+
+	flavor := s.flavor.Load()
+	if flavor == nil {
+		return ""
+	}
+
+	return *flavor
+}
+
+// Store sets the detected flavor.
+func (s *flavorStore) Store(flavor string) {
+	s.flavor.Store(&flavor)
+}
+
+// upstreamFlavor returns the configured upstream flavor or, in auto mode, the detected one. An empty string is returned if the flavor is not detected yet.
+func (app *application) upstreamFlavor() string {
+	if app.UpstreamFlavor != "" && app.UpstreamFlavor != flavorAuto {
+		return app.UpstreamFlavor
+	}
+
+	return app.detectedFlavor.Load()
+}
+
+// queryDialect returns the configured query dialect or, in auto mode, the one matching the upstream flavor. MetricsQL is used until the flavor is detected, as it's a superset of PromQL.
+func (app *application) queryDialect() string {
+	if app.QueryDialect != "" && app.QueryDialect != flavorAuto {
+		return app.QueryDialect
+	}
+
+	if containsString(promQLFlavors, app.upstreamFlavor()) {
+		return dialectPromQL
+	}
+
+	return dialectMetricsQL
+}
+
+// buildInfoResponse describes the part of /api/v1/status/buildinfo response used for flavor detection
+type buildInfoResponse struct {
+	Data struct {
+		Application string `json:"application"`
+		Version     string `json:"version"`
+	} `json:"data"`
+}
+
+// detectFlavor probes the upstream to find out its flavor. Mimir is detected through /api/v1/status/buildinfo, other flavors - through build info metrics exposed on /metrics.
+func detectFlavor(ctx context.Context, client *http.Client, upstreamURL *url.URL) (string, error) {
+	body, err := probeUpstream(ctx, client, upstreamURL.JoinPath("/api/v1/status/buildinfo"))
+	if err == nil {
+		var info buildInfoResponse
+		if json.Unmarshal(body, &info) == nil && strings.Contains(strings.ToLower(info.Data.Application), "mimir") {
+			return flavorMimir, nil
+		}
+	}
+
+	// Metrics are usually exposed on the root path even if the API is available under a prefix
+	metricsURL := upstreamURL.ResolveReference(&url.URL{Path: "/metrics"})
+	body, err = probeUpstream(ctx, client, metricsURL)
+	if err != nil {
+		return "", err
+	}
+
+	return flavorFromMetrics(body)
+}
+
+// flavorFromMetrics returns the flavor based on build info metrics in the Prometheus text format.
+func flavorFromMetrics(body []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	// Some lines with labels might be longer than the default limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "vm_app_version{"):
+			// E.g. vm_app_version{version="vmselect-20230101-...", short_version="v1.86.0"} 1
+			if strings.Contains(line, `version="vmselect-`) {
+				return flavorVictoriaMetricsCluster, nil
+			}
+			return flavorVictoriaMetrics, nil
+		case strings.HasPrefix(line, "thanos_build_info{"), strings.HasPrefix(line, "thanos_build_info "):
+			return flavorThanos, nil
+		case strings.HasPrefix(line, "prometheus_build_info{"), strings.HasPrefix(line, "prometheus_build_info "):
+			return flavorPrometheus, nil
+		case strings.HasPrefix(line, "alertmanager_build_info{"), strings.HasPrefix(line, "alertmanager_build_info "):
+			return flavorAlertmanager, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("none of the known build info metrics found")
+}
+
+// probeUpstream sends a GET request and returns the response body, non-2xx responses are treated as errors.
+func probeUpstream(ctx context.Context, client *http.Client, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s", u.Redacted(), resp.Status)
+	}
+
+	// Responses are small, the limit is just a safety net
+	return io.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+}
+
+// configureUpstreamFlavor logs the upstream flavor and, in auto mode, starts its detection in the background. Detection stops once ctx is done.
+func (app *application) configureUpstreamFlavor(ctx context.Context) {
+	if app.UpstreamFlavor != "" && app.UpstreamFlavor != flavorAuto {
+		app.logger.Info().Caller().
+			Msgf("Upstream flavor: %s", app.UpstreamFlavor)
+		return
+	}
+
+	app.detectedFlavor = &flavorStore{}
+	go app.watchUpstreamFlavor(ctx)
+}
+
+// watchUpstreamFlavor tries to detect the upstream flavor until it succeeds or ctx is done. Attempts are retried with an exponential backoff, until then the most restrictive settings are used.
+func (app *application) watchUpstreamFlavor(ctx context.Context) {
+	client := &http.Client{Timeout: flavorDetectionTimeout}
+	interval := time.Second
+
+	for {
+		flavor, err := detectFlavor(ctx, client, app.UpstreamURL)
+		if err == nil {
+			app.detectedFlavor.Store(flavor)
+			app.logger.Info().Caller().
+				Msgf("Detected upstream flavor: %s", flavor)
+			return
+		}
+
+		app.logger.Warn().Caller().
+			Err(err).Msgf("Failed to detect upstream flavor, retrying in %s", interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > flavorDetectionMaxInterval {
+			interval = flavorDetectionMaxInterval
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package lfgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_flavorFromMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		want    string
+		fail    bool
+	}{
+		{
+			name:    "Prometheus",
+			metrics: "# HELP prometheus_build_info A metric with a constant '1' value.\n# TYPE prometheus_build_info gauge\nprometheus_build_info{branch=\"HEAD\",version=\"2.45.0\"} 1\n",
+			want:    flavorPrometheus,
+		},
+		{
+			name:    "VictoriaMetrics",
+			metrics: "vm_app_version{version=\"victoria-metrics-20230902-002838-tags-v1.93.3-0-g9e6b1c5e9\", short_version=\"v1.93.3\"} 1\n",
+			want:    flavorVictoriaMetrics,
+		},
+		{
+			name:    "VictoriaMetrics cluster",
+			metrics: "vm_app_version{version=\"vmselect-20230902-003138-tags-v1.93.3-cluster-0-g4c9ac2c3d\", short_version=\"v1.93.3\"} 1\n",
+			want:    flavorVictoriaMetricsCluster,
+		},
+		{
+			name:    "Thanos",
+			metrics: "thanos_build_info{branch=\"HEAD\",version=\"0.32.0\"} 1\n",
+			want:    flavorThanos,
+		},
+		{
+			name:    "Alertmanager",
+			metrics: "alertmanager_build_info{branch=\"HEAD\",version=\"0.26.0\"} 1\n",
+			want:    flavorAlertmanager,
+		},
+		{
+			name:    "Unknown",
+			metrics: "go_goroutines 10\n",
+			fail:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := flavorFromMetrics([]byte(tt.metrics))
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// flavorUpstreamServer returns a test server, which imitates the specified buildinfo and metrics responses. An empty response results in 404.
+func flavorUpstreamServer(t *testing.T, buildInfo string, metrics string) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/api/v1/status/buildinfo", "/prometheus/api/v1/status/buildinfo":
+			body = buildInfo
+		case "/metrics":
+			body = metrics
+		}
+
+		if body == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func Test_detectFlavor(t *testing.T) {
+	tests := []struct {
+		name      string
+		buildInfo string
+		metrics   string
+		path      string
+		want      string
+		fail      bool
+	}{
+		{
+			name:      "Mimir",
+			buildInfo: `{"status":"success","data":{"application":"Grafana Mimir","version":"2.9.0"}}`,
+			path:      "/prometheus",
+			want:      flavorMimir,
+		},
+		{
+			name:      "Prometheus",
+			buildInfo: `{"status":"success","data":{"version":"2.45.0"}}`,
+			metrics:   "prometheus_build_info{version=\"2.45.0\"} 1\n",
+			want:      flavorPrometheus,
+		},
+		{
+			name:    "VictoriaMetrics without buildinfo",
+			metrics: "vm_app_version{version=\"victoria-metrics-20230902\"} 1\n",
+			want:    flavorVictoriaMetrics,
+		},
+		{
+			name: "Unavailable metrics",
+			fail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := flavorUpstreamServer(t, tt.buildInfo, tt.metrics)
+			defer ts.Close()
+
+			upstreamURL, err := url.Parse(ts.URL + tt.path)
+			assert.Nil(t, err)
+
+			got, err := detectFlavor(context.Background(), ts.Client(), upstreamURL)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplication_watchUpstreamFlavor(t *testing.T) {
+	ts := flavorUpstreamServer(t, "", "thanos_build_info{version=\"0.32.0\"} 1\n")
+	defer ts.Close()
+
+	upstreamURL, err := url.Parse(ts.URL)
+	assert.Nil(t, err)
+
+	logger := zerolog.New(nil)
+	app := &application{
+		logger:      &logger,
+		UpstreamURL: upstreamURL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Equal(t, "", app.upstreamFlavor())
+
+	app.configureUpstreamFlavor(ctx)
+	assert.Eventually(t, func() bool {
+		return app.upstreamFlavor() == flavorThanos
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestApplication_upstreamFlavor(t *testing.T) {
+	detected := &flavorStore{}
+	detected.Store(flavorVictoriaMetrics)
+
+	tests := []struct {
+		name string
+		app  application
+		want string
+	}{
+		{
+			name: "Not detected yet",
+			app:  application{UpstreamFlavor: flavorAuto},
+			want: "",
+		},
+		{
+			name: "Detected",
+			app:  application{UpstreamFlavor: flavorAuto, detectedFlavor: detected},
+			want: flavorVictoriaMetrics,
+		},
+		{
+			name: "Explicit flavor takes precedence",
+			app:  application{UpstreamFlavor: flavorPrometheus, detectedFlavor: detected},
+			want: flavorPrometheus,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.app.upstreamFlavor())
+		})
+	}
+}
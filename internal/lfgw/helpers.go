@@ -2,6 +2,8 @@ package lfgw
 
 import (
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
@@ -56,18 +58,6 @@ func (app *application) getRawAccessToken(r *http.Request) (string, error) {
 	return "", errNoToken
 }
 
-// isNotAPIRequest returns true if the requested path does not target API or federate endpoints.
-func (app *application) isNotAPIRequest(path string) bool {
-	return !strings.Contains(path, "/api/") && !strings.Contains(path, "/federate")
-}
-
-// isUnsafePath returns true if the requested path targets a potentially dangerous endpoint (admin or remote write).
-func (app *application) isUnsafePath(path string) bool {
-	// TODO: move to regexp?
-	// TODO: more unsafe paths?
-	return strings.Contains(path, "/admin/tsdb") || strings.Contains(path, "/api/v1/write")
-}
-
 // unescapedURLQuery returns unescaped query string
 func (app *application) unescapedURLQuery(s string) string {
 	// We should never hit an error as we encoded query string ourselves. The undelying library returns an empty string in case of an error, error handling is left only for clarity.
@@ -78,3 +68,28 @@ func (app *application) unescapedURLQuery(s string) string {
 
 	return decoded
 }
+
+// readRequestBody reads and closes the request body, an error is returned if the body exceeds the limit.
+func readRequestBody(r *http.Request, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+
+	if len(data) > limit {
+		return nil, fmt.Errorf("request exceeds %d bytes", limit)
+	}
+
+	return data, nil
+}
+
+// isFormRequest returns true if the request body is URL-encoded form, which is read by r.ParseForm().
+func isFormRequest(r *http.Request) bool {
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return ct == "application/x-www-form-urlencoded"
+}
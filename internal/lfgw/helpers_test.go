@@ -95,78 +95,43 @@ func TestGetRawAccessToken(t *testing.T) {
 	}
 }
 
-func TestIsUnsafePath(t *testing.T) {
-	logger := zerolog.New(nil)
-	app := &application{
-		logger: &logger,
-	}
-
+func Test_isFormRequest(t *testing.T) {
 	tests := []struct {
-		name string
-		path string
-		want bool
+		name        string
+		contentType string
+		want        bool
 	}{
 		{
-			name: "tsdb",
-			path: "/admin/tsdb/1",
-			want: true,
+			name:        "Form",
+			contentType: "application/x-www-form-urlencoded",
+			want:        true,
 		},
 		{
-			name: "write",
-			path: "/api/v1/write",
-			want: true,
+			name:        "Form with parameters",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			want:        true,
 		},
 		{
-			name: "random endpoint",
-			path: "/api/v1/random",
-			want: false,
+			name:        "Protobuf",
+			contentType: "application/x-protobuf",
+			want:        false,
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := app.isUnsafePath(tt.path)
-			if got != tt.want {
-				t.Errorf("want %t; got %t", tt.want, got)
-			}
-		})
-	}
-}
-
-func TestIsNotAPIRequest(t *testing.T) {
-	logger := zerolog.New(nil)
-	app := &application{
-		logger: &logger,
-	}
-
-	tests := []struct {
-		name string
-		path string
-		want bool
-	}{
 		{
-			name: "api",
-			path: "/api/v1/query",
-			want: false,
-		},
-		{
-			name: "federate",
-			path: "/federate",
-			want: false,
-		},
-		{
-			name: "random endpoint",
-			path: "/metrics",
-			want: true,
+			name:        "No content type",
+			contentType: "",
+			want:        false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := app.isNotAPIRequest(tt.path)
-			if got != tt.want {
-				t.Errorf("want %t; got %t", tt.want, got)
+			r, err := http.NewRequest(http.MethodPost, "/", nil)
+			if err != nil {
+				t.Fatal(err)
 			}
+			r.Header.Set("Content-Type", tt.contentType)
+
+			assert.Equal(t, tt.want, isFormRequest(r))
 		})
 	}
 }
@@ -0,0 +1,420 @@
+package lfgw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// labelValuesPathRe matches normalized paths of label values endpoints and captures the label name
+var labelValuesPathRe = regexp.MustCompile(`^/api/v1/label/([^/]+)/values$`)
+
+// federateAccept is used for federation requests with response inspection, so that the response is in the text format regardless of the client preferences
+const federateAccept = "text/plain;version=0.0.4"
+
+// seriesInspector checks label sets of series in upstream responses against an ACL and counts violations
+type seriesInspector struct {
+	e       *querymodifier.SeriesEnforcer
+	path    string
+	dropped int
+}
+
+// keep returns true if the series is allowed by the ACL (see querymodifier.SeriesEnforcer.Violates), dropped series are counted in response_series_dropped_total.
+func (si *seriesInspector) keep(labels map[string]string) bool {
+	if !si.e.Violates(labels) {
+		return true
+	}
+
+	si.drop()
+
+	return false
+}
+
+// drop counts a dropped series (or a label name, label value) in response_series_dropped_total.
+func (si *seriesInspector) drop() {
+	si.dropped++
+	metrics.GetOrCreateCounter(fmt.Sprintf(`response_series_dropped_total{path=%q}`, si.path)).Inc()
+}
+
+// withResponseInspector returns the request with a responseStreamFilter dropping series that violate the ACL from the upstream response (query, query_range, series, federate, label names and label values endpoints). Requests to other endpoints are returned as is. It's a safety net against gaps in request rewrites, so every dropped series is logged and counted.
+func (app *application) withResponseInspector(r *http.Request, acl querymodifier.ACL) (*http.Request, error) {
+	e, err := querymodifier.NewSeriesEnforcer(acl, false)
+	if err != nil {
+		return nil, err
+	}
+
+	p := normalizeRoutePath(r.URL.Path)
+	si := &seriesInspector{e: e, path: p}
+
+	var filter responseStreamFilter
+	switch {
+	case p == "/api/v1/query", p == "/api/v1/query_range":
+		filter = func(dst io.Writer, src io.Reader) error {
+			return filterJSONArrayStream(dst, src, []string{"data", "result"}, si.keepQueryResult)
+		}
+	case p == "/api/v1/series":
+		filter = func(dst io.Writer, src io.Reader) error {
+			return filterJSONArrayStream(dst, src, []string{"data"}, si.keepSeries)
+		}
+	case p == "/api/v1/labels":
+		// Label names cannot be checked against the ACL, so the response is trusted only if it's limited by the rewritten match[]
+		applied, err := isMatchApplied(r, acl)
+		if err != nil {
+			return nil, err
+		}
+		if applied {
+			return r, nil
+		}
+		filter = func(dst io.Writer, src io.Reader) error {
+			return filterJSONArrayStream(dst, src, []string{"data"}, func(json.RawMessage) (bool, error) {
+				si.drop()
+				return false, nil
+			})
+		}
+	case labelValuesPathRe.MatchString(p):
+		name := labelValuesPathRe.FindStringSubmatch(p)[1]
+		filter = func(dst io.Writer, src io.Reader) error {
+			return filterJSONArrayStream(dst, src, []string{"data"}, func(raw json.RawMessage) (bool, error) {
+				var value string
+				if err := json.Unmarshal(raw, &value); err != nil {
+					return false, err
+				}
+				return si.keep(map[string]string{name: value}), nil
+			})
+		}
+	case p == "/federate":
+		r.Header.Set("Accept", federateAccept)
+		filter = func(dst io.Writer, src io.Reader) error {
+			return filterFederateStream(dst, src, si.keep)
+		}
+	default:
+		return r, nil
+	}
+
+	inspect := func(dst io.Writer, src io.Reader) error {
+		err := filter(dst, src)
+		if si.dropped > 0 {
+			hlog.FromRequest(r).Error().Caller().
+				Msgf("Dropped %d series violating the ACL from the response to %s", si.dropped, r.URL.Path)
+		}
+		return err
+	}
+
+	return withResponseStreamFilter(r, inspect), nil
+}
+
+// isMatchApplied returns true if the request contains match[] selectors (in the query or in the form-encoded body) and all of them are limited by the ACL (see querymodifier.ACL.IsApplied). The body is restored after reading.
+func isMatchApplied(r *http.Request, acl querymodifier.ACL) (bool, error) {
+	params := r.URL.Query()
+
+	if r.Body != nil && isFormRequest(r) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return false, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		postParams, err := url.ParseQuery(string(body))
+		if err != nil {
+			return false, err
+		}
+		params["match[]"] = append(params["match[]"], postParams["match[]"]...)
+	}
+
+	if len(params["match[]"]) == 0 {
+		return false, nil
+	}
+
+	for _, match := range params["match[]"] {
+		expr, err := metricsql.Parse(match)
+		if err != nil {
+			return false, nil
+		}
+		me, ok := expr.(*metricsql.MetricExpr)
+		if !ok || !acl.IsApplied(me.LabelFilters) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// keepQueryResult returns true if the element of a query result is allowed by the ACL. Elements of scalar and string results are always kept.
+func (si *seriesInspector) keepQueryResult(raw json.RawMessage) (bool, error) {
+	if len(raw) == 0 || raw[0] != '{' {
+		return true, nil
+	}
+
+	var result struct {
+		Metric map[string]string `json:"metric"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false, err
+	}
+
+	return si.keep(result.Metric), nil
+}
+
+// keepSeries returns true if the label set returned by /api/v1/series is allowed by the ACL.
+func (si *seriesInspector) keepSeries(raw json.RawMessage) (bool, error) {
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return false, err
+	}
+
+	return si.keep(labels), nil
+}
+
+// filterJSONArrayStream copies the JSON document from src to dst token by token, elements of the array found by the path of object keys are dropped unless keep returns true. Documents without such an array are copied unmodified.
+func filterJSONArrayStream(dst io.Writer, src io.Reader, path []string, keep func(raw json.RawMessage) (bool, error)) error {
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+	s := &jsonStream{dec: dec, w: bufio.NewWriter(dst), keep: keep}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if err := s.filter(tok, path); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+// jsonStream re-encodes tokens read from a JSON decoder, see filterJSONArrayStream
+type jsonStream struct {
+	dec  *json.Decoder
+	w    *bufio.Writer
+	keep func(raw json.RawMessage) (bool, error)
+}
+
+// filter copies the value starting with the token, the array found by the path is filtered.
+func (s *jsonStream) filter(tok json.Token, path []string) error {
+	delim, ok := tok.(json.Delim)
+	switch {
+	case ok && delim == '[' && len(path) == 0:
+		return s.filterArray()
+	case ok && delim == '{' && len(path) > 0:
+		return s.copyObject(path)
+	default:
+		return s.copy(tok)
+	}
+}
+
+// copy copies the value starting with the token.
+func (s *jsonStream) copy(tok json.Token) error {
+	switch tok {
+	case json.Delim('{'):
+		return s.copyObject(nil)
+	case json.Delim('['):
+		return s.copyArray()
+	}
+
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(b)
+
+	return err
+}
+
+// copyObject copies the object after the opening brace, the value of the key matching the path is filtered.
+func (s *jsonStream) copyObject(path []string) error {
+	s.w.WriteByte('{')
+
+	for i := 0; s.dec.More(); i++ {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected an object key, got %v", tok)
+		}
+
+		if i > 0 {
+			s.w.WriteByte(',')
+		}
+		if err := s.copy(key); err != nil {
+			return err
+		}
+		s.w.WriteByte(':')
+
+		tok, err = s.dec.Token()
+		if err != nil {
+			return err
+		}
+		if len(path) > 0 && key == path[0] {
+			err = s.filter(tok, path[1:])
+		} else {
+			err = s.copy(tok)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Closing brace
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+
+	return s.w.WriteByte('}')
+}
+
+// copyArray copies the array after the opening bracket.
+func (s *jsonStream) copyArray() error {
+	s.w.WriteByte('[')
+
+	for i := 0; s.dec.More(); i++ {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			s.w.WriteByte(',')
+		}
+		if err := s.copy(tok); err != nil {
+			return err
+		}
+	}
+
+	// Closing bracket
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+
+	return s.w.WriteByte(']')
+}
+
+// filterArray copies elements of the array after the opening bracket for which keep returns true.
+func (s *jsonStream) filterArray() error {
+	s.w.WriteByte('[')
+
+	kept := 0
+	for s.dec.More() {
+		var raw json.RawMessage
+		if err := s.dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		ok, err := s.keep(raw)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if kept > 0 {
+			s.w.WriteByte(',')
+		}
+		s.w.Write(raw)
+		kept++
+	}
+
+	// Closing bracket
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+
+	return s.w.WriteByte(']')
+}
+
+// filterFederateStream copies the response in the text exposition format from src to dst line by line, samples are dropped unless keep returns true for their labels. Comments (HELP, TYPE) preceding samples of a metric family are copied only along with the first kept sample, so that names of fully dropped families are not exposed either.
+func filterFederateStream(dst io.Writer, src io.Reader, keep func(labels map[string]string) bool) error {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 0, 64*1024), responseFilterMaxSize)
+	w := bufio.NewWriter(dst)
+
+	// Comments of the current metric family, which haven't been written yet
+	pending := []string{}
+	samplesSeen := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			// A comment after samples starts a new metric family
+			if samplesSeen {
+				pending = pending[:0]
+				samplesSeen = false
+			}
+			pending = append(pending, line)
+			continue
+		default:
+			samplesSeen = true
+
+			metric, err := sampleMetric(trimmed)
+			if err != nil {
+				return err
+			}
+
+			lbls, err := parser.ParseMetric(metric)
+			if err != nil {
+				return fmt.Errorf("failed to parse sample %q: %s", line, err)
+			}
+
+			if !keep(lbls.Map()) {
+				continue
+			}
+		}
+
+		for _, c := range pending {
+			w.WriteString(c)
+			w.WriteByte('\n')
+		}
+		pending = pending[:0]
+
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// sampleMetric returns the metric part of a sample line in the text exposition format (e.g. up{job="a"} for up{job="a"} 1).
+func sampleMetric(line string) (string, error) {
+	end := strings.IndexAny(line, " \t{")
+	if end < 0 {
+		return "", fmt.Errorf("incorrect sample %q", line)
+	}
+	if line[end] != '{' {
+		return line[:end], nil
+	}
+
+	inQuotes := false
+	for i := end + 1; i < len(line); i++ {
+		switch c := line[i]; {
+		case inQuotes && c == '\\':
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && c == '}':
+			return line[:i+1], nil
+		}
+	}
+
+	return "", fmt.Errorf("incorrect sample %q, unterminated label set", line)
+}
@@ -0,0 +1,247 @@
+package lfgw
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func TestApplication_withResponseInspector(t *testing.T) {
+	app := &application{}
+
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		query      url.Values
+		body       string
+		want       string
+		wantAccept string
+		wantErr    bool
+	}{
+		{
+			name: "Vector",
+			path: "/api/v1/query",
+			body: `{"status":"success","data":{"resultType":"vector","result":[
+{"metric":{"__name__":"up","namespace":"minio"},"value":[1700000000.123,"1"]},
+{"metric":{"__name__":"up","namespace":"stolon"},"value":[1700000000.123,"1"]},
+{"metric":{},"value":[1700000000.123,"2"]}
+]},"warnings":["<warning>"]}`,
+			want: `{"status":"success","data":{"resultType":"vector","result":[
+{"metric":{"__name__":"up","namespace":"minio"},"value":[1700000000.123,"1"]},
+{"metric":{},"value":[1700000000.123,"2"]}
+]},"warnings":["<warning>"]}`,
+		},
+		{
+			name: "Matrix with a VictoriaMetrics prefix",
+			path: "/select/0/prometheus/api/v1/query_range",
+			body: `{"status":"success","isPartial":false,"data":{"resultType":"matrix","result":[
+{"metric":{"namespace":"stolon"},"values":[[1700000000,"1"],[1700000015,"1"]]}
+]},"stats":{"seriesFetched":"1"}}`,
+			want: `{"status":"success","isPartial":false,"data":{"resultType":"matrix","result":[]},"stats":{"seriesFetched":"1"}}`,
+		},
+		{
+			name: "Scalar",
+			path: "/api/v1/query",
+			body: `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`,
+			want: `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`,
+		},
+		{
+			name: "Series",
+			path: "/api/v1/series",
+			body: `{"status":"success","data":[{"__name__":"up","namespace":"minio"},{"__name__":"up","namespace":"stolon"}]}`,
+			want: `{"status":"success","data":[{"__name__":"up","namespace":"minio"}]}`,
+		},
+		{
+			name: "Values of a label restricted by the ACL",
+			path: "/api/v1/label/namespace/values",
+			body: `{"status":"success","data":["minio","stolon"]}`,
+			want: `{"status":"success","data":["minio"]}`,
+		},
+		{
+			name: "Values of another label",
+			path: "/api/v1/label/job/values",
+			body: `{"status":"success","data":["minio","stolon"]}`,
+			want: `{"status":"success","data":["minio","stolon"]}`,
+		},
+		{
+			name: "Federate",
+			path: "/federate",
+			body: `# TYPE up untyped
+up{namespace="minio",instance="a{b}"} 1 1700000000000
+up{namespace="stolon",instance="a\"}"} 1 1700000000000
+up 1
+`,
+			want: `# TYPE up untyped
+up{namespace="minio",instance="a{b}"} 1 1700000000000
+up 1
+`,
+			wantAccept: federateAccept,
+		},
+		{
+			name: "Federate without any kept samples of a metric family",
+			path: "/federate",
+			body: `# HELP secret_total Secret.
+# TYPE secret_total counter
+secret_total{namespace="stolon"} 1
+# HELP up Up.
+# TYPE up untyped
+up{namespace="stolon"} 0
+up{namespace="minio"} 1
+`,
+			want: `# HELP up Up.
+# TYPE up untyped
+up{namespace="minio"} 1
+`,
+			wantAccept: federateAccept,
+		},
+		{
+			name: "Label names without match[]",
+			path: "/api/v1/labels",
+			body: `{"status":"success","data":["__name__","namespace","secret"]}`,
+			want: `{"status":"success","data":[]}`,
+		},
+		{
+			name:  "Label names with a match[] not limited by the ACL",
+			path:  "/api/v1/labels",
+			query: url.Values{"match[]": {"up", `{namespace="minio"}`}},
+			body:  `{"status":"success","data":["__name__","namespace","secret"]}`,
+			want:  `{"status":"success","data":[]}`,
+		},
+		{
+			name:    "Incorrect JSON",
+			path:    "/api/v1/series",
+			body:    `{"status":"success","data":[{"namespace":1}]}`,
+			wantErr: true,
+		},
+		{
+			name:       "Incorrect sample",
+			path:       "/federate",
+			body:       "up{namespace=\"minio\" 1\n",
+			wantAccept: federateAccept,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.URL.RawQuery = tt.query.Encode()
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyACL, acl))
+
+			r, err := app.withResponseInspector(r, acl)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantAccept, r.Header.Get("Accept"))
+
+			filter, ok := r.Context().Value(contextKeyResponseStreamFilter).(responseStreamFilter)
+			assert.True(t, ok)
+
+			var got bytes.Buffer
+			err = filter(&got, strings.NewReader(tt.body))
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			if tt.path == "/federate" {
+				assert.Equal(t, tt.want, got.String())
+			} else {
+				assert.JSONEq(t, tt.want, got.String())
+			}
+		})
+	}
+
+	t.Run("Label names limited by the ACL are not inspected", func(t *testing.T) {
+		params := url.Values{"match[]": {`{namespace="minio"}`}}
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/labels", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		r, err := app.withResponseInspector(r, acl)
+		assert.Nil(t, err)
+
+		_, ok := r.Context().Value(contextKeyResponseStreamFilter).(responseStreamFilter)
+		assert.False(t, ok)
+
+		// The body is still available for the upstream
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, params.Encode(), string(body))
+	})
+
+	t.Run("Other endpoints are not inspected", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/status/buildinfo", nil)
+
+		r, err := app.withResponseInspector(r, acl)
+		assert.Nil(t, err)
+
+		_, ok := r.Context().Value(contextKeyResponseStreamFilter).(responseStreamFilter)
+		assert.False(t, ok)
+	})
+}
+
+func Test_sampleMetric(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{line: `up 1`, want: `up`},
+		{line: `up{job="a b"} 1`, want: `up{job="a b"}`},
+		{line: `up{job="a\\"} 1`, want: `up{job="a\\"}`},
+		{line: `up{job="}"} 1`, want: `up{job="}"}`},
+		{line: `up{job="a"`, wantErr: true},
+		{line: `up`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := sampleMetric(tt.line)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_streamResponse(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/series", nil)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {"2"}},
+		Body:          io.NopCloser(strings.NewReader("ok")),
+		ContentLength: 2,
+		Request:       r,
+	}
+
+	streamResponse(resp, func(dst io.Writer, src io.Reader) error {
+		b, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(bytes.ToUpper(b))
+		return err
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", string(body))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "", resp.Header.Get("Content-Length"))
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"runtime"
 	"time"
 
@@ -20,14 +21,32 @@ import (
 // web application.
 type application struct {
 	UpstreamURL             *url.URL
+	UpstreamFlavor          string
 	OIDCRealmURL            string
 	OIDCClientID            string
 	ACLPath                 string
+	ACLReloadInterval       time.Duration
 	AssumedRolesEnabled     bool
+	AssumedRolesAllow       *regexp.Regexp
+	AssumedRolesDeny        *regexp.Regexp
+	AssumedRolesLiteral     bool
+	AssumedRolesStripPrefix string
+	AssumedRolesStripSuffix string
+	RolesClaims             []claimPath
 	EnableDeduplication     bool
 	OptimizeExpressions     bool
+	QueryDialect            string
+	EnforcementMode         string
+	ClientExtraFilters      string
+	WriteMode               string
+	InspectResponses        bool
 	SafeMode                bool
+	SafeModeFlavor          string
+	SafeModeAllow           []safeModeRule
+	SafeModeDeny            []safeModeRule
+	SafeModeExemptRoles     []string
 	SetProxyHeaders         bool
+	TenantHeader            string
 	SetGomaxProcs           bool
 	Debug                   bool
 	LogFormat               string
@@ -38,7 +57,8 @@ type application struct {
 	WriteTimeout            time.Duration
 	GracefulShutdownTimeout time.Duration
 	errorLog                *log.Logger
-	ACLs                    querymodifier.ACLs
+	ACLs                    *aclStore
+	detectedFlavor          *flavorStore
 	proxy                   *httputil.ReverseProxy
 	verifier                *oidc.IDTokenVerifier
 	logger                  *zerolog.Logger
@@ -63,16 +83,94 @@ func newApplication(c *cli.Context) (application, error) {
 		return application{}, fmt.Errorf("failed to parse upstream-url: %s", err)
 	}
 
+	assumedRolesAllow, err := compileAnchoredRegexp(c.String("assumed-roles-allow"))
+	if err != nil {
+		return application{}, fmt.Errorf("failed to parse assumed-roles-allow: %s", err)
+	}
+
+	assumedRolesDeny, err := compileAnchoredRegexp(c.String("assumed-roles-deny"))
+	if err != nil {
+		return application{}, fmt.Errorf("failed to parse assumed-roles-deny: %s", err)
+	}
+
+	rolesClaims, err := parseClaimPaths(c.StringSlice("roles-claims"))
+	if err != nil {
+		return application{}, fmt.Errorf("failed to parse roles-claims: %s", err)
+	}
+
+	upstreamFlavor := c.String("upstream-flavor")
+	if err := validateUpstreamFlavor(upstreamFlavor); err != nil {
+		return application{}, fmt.Errorf("failed to parse upstream-flavor: %s", err)
+	}
+
+	queryDialect := c.String("query-dialect")
+	if err := validateQueryDialect(queryDialect); err != nil {
+		return application{}, fmt.Errorf("failed to parse query-dialect: %s", err)
+	}
+
+	enforcementMode := c.String("enforcement-mode")
+	if err := validateEnforcementMode(enforcementMode, upstreamFlavor); err != nil {
+		return application{}, fmt.Errorf("failed to parse enforcement-mode: %s", err)
+	}
+
+	clientExtraFilters := c.String("client-extra-filters")
+	if err := validateClientExtraFilters(clientExtraFilters); err != nil {
+		return application{}, fmt.Errorf("failed to parse client-extra-filters: %s", err)
+	}
+
+	writeMode := c.String("write-mode")
+	if err := validateWriteMode(writeMode); err != nil {
+		return application{}, fmt.Errorf("failed to parse write-mode: %s", err)
+	}
+
+	tenantHeader := c.String("tenant-header")
+	if err := validateTenantHeader(tenantHeader); err != nil {
+		return application{}, fmt.Errorf("failed to parse tenant-header: %s", err)
+	}
+
+	safeModeFlavor := c.String("safe-mode-flavor")
+	if err := validateSafeModeFlavor(safeModeFlavor); err != nil {
+		return application{}, fmt.Errorf("failed to parse safe-mode-flavor: %s", err)
+	}
+
+	safeModeAllow, err := parseSafeModeRules(c.StringSlice("safe-mode-allow"))
+	if err != nil {
+		return application{}, fmt.Errorf("failed to parse safe-mode-allow: %s", err)
+	}
+
+	safeModeDeny, err := parseSafeModeRules(c.StringSlice("safe-mode-deny"))
+	if err != nil {
+		return application{}, fmt.Errorf("failed to parse safe-mode-deny: %s", err)
+	}
+
 	app := application{
 		UpstreamURL:             upstreamURL,
+		UpstreamFlavor:          upstreamFlavor,
 		OIDCRealmURL:            c.String("oidc-realm-url"),
 		OIDCClientID:            c.String("oidc-client-id"),
 		ACLPath:                 c.String("acl-path"),
+		ACLReloadInterval:       c.Duration("acl-reload-interval"),
 		AssumedRolesEnabled:     c.Bool("assumed-roles"),
+		AssumedRolesAllow:       assumedRolesAllow,
+		AssumedRolesDeny:        assumedRolesDeny,
+		AssumedRolesLiteral:     c.Bool("assumed-roles-literal"),
+		AssumedRolesStripPrefix: c.String("assumed-roles-strip-prefix"),
+		AssumedRolesStripSuffix: c.String("assumed-roles-strip-suffix"),
+		RolesClaims:             rolesClaims,
 		EnableDeduplication:     c.Bool("enable-deduplication"),
 		OptimizeExpressions:     c.Bool("optimize-expressions"),
+		QueryDialect:            queryDialect,
+		EnforcementMode:         enforcementMode,
+		ClientExtraFilters:      clientExtraFilters,
+		WriteMode:               writeMode,
+		InspectResponses:        c.Bool("inspect-responses"),
 		SafeMode:                c.Bool("safe-mode"),
+		SafeModeFlavor:          safeModeFlavor,
+		SafeModeAllow:           safeModeAllow,
+		SafeModeDeny:            safeModeDeny,
+		SafeModeExemptRoles:     c.StringSlice("safe-mode-exempt-roles"),
 		SetProxyHeaders:         c.Bool("set-proxy-headers"),
+		TenantHeader:            tenantHeader,
 		SetGomaxProcs:           c.Bool("set-gomax-procs"),
 		Debug:                   c.Bool("debug"),
 		LogFormat:               c.String("log-format"),
@@ -109,6 +207,15 @@ func (app *application) Run() {
 	app.logger.Info().Caller().
 		Msgf("Runtime settings: GOMAXPROCS = %d", runtime.GOMAXPROCS(0))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if app.ACLPath != "" {
+		go app.watchACLs(ctx)
+	}
+
+	app.configureUpstreamFlavor(ctx)
+
 	err := app.serve()
 	if err != nil {
 		app.logger.Fatal().Caller().
@@ -116,7 +223,7 @@ func (app *application) Run() {
 	}
 }
 
-// configureACLs logs assumed roles mode, verifies current ACLs settings (assumed roles, aclpath), loads the ACLs from a file and logs roles if needed
+// configureACLs logs assumed roles mode, verifies current ACLs settings (assumed roles, aclpath), loads the ACLs from a file and logs roles if needed. Further reloads are handled by app.watchACLs.
 func (app *application) configureACLs() {
 	// Just to make sure our logging calls are always safe
 	if app.logger == nil {
@@ -141,21 +248,18 @@ func (app *application) configureACLs() {
 		app.logger.Info().Caller().
 			Msgf("ACL_PATH is empty, thus predefined roles will not be loaded")
 
+		app.ACLs = newACLStore(querymodifier.ACLs{})
+
 		return
 	}
 
-	var err error
-
-	app.ACLs, err = querymodifier.NewACLsFromFile(app.ACLPath)
+	_, err := app.loadACLs(true)
 	if err != nil {
 		app.logger.Fatal().Caller().
 			Err(err).Msgf("Failed to load ACL")
 	}
 
-	for role, acl := range app.ACLs {
-		app.logger.Info().Caller().
-			Msgf("Loaded role definition for %s: %q (converted to %s)", role, acl.RawACL, acl.LabelFilter.AppendString(nil))
-	}
+	app.logACLs()
 }
 
 // configureOIDCVerifier sets up OIDC token verifier by using app.OIDCRealmURL and app.OIDCClientID
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"net/url"
+	"regexp"
 	"testing"
 	"time"
 
@@ -43,6 +44,10 @@ func Test_newApplication(t *testing.T) {
 			name: "safe-mode",
 			want: application{SafeMode: true},
 		},
+		{
+			name: "inspect-responses",
+			want: application{InspectResponses: true},
+		},
 		{
 			name: "set-proxy-headers",
 			want: application{SetProxyHeaders: true},
@@ -55,6 +60,10 @@ func Test_newApplication(t *testing.T) {
 			name: "assumed-roles",
 			want: application{AssumedRolesEnabled: true},
 		},
+		{
+			name: "assumed-roles-literal",
+			want: application{AssumedRolesLiteral: true},
+		},
 	}
 
 	for _, tt := range tests {
@@ -74,14 +83,32 @@ func Test_newApplication(t *testing.T) {
 
 	t.Run("Full application struct", func(t *testing.T) {
 		upstreamURL := "http://localhost"
+		upstreamFlavor := "victoriametrics"
 		oidcRealmURL := "http://localhost2"
 		oidcClientID := "grafana"
 		aclPath := "ACL.yaml"
+		aclReloadInterval := 5 * time.Second
 		assumedRoles := true
+		assumedRolesAllow := "ns-.+"
+		assumedRolesDeny := "ns-kube-.*"
+		assumedRolesLiteral := true
+		assumedRolesStripPrefix := "ns-"
+		assumedRolesStripSuffix := "-viewer"
+		rolesClaims := cli.NewStringSlice("roles", "realm_access.roles", `resource_access."my.client".roles`)
 		enableDeduplication := true
 		optimizeExpression := true
+		queryDialect := "promql"
+		enforcementMode := "rewrite"
+		clientExtraFilters := "rewrite"
+		writeMode := "reject"
+		inspectResponses := true
 		safeMode := true
+		safeModeFlavor := "prometheus"
+		safeModeAllow := cli.NewStringSlice("GET /api/v1/admin/tsdb/snapshot")
+		safeModeDeny := cli.NewStringSlice("/api/v1/custom/*")
+		safeModeExemptRoles := cli.NewStringSlice("admin")
 		setProxyHeaders := true
+		tenantHeader := "X-Scope-OrgID"
 		setGomaxProcs := true
 		debug := true
 		logFormat := "json"
@@ -94,14 +121,32 @@ func Test_newApplication(t *testing.T) {
 
 		set := flag.NewFlagSet("test", 0)
 		set.String("upstream-url", upstreamURL, "doc")
+		set.String("upstream-flavor", upstreamFlavor, "doc")
 		set.String("oidc-realm-url", oidcRealmURL, "doc")
 		set.String("oidc-client-id", oidcClientID, "doc")
 		set.String("acl-path", aclPath, "doc")
+		set.Duration("acl-reload-interval", aclReloadInterval, "doc")
 		set.Bool("assumed-roles", assumedRoles, "doc")
+		set.String("assumed-roles-allow", assumedRolesAllow, "doc")
+		set.String("assumed-roles-deny", assumedRolesDeny, "doc")
+		set.Bool("assumed-roles-literal", assumedRolesLiteral, "doc")
+		set.String("assumed-roles-strip-prefix", assumedRolesStripPrefix, "doc")
+		set.String("assumed-roles-strip-suffix", assumedRolesStripSuffix, "doc")
+		set.Var(rolesClaims, "roles-claims", "doc")
 		set.Bool("enable-deduplication", enableDeduplication, "doc")
 		set.Bool("optimize-expressions", optimizeExpression, "doc")
+		set.String("query-dialect", queryDialect, "doc")
+		set.String("enforcement-mode", enforcementMode, "doc")
+		set.String("client-extra-filters", clientExtraFilters, "doc")
+		set.String("write-mode", writeMode, "doc")
+		set.Bool("inspect-responses", inspectResponses, "doc")
 		set.Bool("safe-mode", safeMode, "doc")
+		set.String("safe-mode-flavor", safeModeFlavor, "doc")
+		set.Var(safeModeAllow, "safe-mode-allow", "doc")
+		set.Var(safeModeDeny, "safe-mode-deny", "doc")
+		set.Var(safeModeExemptRoles, "safe-mode-exempt-roles", "doc")
 		set.Bool("set-proxy-headers", setProxyHeaders, "doc")
+		set.String("tenant-header", tenantHeader, "doc")
 		set.Bool("set-gomax-procs", setGomaxProcs, "doc")
 		set.Bool("debug", debug, "doc")
 		set.String("log-format", logFormat, "doc")
@@ -118,14 +163,32 @@ func Test_newApplication(t *testing.T) {
 
 		want := application{
 			UpstreamURL:             appUpstreamURL,
+			UpstreamFlavor:          upstreamFlavor,
 			OIDCRealmURL:            oidcRealmURL,
 			OIDCClientID:            oidcClientID,
 			ACLPath:                 aclPath,
+			ACLReloadInterval:       aclReloadInterval,
 			AssumedRolesEnabled:     assumedRoles,
+			AssumedRolesAllow:       regexp.MustCompile("^(?:ns-.+)$"),
+			AssumedRolesDeny:        regexp.MustCompile("^(?:ns-kube-.*)$"),
+			AssumedRolesLiteral:     assumedRolesLiteral,
+			AssumedRolesStripPrefix: assumedRolesStripPrefix,
+			AssumedRolesStripSuffix: assumedRolesStripSuffix,
+			RolesClaims:             []claimPath{{"roles"}, {"realm_access", "roles"}, {"resource_access", "my.client", "roles"}},
 			OptimizeExpressions:     optimizeExpression,
 			EnableDeduplication:     enableDeduplication,
+			QueryDialect:            queryDialect,
+			EnforcementMode:         enforcementMode,
+			ClientExtraFilters:      clientExtraFilters,
+			WriteMode:               writeMode,
+			InspectResponses:        inspectResponses,
 			SafeMode:                safeMode,
+			SafeModeFlavor:          safeModeFlavor,
+			SafeModeAllow:           []safeModeRule{{Method: "GET", Pattern: "/api/v1/admin/tsdb/snapshot"}},
+			SafeModeDeny:            []safeModeRule{{Pattern: "/api/v1/custom/*"}},
+			SafeModeExemptRoles:     []string{"admin"},
 			SetProxyHeaders:         setProxyHeaders,
+			TenantHeader:            tenantHeader,
 			SetGomaxProcs:           setGomaxProcs,
 			Debug:                   debug,
 			LogFormat:               logFormat,
@@ -142,6 +205,124 @@ func Test_newApplication(t *testing.T) {
 
 		assert.Equal(t, want, got)
 	})
+
+	t.Run("Incorrect assumed-roles-allow", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("assumed-roles-allow", "ns-(", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect assumed-roles-deny", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("assumed-roles-deny", "ns-(", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect upstream-flavor", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("upstream-flavor", "cortex", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect query-dialect", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("query-dialect", "logql", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect enforcement-mode", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("enforcement-mode", "extra-label", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("enforcement-mode is not supported by upstream-flavor", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("upstream-flavor", "prometheus", "doc")
+		set.String("enforcement-mode", "extra-filters", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect client-extra-filters", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("client-extra-filters", "drop", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect write-mode", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("write-mode", "drop", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect tenant-header", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("tenant-header", "X-Scope OrgID", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect safe-mode-flavor", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.String("safe-mode-flavor", "thanos2", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect safe-mode-allow", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.Var(cli.NewStringSlice("GET /api/v1/[admin"), "safe-mode-allow", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect safe-mode-deny", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.Var(cli.NewStringSlice("api/v1/custom"), "safe-mode-deny", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Incorrect roles-claims", func(t *testing.T) {
+		set := flag.NewFlagSet("test", 0)
+		set.Var(cli.NewStringSlice(`resource_access."my.client`), "roles-claims", "doc")
+		c := cli.NewContext(nil, set, nil)
+
+		_, err := newApplication(c)
+		assert.NotNil(t, err)
+	})
 }
 
 func TestApp_configureOIDCVerifier(t *testing.T) {
@@ -166,13 +347,13 @@ func TestApp_configureOIDCVerifier(t *testing.T) {
 
 	// A type that will be used for generating token claims
 	type testClaims struct {
-		userClaims
+		tokenClaims
 		jwt.StandardClaims
 	}
 
 	t.Run("Valid token", func(t *testing.T) {
 		claims := testClaims{
-			userClaims{
+			tokenClaims{
 				Roles: []string{"random-role"},
 				Email: "random-email@localhost",
 			},
@@ -194,7 +375,7 @@ func TestApp_configureOIDCVerifier(t *testing.T) {
 
 	t.Run("Incorrent token", func(t *testing.T) {
 		claims := testClaims{
-			userClaims{
+			tokenClaims{
 				Roles: []string{"random-role"},
 				Email: "random-email@localhost",
 			},
@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,10 +18,8 @@ type contextKey string
 
 const contextKeyACL = contextKey("acl")
 
-type userClaims struct {
-	Roles []string `json:"roles"`
-	Email string   `json:"email"`
-}
+// contextKeyRoles is used to store roles found in the access token (before assumed roles are applied)
+const contextKeyRoles = contextKey("roles")
 
 var (
 	requestsTotal      = metrics.NewCounter("requests_total")
@@ -28,6 +28,17 @@ var (
 	queryRangeDuration = metrics.NewSummary(`request_duration_seconds{path="/api/v1/query_range"}`)
 )
 
+// normalizePathMiddleware cleans the request path (duplicate slashes, dot segments, a trailing slash), so that routing decisions and endpoint checks are based on the same path as the one forwarded to the upstream.
+func (app *application) normalizePathMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = cleanPath(r.URL.Path)
+		// RawPath would take precedence over Path if it's still a valid encoding of Path, so it's safer to drop it
+		r.URL.RawPath = ""
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // nonProxiedEndpointsMiddleware is a workaround to support healthz and metrics endpoints while forwarding everything else to an upstream.
 func (app *application) nonProxiedEndpointsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -57,11 +68,13 @@ func (app *application) logAndMetricsMiddleware(next http.Handler) http.Handler
 				return
 			}
 
-			// Once r.ParseForm() is called, we need to update ContentLength, otherwise the request will fail. r.PostForm contains data for PATCH, POST, and PUT requests.
+			// Once r.ParseForm() is called, we need to update ContentLength, otherwise the request will fail. r.PostForm contains data for PATCH, POST, and PUT requests. Other bodies (e.g. remote read / write requests) are not read by r.ParseForm(), so they're left untouched.
 			postForm := r.PostForm.Encode()
-			newBody := strings.NewReader(postForm)
-			r.ContentLength = newBody.Size()
-			r.Body = io.NopCloser(newBody)
+			if isFormRequest(r) {
+				newBody := strings.NewReader(postForm)
+				r.ContentLength = newBody.Size()
+				r.Body = io.NopCloser(newBody)
+			}
 
 			// If any of those are empty, they won't get logged
 			app.enrichDebugLogContext(r, "get_params", app.unescapedURLQuery(r.URL.Query().Encode()))
@@ -106,7 +119,10 @@ func (app *application) logAndMetricsMiddleware(next http.Handler) http.Handler
 // safeModeMiddleware forbids access to some API endpoints if safe mode is enabled.
 func (app *application) safeModeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.SafeMode && app.isUnsafePath(r.URL.Path) {
+		// Roles are not set only if oidcMiddleware hasn't been called, then no exemptions apply
+		roles, _ := r.Context().Value(contextKeyRoles).([]string)
+
+		if app.SafeMode && app.isBlockedBySafeMode(r, roles) {
 			hlog.FromRequest(r).Error().Caller().
 				Msgf("Blocked a request to %s", r.URL.Path)
 			app.clientError(w, http.StatusForbidden)
@@ -158,8 +174,8 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		var claims userClaims
-		if err := accessToken.Claims(&claims); err != nil {
+		var rawClaims map[string]interface{}
+		if err := accessToken.Claims(&rawClaims); err != nil {
 			// Claims property is not set / unmarshal errors, very unlikely to catch it
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
@@ -167,11 +183,29 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		app.enrichLogContext(r, "email", claims.Email)
+		roles, err := extractRoles(rawClaims, app.RolesClaims)
+		if err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msg("")
+			app.clientErrorMessage(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		// NOTE: roles are extracted through app.RolesClaims, so email is the only other claim we need
+		email, _ := rawClaims["email"].(string)
+		app.enrichLogContext(r, "email", email)
 		// NOTE: The field will contain all roles present in the token, not only those that are considered during ACL generation process
-		app.enrichDebugLogContext(r, "roles", strings.Join(claims.Roles, ", "))
+		app.enrichDebugLogContext(r, "roles", strings.Join(roles, ", "))
+
+		ctx = context.WithValue(ctx, contextKeyRoles, roles)
 
-		acl, err := app.ACLs.GetUserACL(claims.Roles, app.AssumedRolesEnabled)
+		acls := app.ACLs.Load()
+		app.logInvalidRoles(r, roles, acls)
+		if app.AssumedRolesEnabled {
+			roles = app.filterAssumedRoles(r, roles, acls)
+		}
+
+		acl, err := acls.GetUserACL(roles, app.AssumedRolesEnabled)
 		if err != nil {
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
@@ -179,7 +213,7 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		app.enrichDebugLogContext(r, "label_filter", string(acl.LabelFilter.AppendString(nil)))
+		app.enrichDebugLogContext(r, "label_filter", acl.LabelFiltersString())
 
 		ctx = context.WithValue(ctx, contextKeyACL, acl)
 		r = r.WithContext(ctx)
@@ -207,9 +241,41 @@ func (app *application) rewriteRequestMiddleware(next http.Handler) http.Handler
 			return
 		}
 
-		if app.isNotAPIRequest(r.URL.Path) {
+		// Same as with routes and safe mode rules, VictoriaMetrics prefixes are ignored
+		if !acl.IsEndpointAllowed(normalizeRoutePath(r.URL.Path)) {
+			hlog.FromRequest(r).Error().Caller().
+				Msgf("Blocked a request to %s, the endpoint is not allowed for the user", r.URL.Path)
+			app.clientError(w, http.StatusForbidden)
+			return
+		}
+
+		if err := app.routeVMTenant(r, acl); err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msgf("Blocked a request to %s", r.URL.Path)
+			app.clientError(w, http.StatusForbidden)
+			return
+		}
+
+		if err := app.setTenantHeader(r, acl); err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msgf("Blocked a request to %s", r.URL.Path)
+			app.clientError(w, http.StatusForbidden)
+			return
+		}
+
+		rt := app.matchRoute(r.URL.Path)
+		app.enrichDebugLogContext(r, "route_action", rt.Action.String())
+
+		switch rt.Action {
+		case routeDeny:
+			hlog.FromRequest(r).Error().Caller().
+				Msgf("Blocked a request to %s, the endpoint is not known", r.URL.Path)
+			app.clientError(w, http.StatusForbidden)
+			return
+		case routePass, routeUnsafe:
+			// Unsafe endpoints are blocked by safeModeMiddleware in safe mode
 			hlog.FromRequest(r).Debug().Caller().
-				Msg("Not an API request, request is not modified")
+				Msg("The endpoint doesn't need rewrites, request is not modified")
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -221,26 +287,107 @@ func (app *application) rewriteRequestMiddleware(next http.Handler) http.Handler
 			return
 		}
 
+		if rt.Action == routeRules {
+			e, err := querymodifier.NewSeriesEnforcer(acl, false)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, withResponseFilter(r, rulesResponseFilter(normalizeRoutePath(r.URL.Path), e)))
+			return
+		}
+
+		if rt.Action == routeAlertmanager {
+			app.handleAlertmanager(w, r, acl, next)
+			return
+		}
+
+		if rt.Action == routeRemoteWrite {
+			stats, err := app.rewriteWrite(r, acl)
+			if err != nil {
+				hlog.FromRequest(r).Error().Caller().
+					Err(err).Msg("")
+				app.clientError(w, http.StatusBadRequest)
+				return
+			}
+			app.countWrittenSamples(r, stats)
+			app.enrichDebugLogContext(r, "accepted_samples", strconv.Itoa(stats.Accepted))
+			app.enrichDebugLogContext(r, "rejected_samples", strconv.Itoa(stats.Rejected))
+
+			if stats.Accepted == 0 && stats.Rejected > 0 {
+				hlog.FromRequest(r).Error().Caller().
+					Msgf("Blocked a request to %s, all %d samples are rejected", r.URL.Path, stats.Rejected)
+				app.clientError(w, http.StatusForbidden)
+				return
+			}
+			if stats.Rejected > 0 {
+				hlog.FromRequest(r).Warn().Caller().
+					Msgf("Rejected %d out of %d samples", stats.Rejected, stats.Accepted+stats.Rejected)
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rt.Action == routeRemoteRead {
+			qm := acl.QueryModifier(app.EnableDeduplication, app.OptimizeExpressions)
+			if err := rewriteRemoteRead(r, qm); err != nil {
+				hlog.FromRequest(r).Error().Caller().
+					Err(err).Msg("")
+				app.clientError(w, http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
 			app.clientError(w, http.StatusBadRequest)
 			return
 		}
 
-		qm := querymodifier.QueryModifier{
-			ACL:                 acl,
-			EnableDeduplication: app.EnableDeduplication,
-			OptimizeExpressions: app.OptimizeExpressions,
+		getParams := r.URL.Query()
+
+		if selectorParam := rt.selectorParam(); len(r.Form[selectorParam]) == 0 {
+			switch rt.MatchSelector {
+			case matchSelectorRequired:
+				hlog.FromRequest(r).Error().Caller().
+					Msgf("Blocked a request to %s, %s is not specified", r.URL.Path, selectorParam)
+				app.clientErrorMessage(w, http.StatusBadRequest, errNoMatchSelector)
+				return
+			case matchSelectorInject:
+				hlog.FromRequest(r).Debug().Caller().
+					Msgf("%s is not specified, injecting %s", selectorParam, rt.defaultSelector())
+				getParams.Add(selectorParam, rt.defaultSelector())
+			}
 		}
 
+		qm := acl.QueryModifier(app.EnableDeduplication, app.OptimizeExpressions)
+		qm.ExprParams = rt.Params
+		qm.StrictPromQL = app.queryDialect() == dialectPromQL
+		qm.LogQL = rt.LogQL
+		// extra_filters[] is specific to VictoriaMetrics, so LogQL queries are always rewritten
+		qm.ExtraFilters = app.useExtraFilters() && !rt.LogQL
+		qm.RewriteClientExtraFilters = app.ClientExtraFilters == clientExtraFiltersRewrite
+		app.logClientExtraFilters(r)
+
 		// Adjust GET params
-		newGetParams, err := qm.GetModifiedEncodedURLValues(r.URL.Query())
+		newGetParams, err := qm.GetModifiedEncodedURLValues(getParams)
 		if err != nil {
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
 			app.clientError(w, http.StatusBadRequest)
 			return
 		}
+		if qm.ExtraFilters {
+			// VictoriaMetrics reads extra_filters[] from both GET and POST params, so it's enough to add it once
+			extraFilters := url.Values{querymodifier.ExtraFiltersParam: {acl.ExtraFilter()}}.Encode()
+			if newGetParams != "" {
+				newGetParams += "&"
+			}
+			newGetParams += extraFilters
+		}
 		r.URL.RawQuery = newGetParams
 		app.enrichDebugLogContext(r, "new_get_params", app.unescapedURLQuery(newGetParams))
 
@@ -262,6 +409,15 @@ func (app *application) rewriteRequestMiddleware(next http.Handler) http.Handler
 		r.Form = nil
 		r.PostForm = nil
 
+		if app.InspectResponses {
+			inspected, err := app.withResponseInspector(r, acl)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			r = inspected
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
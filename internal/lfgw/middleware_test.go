@@ -8,12 +8,14 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/weisdd/lfgw/internal/querymodifier"
@@ -87,6 +89,32 @@ func Test_nonProxiedEndpointsMiddleware(t *testing.T) {
 	}
 }
 
+func Test_normalizePathMiddleware(t *testing.T) {
+	logger := zerolog.New(nil)
+	app := &application{
+		logger: &logger,
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query/..//write/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/write", r.URL.Path)
+		assert.Equal(t, "/api/v1/write", r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	rr := httptest.NewRecorder()
+	app.normalizePathMiddleware(next).ServeHTTP(rr, r)
+	rs := rr.Result()
+
+	assert.Equal(t, http.StatusNoContent, rs.StatusCode)
+
+	defer rs.Body.Close()
+}
+
 // TODO: logMiddleware add a test https://go.dev/src/net/http/httputil/reverseproxy_test.go
 // to make sure such errors don't happen: reverseproxy.go:489 >  error="http: proxy error: net/http: HTTP/1.x transport connection broken: http: ContentLength=57 with Body length 0\n"
 
@@ -169,6 +197,35 @@ func Test_safeModeMiddleware(t *testing.T) {
 			defer rs.Body.Close()
 		})
 	}
+
+	t.Run("Roles from the context are exempt", func(t *testing.T) {
+		logger := zerolog.New(nil)
+		app := &application{
+			logger:              &logger,
+			SafeMode:            true,
+			SafeModeExemptRoles: []string{"admin"},
+		}
+
+		r, err := http.NewRequest(http.MethodPost, "/-/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyRoles, []string{"admin"})
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.safeModeMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
 }
 
 func Test_proxyHeadersMiddleware(t *testing.T) {
@@ -263,7 +320,7 @@ func Test_oidcMiddleware(t *testing.T) {
 
 	// A type that will be used for generating token claims
 	type testClaims struct {
-		userClaims
+		tokenClaims
 		jwt.StandardClaims
 	}
 
@@ -274,10 +331,10 @@ func Test_oidcMiddleware(t *testing.T) {
 	aclEditor, err := querymodifier.NewACL("monitoring")
 	assert.Nil(t, err)
 
-	acls := querymodifier.ACLs{
+	acls := querymodifier.NewACLs(map[string]querymodifier.ACL{
 		"grafana-admin":  aclAdmin,
 		"grafana-editor": aclEditor,
-	}
+	})
 
 	// Some of the reusable test data
 	unknownRole := "unknown-role"
@@ -295,7 +352,7 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "Verifier not initialized",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: nil,
 			},
 			claims: nil,
@@ -305,7 +362,7 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "No token",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: verifier,
 			},
 			claims: nil,
@@ -315,7 +372,7 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "Incorrect token: different issuer",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: verifier,
 			},
 			claims: jwt.StandardClaims{
@@ -329,7 +386,7 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "Incorrect token: expired",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: verifier,
 			},
 			claims: jwt.StandardClaims{
@@ -343,7 +400,7 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "Incorrect token: different audience",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: verifier,
 			},
 			claims: jwt.StandardClaims{
@@ -357,11 +414,11 @@ func Test_oidcMiddleware(t *testing.T) {
 			name: "No known roles, assumed roles disabled",
 			app: application{
 				logger:   &logger,
-				ACLs:     acls,
+				ACLs:     newACLStore(acls),
 				verifier: verifier,
 			},
 			claims: testClaims{
-				userClaims{
+				tokenClaims{
 					Roles: []string{unknownRole},
 					Email: unknownEmail,
 				},
@@ -378,11 +435,33 @@ func Test_oidcMiddleware(t *testing.T) {
 			app: application{
 				logger:              &logger,
 				AssumedRolesEnabled: true,
-				ACLs:                acls,
+				ACLs:                newACLStore(acls),
+				verifier:            verifier,
+			},
+			claims: testClaims{
+				tokenClaims{
+					Roles: []string{unknownRole},
+					Email: unknownEmail,
+				},
+				jwt.StandardClaims{
+					Audience:  clientID,
+					ExpiresAt: time.Now().Add(time.Minute * 5).Unix(),
+					Issuer:    issuerURL,
+				},
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "No known roles, assumed role is not in the allowlist",
+			app: application{
+				logger:              &logger,
+				AssumedRolesEnabled: true,
+				AssumedRolesAllow:   regexp.MustCompile("^(?:ns-.+)$"),
+				ACLs:                newACLStore(acls),
 				verifier:            verifier,
 			},
 			claims: testClaims{
-				userClaims{
+				tokenClaims{
 					Roles: []string{unknownRole},
 					Email: unknownEmail,
 				},
@@ -392,8 +471,40 @@ func Test_oidcMiddleware(t *testing.T) {
 					Issuer:    issuerURL,
 				},
 			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "Known role in a nested claim",
+			app: application{
+				logger:      &logger,
+				RolesClaims: []claimPath{{"roles"}, {"realm_access", "roles"}},
+				ACLs:        newACLStore(acls),
+				verifier:    verifier,
+			},
+			claims: jwt.MapClaims{
+				"realm_access": map[string]interface{}{"roles": []string{"grafana-editor"}},
+				"aud":          clientID,
+				"exp":          time.Now().Add(time.Minute * 5).Unix(),
+				"iss":          issuerURL,
+			},
 			want: http.StatusOK,
 		},
+		{
+			name: "Roles claim of an unsupported type",
+			app: application{
+				logger:      &logger,
+				RolesClaims: []claimPath{{"realm_access"}},
+				ACLs:        newACLStore(acls),
+				verifier:    verifier,
+			},
+			claims: jwt.MapClaims{
+				"realm_access": map[string]interface{}{"roles": []string{"grafana-editor"}},
+				"aud":          clientID,
+				"exp":          time.Now().Add(time.Minute * 5).Unix(),
+				"iss":          issuerURL,
+			},
+			want: http.StatusUnauthorized,
+		},
 	}
 
 	for _, tt := range tests {
@@ -429,7 +540,7 @@ func Test_oidcMiddleware(t *testing.T) {
 	t.Run("Correct ACL is in the context", func(t *testing.T) {
 		app := application{
 			logger:   &logger,
-			ACLs:     acls,
+			ACLs:     newACLStore(acls),
 			verifier: verifier,
 		}
 
@@ -439,7 +550,7 @@ func Test_oidcMiddleware(t *testing.T) {
 		}
 
 		claims := testClaims{
-			userClaims{
+			tokenClaims{
 				Roles: []string{"grafana-editor"},
 				Email: "user@localhost",
 			},
@@ -705,37 +816,884 @@ func Test_rewriteRequestMiddleware(t *testing.T) {
 		defer rs.Body.Close()
 	})
 
-	// TODO: log fields are added (both get / post)
-}
+	t.Run("Endpoint is not allowed for the user", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query_range?query=kube_pod_info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-// oidcWellKnownContent returns content for openid-connect/.well-known needed in oidcMiddleware test
-func oidcWellKnownContent(t *testing.T, url string) string {
-	t.Helper()
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+		acl.AllowedEndpoints = []string{"/api/v1/query"}
 
-	return fmt.Sprintf(`{
-		"issuer": "%[1]s",
-		"authorization_endpoint": "%[1]s/protocol/openid-connect/auth",
-		"token_endpoint": "%[1]s/protocol/openid-connect/token",
-		"introspection_endpoint": "%[1]s/protocol/openid-connect/token/introspect",
-		"userinfo_endpoint": "%[1]s/protocol/openid-connect/userinfo",
-		"end_session_endpoint": "%[1]s/protocol/openid-connect/logout",
-		"jwks_uri": "%[1]s/protocol/openid-connect/certs",
-		"id_token_signing_alg_values_supported": [
-			"RS256"
-		]
-	}`, url)
-}
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
 
-// oidcCertsContent returns certs needed in oidcMiddleware test
-func oidcCertsContent(t *testing.T) []byte {
-	t.Helper()
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
 
-	certs, err := os.ReadFile("test/certs")
-	if err != nil {
-		t.Fatal(err)
-	}
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
 
-	return certs
+		got := rs.StatusCode
+		want := http.StatusForbidden
+
+		assert.Equal(t, want, got)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Allowed endpoints are matched against normalized paths", func(t *testing.T) {
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+		acl.AllowedEndpoints = []string{"/api/v1/query"}
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		for _, p := range []string{"/prometheus/api/v1/query", "/select/0/prometheus/api/v1/query", "//api/v1/./query"} {
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw"+p+"?query=kube_pod_info", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyACL, acl))
+
+			rr := httptest.NewRecorder()
+			app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, http.StatusOK, rs.StatusCode, p)
+
+			rs.Body.Close()
+		}
+	})
+
+	t.Run("Tenant is not allowed for the user", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/select/2/prometheus/api/v1/query?query=kube_pod_info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Tenants are checked even for users with full access
+		acl, err := querymodifier.NewACL(".*")
+		assert.Nil(t, err)
+		acl.Tenants = []string{"1"}
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusForbidden, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Assumed roles do not give access to any tenant", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/select/2/prometheus/api/v1/query?query=kube_pod_info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := querymodifier.NewACLs(map[string]querymodifier.ACL{
+			"team-a": {Tenants: []string{"1"}},
+		})
+		acl, err := a.GetUserACL([]string{"monitoring"}, true)
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusForbidden, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Per-role settings take precedence over global ones", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, `http://lfgw/api/v1/query?query=kube_pod_info{namespace="monitoring"}`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitor.*")
+		assert.Nil(t, err)
+		disabled := false
+		acl.EnableDeduplication = &disabled
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := url.Values{
+				"query": {`kube_pod_info{namespace="monitoring", namespace=~"monitor.*"}`},
+			}
+			got := r.URL.Query()
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:              &logger,
+			UpstreamURL:         upstreamURL,
+			EnableDeduplication: true,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		got := rs.StatusCode
+		want := http.StatusOK
+
+		assert.Equal(t, want, got)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("match[] is injected into requests to label endpoints", func(t *testing.T) {
+		paths := []string{
+			"http://lfgw/api/v1/labels",
+			"http://lfgw/api/v1/label/namespace/values",
+			"http://lfgw/api/v1/export",
+			"http://lfgw/prometheus/api/v1/label/__name__/values",
+		}
+
+		for _, path := range paths {
+			r, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acl, err := querymodifier.NewACL("monitoring")
+			assert.Nil(t, err)
+
+			ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+			r = r.WithContext(ctx)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				want := []string{`{__name__=~".+", namespace="monitoring"}`}
+				got := r.URL.Query()["match[]"]
+
+				assert.Equal(t, want, got, path)
+
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, http.StatusOK, rs.StatusCode, path)
+
+			rs.Body.Close()
+		}
+	})
+
+	t.Run("Stream selector is injected into requests to Loki label endpoints", func(t *testing.T) {
+		paths := []string{
+			"http://lfgw/loki/api/v1/labels",
+			"http://lfgw/loki/api/v1/label/app/values",
+		}
+
+		for _, path := range paths {
+			r, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acl, err := querymodifier.NewACL("monitoring")
+			assert.Nil(t, err)
+
+			ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+			r = r.WithContext(ctx)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				want := []string{`{namespace="monitoring"}`}
+				got := r.URL.Query()["query"]
+
+				assert.Equal(t, want, got, path)
+				assert.Empty(t, r.URL.Query()["match[]"], path)
+
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, http.StatusOK, rs.StatusCode, path)
+
+			rs.Body.Close()
+		}
+	})
+
+	t.Run("LogQL query is rewritten", func(t *testing.T) {
+		query := url.Values{"query": {`sum(rate({app="nginx"} |= "error" [5m]))`}}
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/loki/api/v1/query_range?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := `sum(rate({app="nginx", namespace="monitoring"} |= "error"[5m]))`
+			got := r.URL.Query().Get("query")
+
+			assert.Equal(t, want, got)
+			assert.Empty(t, r.URL.Query()[querymodifier.ExtraFiltersParam])
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:          &logger,
+			UpstreamURL:     upstreamURL,
+			UpstreamFlavor:  flavorVictoriaMetrics,
+			EnforcementMode: enforcementExtraFilters,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Both match[] and match are rewritten for Loki series", func(t *testing.T) {
+		query := url.Values{"match[]": {`{app="x"}`}, "match": {`{namespace="kube-system"}`}}
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/loki/api/v1/series?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, `{app="x", namespace="monitoring"}`, r.URL.Query().Get("match[]"))
+			assert.Equal(t, `{namespace="monitoring"}`, r.URL.Query().Get("match"))
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:      &logger,
+			UpstreamURL: upstreamURL,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("match[] is not injected if it's specified in the body", func(t *testing.T) {
+		body := io.NopCloser(strings.NewReader("match[]=up"))
+
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/labels", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Form = nil
+			r.PostForm = nil
+
+			err := r.ParseForm()
+			assert.Nil(t, err)
+
+			want := url.Values{
+				"match[]": {`up{namespace="monitoring"}`},
+			}
+			got := r.Form
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("ACL is passed through extra_filters[] for VictoriaMetrics", func(t *testing.T) {
+		body := io.NopCloser(strings.NewReader(`query=kube_pod_info&extra_filters[]={namespace=~".*"}`))
+
+		r, err := http.NewRequest(http.MethodPost, `http://lfgw/api/v1/query?extra_label=namespace=kube-system`, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Form = nil
+			r.PostForm = nil
+
+			err := r.ParseForm()
+			assert.Nil(t, err)
+
+			want := url.Values{
+				"query":           {`kube_pod_info`},
+				"extra_filters[]": {`{namespace="monitoring"}`},
+			}
+			got := r.Form
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:          &logger,
+			UpstreamURL:     upstreamURL,
+			UpstreamFlavor:  flavorVictoriaMetrics,
+			EnforcementMode: enforcementExtraFilters,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Client-supplied extra filters are rewritten", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, `http://lfgw/api/v1/query?query=up&extra_filters[]={namespace="kube-system"}`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := url.Values{
+				"query":           {`up{namespace="monitoring"}`},
+				"extra_filters[]": {`{namespace="monitoring"}`},
+			}
+			got := r.URL.Query()
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:             &logger,
+			UpstreamURL:        upstreamURL,
+			ClientExtraFilters: clientExtraFiltersRewrite,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Client-supplied extra filters are stripped by default", func(t *testing.T) {
+		clientParams := url.Values{
+			"query":           {`up`},
+			"extra_label":     {"namespace=kube-system"},
+			"extra_filters[]": {`{namespace="kube-system"}`},
+		}
+
+		tests := []struct {
+			name            string
+			enforcementMode string
+			want            url.Values
+		}{
+			{
+				name: "Expression mode",
+				want: url.Values{
+					"query": {`up{namespace="monitoring"}`},
+				},
+			},
+			{
+				name:            "Extra-filters mode",
+				enforcementMode: enforcementExtraFilters,
+				want: url.Values{
+					"query":           {`up`},
+					"extra_filters[]": {`{namespace="monitoring"}`},
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/query?"+clientParams.Encode(), strings.NewReader(clientParams.Encode()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+				acl, err := querymodifier.NewACL("monitoring")
+				assert.Nil(t, err)
+
+				ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+				r = r.WithContext(ctx)
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tt.want, r.URL.Query())
+
+					r.Form = nil
+					r.PostForm = nil
+					err := r.ParseForm()
+					assert.Nil(t, err)
+					assert.NotContains(t, r.PostForm, "extra_label")
+					assert.NotContains(t, r.PostForm, "extra_filters[]")
+
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				app := &application{
+					logger:          &logger,
+					UpstreamURL:     upstreamURL,
+					UpstreamFlavor:  flavorVictoriaMetrics,
+					EnforcementMode: tt.enforcementMode,
+				}
+
+				rr := httptest.NewRecorder()
+				app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+
+				assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+				defer rs.Body.Close()
+			})
+		}
+	})
+
+	t.Run("Expressions are rewritten in extra-filters mode until the flavor is known", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?query=kube_pod_info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := url.Values{
+				"query": {`kube_pod_info{namespace="monitoring"}`},
+			}
+			got := r.URL.Query()
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:          &logger,
+			UpstreamURL:     upstreamURL,
+			UpstreamFlavor:  flavorAuto,
+			EnforcementMode: enforcementExtraFilters,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Response inspector is attached to rewritten requests", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Value(contextKeyResponseStreamFilter).(responseStreamFilter)
+			assert.True(t, ok)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:           &logger,
+			UpstreamURL:      upstreamURL,
+			InspectResponses: true,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Response filter is attached to requests to rules endpoints", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/rules", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Value(contextKeyResponseFilter).(responseFilter)
+			assert.True(t, ok)
+			assert.Equal(t, "", r.Header.Get("Accept-Encoding"))
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:         &logger,
+			UpstreamURL:    upstreamURL,
+			UpstreamFlavor: flavorMimir,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Remote read request is modified according to an ACL", func(t *testing.T) {
+		r := newRemoteReadRequest(t, &prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+			},
+		})
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "monitoring"},
+			}
+			got := readRemoteReadRequest(t, r).Queries[0].Matchers
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:         &logger,
+			UpstreamURL:    upstreamURL,
+			UpstreamFlavor: flavorPrometheus,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Remote write request is modified according to an ACL", func(t *testing.T) {
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				newTimeSeries(1, "__name__", "up", "namespace", "monitoring"),
+				newTimeSeries(1, "__name__", "up", "namespace", "kube-system"),
+			},
+		})
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := []prompb.TimeSeries{
+				newTimeSeries(1, "__name__", "up", "namespace", "monitoring"),
+			}
+			got := readRemoteWriteRequest(t, r).Timeseries
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:         &logger,
+			UpstreamURL:    upstreamURL,
+			UpstreamFlavor: flavorPrometheus,
+			WriteMode:      writeModeReject,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Label overrides are stripped from remote write requests", func(t *testing.T) {
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				newTimeSeries(1, "__name__", "up", "namespace", "monitoring"),
+			},
+		})
+		r.URL.RawQuery = "extra_label=namespace%3Dkube-system"
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.URL.RawQuery)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:         &logger,
+			UpstreamURL:    upstreamURL,
+			UpstreamFlavor: flavorVictoriaMetrics,
+			WriteMode:      writeModeReject,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Remote write request with all samples rejected is blocked", func(t *testing.T) {
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				newTimeSeries(1, "__name__", "up", "namespace", "kube-system"),
+			},
+		})
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		app := &application{
+			logger:         &logger,
+			UpstreamURL:    upstreamURL,
+			UpstreamFlavor: flavorPrometheus,
+			WriteMode:      writeModeReject,
+		}
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusForbidden, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Series request without match[] is rejected", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/series", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Unknown API endpoint is denied", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/status/tsdb", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL(".*")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusForbidden, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Only parameters listed in the route are rewritten", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, `http://lfgw/api/v1/query?query=up&match[]=up`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("monitoring")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := url.Values{
+				"query":   {`up{namespace="monitoring"}`},
+				"match[]": {`up`},
+			}
+			got := r.URL.Query()
+
+			assert.Equal(t, want, got)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	// TODO: log fields are added (both get / post)
+}
+
+// oidcWellKnownContent returns content for openid-connect/.well-known needed in oidcMiddleware test
+func oidcWellKnownContent(t *testing.T, url string) string {
+	t.Helper()
+
+	return fmt.Sprintf(`{
+		"issuer": "%[1]s",
+		"authorization_endpoint": "%[1]s/protocol/openid-connect/auth",
+		"token_endpoint": "%[1]s/protocol/openid-connect/token",
+		"introspection_endpoint": "%[1]s/protocol/openid-connect/token/introspect",
+		"userinfo_endpoint": "%[1]s/protocol/openid-connect/userinfo",
+		"end_session_endpoint": "%[1]s/protocol/openid-connect/logout",
+		"jwks_uri": "%[1]s/protocol/openid-connect/certs",
+		"id_token_signing_alg_values_supported": [
+			"RS256"
+		]
+	}`, url)
+}
+
+// oidcCertsContent returns certs needed in oidcMiddleware test
+func oidcCertsContent(t *testing.T) []byte {
+	t.Helper()
+
+	certs, err := os.ReadFile("test/certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certs
+}
+
+// tokenClaims contains claims of test tokens besides the standard ones
+type tokenClaims struct {
+	Roles []string `json:"roles"`
+	Email string   `json:"email"`
 }
 
 // oidcCertsContent returns a properly signed token needed in oidcMiddleware test
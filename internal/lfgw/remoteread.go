@@ -0,0 +1,56 @@
+package lfgw
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// remoteReadMaxSize limits the size of remote read requests (both compressed and decompressed), real requests contain only a few matchers per query
+const remoteReadMaxSize = 32 * 1024 * 1024
+
+// rewriteRemoteRead decodes a snappy-compressed Prometheus remote read request, applies the ACL to matchers of every query and replaces the request body with the re-encoded request.
+func rewriteRemoteRead(r *http.Request, qm querymodifier.QueryModifier) error {
+	compressed, err := readRequestBody(r, remoteReadMaxSize)
+	if err != nil {
+		return err
+	}
+
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress remote read request: %s", err)
+	}
+	if size > remoteReadMaxSize {
+		return fmt.Errorf("decompressed remote read request exceeds %d bytes", remoteReadMaxSize)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress remote read request: %s", err)
+	}
+
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(data); err != nil {
+		return fmt.Errorf("failed to unmarshal remote read request: %s", err)
+	}
+
+	if err := qm.ModifyReadRequest(&req); err != nil {
+		return err
+	}
+
+	data, err = req.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal remote read request: %s", err)
+	}
+
+	body := snappy.Encode(nil, data)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return nil
+}
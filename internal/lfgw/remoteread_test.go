@@ -0,0 +1,115 @@
+package lfgw
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// newRemoteReadRequest returns a remote read request with a snappy-compressed body.
+func newRemoteReadRequest(t *testing.T, req *prompb.ReadRequest) *http.Request {
+	t.Helper()
+
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/read", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("Content-Encoding", "snappy")
+
+	return r
+}
+
+// readRemoteReadRequest decodes the body of a remote read request.
+func readRemoteReadRequest(t *testing.T, r *http.Request) *prompb.ReadRequest {
+	t.Helper()
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(compressed)), r.ContentLength)
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return &req
+}
+
+func Test_rewriteRemoteRead(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio, stolon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qm := acl.QueryModifier(false, false)
+
+	t.Run("Matchers are rewritten", func(t *testing.T) {
+		r := newRemoteReadRequest(t, &prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{
+					StartTimestampMs: 1000,
+					EndTimestampMs:   2000,
+					Matchers: []*prompb.LabelMatcher{
+						{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+					},
+				},
+			},
+			AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+		})
+
+		err := rewriteRemoteRead(r, qm)
+		assert.Nil(t, err)
+
+		want := &prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{
+					StartTimestampMs: 1000,
+					EndTimestampMs:   2000,
+					Matchers: []*prompb.LabelMatcher{
+						{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+						{Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "minio|stolon"},
+					},
+				},
+			},
+			AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+		}
+		got := readRemoteReadRequest(t, r)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Body is not compressed", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/read", bytes.NewReader([]byte("query=up")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NotNil(t, rewriteRemoteRead(r, qm))
+	})
+
+	t.Run("Body is not a remote read request", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/read", bytes.NewReader(snappy.Encode(nil, []byte("query=up"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NotNil(t, rewriteRemoteRead(r, qm))
+	})
+}
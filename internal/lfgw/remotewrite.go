@@ -0,0 +1,295 @@
+package lfgw
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// Write modes, which determine how remote write and import requests are handled
+const (
+	// writeModeOff means that write endpoints are treated as unsafe ones (blocked in safe mode, forwarded as is otherwise)
+	writeModeOff = "off"
+	// writeModeReject means that series not matching an ACL are dropped from requests
+	writeModeReject = "reject"
+	// writeModeRewrite means that labels restricted by an ACL to a single value are set to that value, other series not matching an ACL are dropped
+	writeModeRewrite = "rewrite"
+)
+
+// remoteWriteMaxSize limits the size of remote write and import requests (both compressed and decompressed), it matches the default limit of vminsert
+const remoteWriteMaxSize = 32 * 1024 * 1024
+
+// vmImportPath is the path of the VictoriaMetrics JSON line import endpoint, other write endpoints accept Prometheus remote write requests
+const vmImportPath = "/api/v1/import"
+
+// remoteWriteV2ContentType is a part of Content-Type sent by Prometheus Remote-Write 2.0 clients, which is not supported
+const remoteWriteV2ContentType = "io.prometheus.write.v2.Request"
+
+// writeRoleAssumed is used in metrics instead of role names if the user has no roles defined in acl.yaml, so that assumed roles don't increase cardinality
+const writeRoleAssumed = "assumed"
+
+// validateWriteMode returns an error if the mode is not known. An empty mode is treated as writeModeOff.
+func validateWriteMode(mode string) error {
+	switch mode {
+	case "", writeModeOff, writeModeReject, writeModeRewrite:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q (supported: %s, %s, %s)", mode, writeModeOff, writeModeReject, writeModeRewrite)
+	}
+}
+
+// isWriteModeEnabled returns true if write requests have to be enforced.
+func (app *application) isWriteModeEnabled() bool {
+	return app.WriteMode != "" && app.WriteMode != writeModeOff
+}
+
+// writeStats contains numbers of samples accepted and rejected during enforcement of a write request
+type writeStats struct {
+	Accepted int
+	Rejected int
+}
+
+// add counts samples of a series as accepted or rejected.
+func (s *writeStats) add(samples int, accepted bool) {
+	if accepted {
+		s.Accepted += samples
+	} else {
+		s.Rejected += samples
+	}
+}
+
+// rewriteWrite enforces the ACL on series of the write request, series not matching the ACL are dropped. The request body is replaced with the re-encoded request, query parameters overriding labels of written series are removed (see stripWriteLabelParams).
+func (app *application) rewriteWrite(r *http.Request, acl querymodifier.ACL) (writeStats, error) {
+	rewrite := app.WriteMode == writeModeRewrite
+
+	if stripped := stripWriteLabelParams(r); len(stripped) > 0 {
+		hlog.FromRequest(r).Warn().Caller().
+			Msgf("Stripped %s from the write request", strings.Join(stripped, ", "))
+	}
+
+	e, err := querymodifier.NewSeriesEnforcer(acl, rewrite)
+	if err != nil {
+		return writeStats{}, err
+	}
+
+	if normalizeRoutePath(r.URL.Path) == vmImportPath {
+		return rewriteVMImport(r, e)
+	}
+
+	return rewriteRemoteWrite(r, e, rewrite)
+}
+
+// stripWriteLabelParams removes query parameters, which VictoriaMetrics applies to written series (extra_label, extra_filters*), as they would override labels checked against the ACL. Names of the removed parameters are returned.
+func stripWriteLabelParams(r *http.Request) []string {
+	params := r.URL.Query()
+	stripped := []string{}
+
+	for k := range params {
+		if k == "extra_label" || strings.HasPrefix(k, "extra_filters") {
+			params.Del(k)
+			stripped = append(stripped, k)
+		}
+	}
+
+	if len(stripped) > 0 {
+		sort.Strings(stripped)
+		r.URL.RawQuery = params.Encode()
+	}
+
+	return stripped
+}
+
+// rewriteRemoteWrite decodes a snappy-compressed Prometheus remote write request, enforces the ACL on every series and replaces the request body with the re-encoded request. Series with duplicate label names are rejected. Labels are sorted again if they might have been rewritten.
+func rewriteRemoteWrite(r *http.Request, e *querymodifier.SeriesEnforcer, rewrite bool) (writeStats, error) {
+	if strings.Contains(r.Header.Get("Content-Type"), remoteWriteV2ContentType) {
+		return writeStats{}, fmt.Errorf("remote write 2.0 requests are not supported")
+	}
+
+	compressed, err := readRequestBody(r, remoteWriteMaxSize)
+	if err != nil {
+		return writeStats{}, err
+	}
+
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return writeStats{}, fmt.Errorf("failed to decompress remote write request: %s", err)
+	}
+	if size > remoteWriteMaxSize {
+		return writeStats{}, fmt.Errorf("decompressed remote write request exceeds %d bytes", remoteWriteMaxSize)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return writeStats{}, fmt.Errorf("failed to decompress remote write request: %s", err)
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		return writeStats{}, fmt.Errorf("failed to unmarshal remote write request: %s", err)
+	}
+
+	var stats writeStats
+	accepted := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		labels := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			labels[l.Name] = l.Value
+		}
+
+		// Only one of the values would be checked, so series with duplicate label names are always rejected
+		ok := len(labels) == len(ts.Labels) && e.Enforce(labels)
+		stats.add(len(ts.Samples)+len(ts.Histograms), ok)
+		if !ok {
+			continue
+		}
+
+		if rewrite {
+			ts.Labels = prompbLabelsFromMap(labels)
+		}
+		accepted = append(accepted, ts)
+	}
+	req.Timeseries = accepted
+
+	data, err = req.Marshal()
+	if err != nil {
+		return writeStats{}, fmt.Errorf("failed to marshal remote write request: %s", err)
+	}
+
+	body := snappy.Encode(nil, data)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return stats, nil
+}
+
+// prompbLabelsFromMap returns labels sorted by name, as required by the remote write protocol.
+func prompbLabelsFromMap(labels map[string]string) []prompb.Label {
+	result := make([]prompb.Label, 0, len(labels))
+	for name, value := range labels {
+		result = append(result, prompb.Label{Name: name, Value: value})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// vmImportLine describes a line of the VictoriaMetrics JSON line import format. Values and timestamps are kept as is, so that they're not altered by re-encoding.
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []json.RawMessage `json:"values"`
+	Timestamps []json.RawMessage `json:"timestamps"`
+}
+
+// rewriteVMImport decodes a VictoriaMetrics JSON line import request (optionally gzip-compressed), enforces the ACL on every line and replaces the request body with accepted lines. The body is forwarded uncompressed.
+func rewriteVMImport(r *http.Request, e *querymodifier.SeriesEnforcer) (writeStats, error) {
+	data, err := readRequestBody(r, remoteWriteMaxSize)
+	if err != nil {
+		return writeStats{}, err
+	}
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		data, err = gunzip(data, remoteWriteMaxSize)
+		if err != nil {
+			return writeStats{}, fmt.Errorf("failed to decompress import request: %s", err)
+		}
+		r.Header.Del("Content-Encoding")
+	}
+
+	var stats writeStats
+	var body bytes.Buffer
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, remoteWriteMaxSize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var line vmImportLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return writeStats{}, fmt.Errorf("failed to unmarshal import request: %s", err)
+		}
+		if line.Metric == nil {
+			line.Metric = make(map[string]string)
+		}
+
+		ok := e.Enforce(line.Metric)
+		stats.add(len(line.Values), ok)
+		if !ok {
+			continue
+		}
+
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return writeStats{}, fmt.Errorf("failed to marshal import request: %s", err)
+		}
+		body.Write(encoded)
+		body.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return writeStats{}, fmt.Errorf("failed to read import request: %s", err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+	r.ContentLength = int64(body.Len())
+
+	return stats, nil
+}
+
+// gunzip decompresses the data, an error is returned if the decompressed data exceeds the limit.
+func gunzip(data []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > limit {
+		return nil, fmt.Errorf("decompressed request exceeds %d bytes", limit)
+	}
+
+	return decompressed, nil
+}
+
+// countWrittenSamples updates per-role metrics of accepted and rejected samples. Only roles defined in acl.yaml are reported, pattern-based roles are reported by the name of the role pattern (see querymodifier.ACLs.RoleDefinition), users without such roles are reported as writeRoleAssumed.
+func (app *application) countWrittenSamples(r *http.Request, stats writeStats) {
+	roles, _ := r.Context().Value(contextKeyRoles).([]string)
+	acls := app.ACLs.Load()
+
+	known := make([]string, 0, len(roles))
+	seen := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		// NOTE: Several roles may match the same role pattern, the samples are counted only once then
+		if name, ok := acls.RoleDefinition(role); ok && !seen[name] {
+			seen[name] = true
+			known = append(known, name)
+		}
+	}
+	if len(known) == 0 {
+		known = append(known, writeRoleAssumed)
+	}
+
+	for _, role := range known {
+		metrics.GetOrCreateCounter(fmt.Sprintf(`remote_write_samples_total{role=%q,status="accepted"}`, role)).Add(stats.Accepted)
+		metrics.GetOrCreateCounter(fmt.Sprintf(`remote_write_samples_total{role=%q,status="rejected"}`, role)).Add(stats.Rejected)
+	}
+}
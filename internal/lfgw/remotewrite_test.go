@@ -0,0 +1,302 @@
+package lfgw
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// newRemoteWriteRequest returns a remote write request with a snappy-compressed body.
+func newRemoteWriteRequest(t *testing.T, path string, req *prompb.WriteRequest) *http.Request {
+	t.Helper()
+
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "http://lfgw"+path, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("Content-Encoding", "snappy")
+
+	return r
+}
+
+// readRemoteWriteRequest decodes the body of a remote write request.
+func readRemoteWriteRequest(t *testing.T, r *http.Request) *prompb.WriteRequest {
+	t.Helper()
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(compressed)), r.ContentLength)
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return &req
+}
+
+// newTimeSeries returns a series with the labels (name, value pairs) and the number of samples.
+func newTimeSeries(samples int, labels ...string) prompb.TimeSeries {
+	ts := prompb.TimeSeries{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	for i := 0; i < samples; i++ {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(i), Timestamp: int64(i)})
+	}
+
+	return ts
+}
+
+func Test_validateWriteMode(t *testing.T) {
+	for _, mode := range []string{"", writeModeOff, writeModeReject, writeModeRewrite} {
+		assert.Nil(t, validateWriteMode(mode))
+	}
+
+	assert.NotNil(t, validateWriteMode("drop"))
+}
+
+func Test_stripWriteLabelParams(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/import?extra_label=namespace%3Dkube-system&extra_filters[]=%7Bnamespace%3D%22a%22%7D&extra_filters=x&timeout=5s", nil)
+
+	stripped := stripWriteLabelParams(r)
+	assert.Equal(t, []string{"extra_filters", "extra_filters[]", "extra_label"}, stripped)
+	assert.Equal(t, "timeout=5s", r.URL.RawQuery)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/write?timeout=5s", nil)
+	assert.Empty(t, stripWriteLabelParams(r))
+	assert.Equal(t, "timeout=5s", r.URL.RawQuery)
+}
+
+func Test_rewriteRemoteWrite(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Series not matching the ACL are rejected", func(t *testing.T) {
+		e, err := querymodifier.NewSeriesEnforcer(acl, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				newTimeSeries(2, "__name__", "up", "namespace", "minio"),
+				newTimeSeries(3, "__name__", "up", "namespace", "stolon"),
+				newTimeSeries(1, "__name__", "up"),
+			},
+		})
+
+		stats, err := rewriteRemoteWrite(r, e, false)
+		assert.Nil(t, err)
+		assert.Equal(t, writeStats{Accepted: 2, Rejected: 4}, stats)
+
+		want := []prompb.TimeSeries{
+			newTimeSeries(2, "__name__", "up", "namespace", "minio"),
+		}
+		got := readRemoteWriteRequest(t, r)
+		assert.Equal(t, want, got.Timeseries)
+	})
+
+	t.Run("Series with duplicate label names are rejected", func(t *testing.T) {
+		for _, rewrite := range []bool{false, true} {
+			e, err := querymodifier.NewSeriesEnforcer(acl, rewrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					newTimeSeries(1, "__name__", "up", "namespace", "kube-system", "namespace", "minio"),
+					newTimeSeries(2, "__name__", "up", "namespace", "minio"),
+				},
+			})
+
+			stats, err := rewriteRemoteWrite(r, e, rewrite)
+			assert.Nil(t, err)
+			assert.Equal(t, writeStats{Accepted: 2, Rejected: 1}, stats)
+
+			want := []prompb.TimeSeries{
+				newTimeSeries(2, "__name__", "up", "namespace", "minio"),
+			}
+			got := readRemoteWriteRequest(t, r)
+			assert.Equal(t, want, got.Timeseries)
+		}
+	})
+
+	t.Run("Labels are rewritten and sorted", func(t *testing.T) {
+		e, err := querymodifier.NewSeriesEnforcer(acl, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				newTimeSeries(1, "__name__", "up", "job", "demo"),
+			},
+		})
+
+		stats, err := rewriteRemoteWrite(r, e, true)
+		assert.Nil(t, err)
+		assert.Equal(t, writeStats{Accepted: 1}, stats)
+
+		want := []prompb.TimeSeries{
+			newTimeSeries(1, "__name__", "up", "job", "demo", "namespace", "minio"),
+		}
+		got := readRemoteWriteRequest(t, r)
+		assert.Equal(t, want, got.Timeseries)
+	})
+
+	t.Run("Remote write 2.0 is not supported", func(t *testing.T) {
+		e, err := querymodifier.NewSeriesEnforcer(acl, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := newRemoteWriteRequest(t, "/api/v1/write", &prompb.WriteRequest{})
+		r.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+
+		_, err = rewriteRemoteWrite(r, e, false)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Body is not compressed", func(t *testing.T) {
+		e, err := querymodifier.NewSeriesEnforcer(acl, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/write", bytes.NewReader([]byte("up 1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = rewriteRemoteWrite(r, e, false)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_rewriteVMImport(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := querymodifier.NewSeriesEnforcer(acl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"metric":{"__name__":"up","namespace":"minio"},"values":[1,0.5],"timestamps":[1000,2000]}
+{"metric":{"__name__":"up","namespace":"stolon"},"values":[1],"timestamps":[1000]}
+
+`
+	want := `{"metric":{"__name__":"up","namespace":"minio"},"values":[1,0.5],"timestamps":[1000,2000]}
+`
+
+	t.Run("Lines not matching the ACL are rejected", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/import", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := rewriteVMImport(r, e)
+		assert.Nil(t, err)
+		assert.Equal(t, writeStats{Accepted: 2, Rejected: 1}, stats)
+
+		got, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(got))
+		assert.Equal(t, int64(len(want)), r.ContentLength)
+	})
+
+	t.Run("Gzip-compressed body", func(t *testing.T) {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		_, _ = zw.Write([]byte(body))
+		zw.Close()
+
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/import", &compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Encoding", "gzip")
+
+		stats, err := rewriteVMImport(r, e)
+		assert.Nil(t, err)
+		assert.Equal(t, writeStats{Accepted: 2, Rejected: 1}, stats)
+		assert.Equal(t, "", r.Header.Get("Content-Encoding"))
+
+		got, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(got))
+	})
+
+	t.Run("Incorrect line", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/import", bytes.NewReader([]byte("up 1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = rewriteVMImport(r, e)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestApp_countWrittenSamples(t *testing.T) {
+	acls, err := querymodifier.NewACLsFromYAML([]byte("writer: minio\nteam-(.+)-writer: $1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		ACLs: newACLStore(acls),
+	}
+
+	counter := func(role string) *metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf(`remote_write_samples_total{role=%q,status="accepted"}`, role))
+	}
+	writerBefore := counter("writer").Get()
+	patternBefore := counter("team-(.+)-writer").Get()
+	assumedBefore := counter(writeRoleAssumed).Get()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", nil)
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyRoles, []string{"writer", "team-a-writer", "team-b-writer", "unknown"}))
+	app.countWrittenSamples(r, writeStats{Accepted: 2})
+
+	// Pattern-based roles are reported by the name of the pattern once, so that the cardinality is bounded by acl.yaml
+	assert.Equal(t, writerBefore+2, counter("writer").Get())
+	assert.Equal(t, patternBefore+2, counter("team-(.+)-writer").Get())
+	assert.Equal(t, uint64(0), counter("team-a-writer").Get())
+	assert.Equal(t, assumedBefore, counter(writeRoleAssumed).Get())
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/write", nil)
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyRoles, []string{"unknown"}))
+	app.countWrittenSamples(r, writeStats{Accepted: 1})
+	assert.Equal(t, assumedBefore+1, counter(writeRoleAssumed).Get())
+}
@@ -0,0 +1,108 @@
+package lfgw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// contextKeyResponseFilter is used to pass a responseFilter from rewriteRequestMiddleware to modifyResponse
+const contextKeyResponseFilter = contextKey("response_filter")
+
+// contextKeyResponseStreamFilter is used to pass a responseStreamFilter from rewriteRequestMiddleware to modifyResponse
+const contextKeyResponseStreamFilter = contextKey("response_stream_filter")
+
+// responseFilterMaxSize limits the size of upstream responses passed through a responseFilter
+const responseFilterMaxSize = 64 * 1024 * 1024
+
+// responseFilter returns the body of a successful upstream response with data not allowed by an ACL removed
+type responseFilter func(body []byte) ([]byte, error)
+
+// responseStreamFilter copies the body of a successful upstream response from src to dst with data not allowed by an ACL removed, so that large responses don't need to be kept in memory
+type responseStreamFilter func(dst io.Writer, src io.Reader) error
+
+// withResponseFilter returns the request with the filter attached, so that the upstream response is passed through it (see modifyResponse). Accept-Encoding is removed, so that the response is transparently decompressed by the transport.
+func withResponseFilter(r *http.Request, filter responseFilter) *http.Request {
+	r.Header.Del("Accept-Encoding")
+	ctx := context.WithValue(r.Context(), contextKeyResponseFilter, filter)
+
+	return r.WithContext(ctx)
+}
+
+// withResponseStreamFilter returns the request with the stream filter attached (see withResponseFilter).
+func withResponseStreamFilter(r *http.Request, filter responseStreamFilter) *http.Request {
+	r.Header.Del("Accept-Encoding")
+	ctx := context.WithValue(r.Context(), contextKeyResponseStreamFilter, filter)
+
+	return r.WithContext(ctx)
+}
+
+// modifyResponse passes the upstream response through the filter attached to the request (see withResponseFilter, withResponseStreamFilter). Error responses are forwarded as is, compressed responses are rejected as they cannot be filtered.
+func (app *application) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	ctx := resp.Request.Context()
+	filter, ok := ctx.Value(contextKeyResponseFilter).(responseFilter)
+	streamFilter, streamOk := ctx.Value(contextKeyResponseStreamFilter).(responseStreamFilter)
+	if !ok && !streamOk {
+		return nil
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return fmt.Errorf("cannot filter a response with %s content encoding", encoding)
+	}
+
+	if streamOk {
+		streamResponse(resp, streamFilter)
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, responseFilterMaxSize+1))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if len(body) > responseFilterMaxSize {
+		return fmt.Errorf("response exceeds %d bytes", responseFilterMaxSize)
+	}
+
+	body, err = filter(body)
+	if err != nil {
+		return fmt.Errorf("failed to filter response: %s", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// streamResponse replaces the body of the response with the output of the stream filter. Headers are already sent by the time the filter fails, so the response is then truncated.
+func streamResponse(resp *http.Response, filter responseStreamFilter) {
+	src := resp.Body
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer src.Close()
+
+		err := filter(pw, src)
+		if err != nil {
+			hlog.FromRequest(resp.Request).Error().Caller().
+				Err(err).Msg("Failed to filter the response")
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
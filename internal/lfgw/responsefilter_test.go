@@ -0,0 +1,94 @@
+package lfgw
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplication_modifyResponse(t *testing.T) {
+	app := &application{}
+
+	upper := func(body []byte) ([]byte, error) {
+		return bytes.ToUpper(body), nil
+	}
+
+	newResponse := func(t *testing.T, r *http.Request, status int, body string) *http.Response {
+		t.Helper()
+
+		return &http.Response{
+			StatusCode:    status,
+			Header:        http.Header{"Content-Length": {"2"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}
+	}
+
+	t.Run("Response is filtered", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v2/alerts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+		r = withResponseFilter(r, upper)
+		assert.Equal(t, "", r.Header.Get("Accept-Encoding"))
+
+		resp := newResponse(t, r, http.StatusOK, "ok")
+		err = app.modifyResponse(resp)
+		assert.Nil(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "OK", string(body))
+		assert.Equal(t, int64(2), resp.ContentLength)
+		assert.Equal(t, "2", resp.Header.Get("Content-Length"))
+	})
+
+	t.Run("Response without a filter is not modified", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := newResponse(t, r, http.StatusOK, "ok")
+		err = app.modifyResponse(resp)
+		assert.Nil(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", string(body))
+	})
+
+	t.Run("Error response is not modified", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v2/alerts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = withResponseFilter(r, upper)
+
+		resp := newResponse(t, r, http.StatusBadRequest, "error")
+		err = app.modifyResponse(resp)
+		assert.Nil(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "error", string(body))
+	})
+
+	t.Run("Compressed response cannot be filtered", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v2/alerts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = withResponseFilter(r, upper)
+
+		resp := newResponse(t, r, http.StatusOK, "ok")
+		resp.Header.Set("Content-Encoding", "gzip")
+		assert.NotNil(t, app.modifyResponse(resp))
+	})
+}
@@ -8,6 +8,7 @@ import (
 // routes returns a router with all paths.
 func (app *application) routes() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(app.normalizePathMiddleware)
 	r.Use(app.nonProxiedEndpointsMiddleware)
 	r.Use(hlog.NewHandler(*app.logger))
 	r.Use(app.logAndMetricsMiddleware)
@@ -0,0 +1,237 @@
+package lfgw
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// routeAction defines how requests to an endpoint are handled
+type routeAction int
+
+const (
+	// routePass means that requests are forwarded as is
+	routePass routeAction = iota
+	// routeRewrite means that metric expressions in the request parameters are rewritten according to an ACL
+	routeRewrite
+	// routeDeny means that requests are always blocked
+	routeDeny
+	// routeUnsafe means that requests are blocked in safe mode and forwarded as is otherwise
+	routeUnsafe
+	// routeRemoteRead means that matchers in a Prometheus remote read request are rewritten according to an ACL
+	routeRemoteRead
+	// routeRemoteWrite means that series in a remote write / import request are checked (or rewritten) according to an ACL, it's used only if write mode is enabled
+	routeRemoteWrite
+	// routeRules means that rule groups, rules and alerts in the response are filtered according to an ACL (see rulesResponseFilter)
+	routeRules
+	// routeAlertmanager means that requests to Alertmanager API are limited according to an ACL (see handleAlertmanager)
+	routeAlertmanager
+)
+
+// String returns the action name used in logs.
+func (a routeAction) String() string {
+	switch a {
+	case routePass:
+		return "pass"
+	case routeRewrite:
+		return "rewrite"
+	case routeDeny:
+		return "deny"
+	case routeUnsafe:
+		return "unsafe"
+	case routeRemoteRead:
+		return "remote_read"
+	case routeRemoteWrite:
+		return "remote_write"
+	case routeRules:
+		return "rules"
+	case routeAlertmanager:
+		return "alertmanager"
+	default:
+		return "unknown"
+	}
+}
+
+// matchSelectorPolicy defines how requests without match[] are handled
+type matchSelectorPolicy int
+
+const (
+	// matchSelectorOptional means that requests are rewritten as is
+	matchSelectorOptional matchSelectorPolicy = iota
+	// matchSelectorInject means that defaultMatchSelector is added to requests
+	matchSelectorInject
+	// matchSelectorRequired means that requests are rejected
+	matchSelectorRequired
+)
+
+// defaultMatchSelector is injected into requests to endpoints with matchSelectorInject policy if they don't contain match[]. The selector itself matches all series, it's limited by label filters of an ACL afterwards.
+const defaultMatchSelector = `{__name__=~".+"}`
+
+// defaultLogQLSelector is injected into requests to Loki endpoints with matchSelectorInject policy. An empty stream selector is not valid in LogQL, though it becomes valid once label filters of an ACL are added.
+const defaultLogQLSelector = `{}`
+
+// route describes an endpoint. Exactly one of Path, Prefix or Regexp is expected to be set.
+type route struct {
+	// Path is matched exactly
+	Path string
+	// Prefix is matched against the beginning of a path
+	Prefix string
+	// Regexp is matched against the whole path
+	Regexp *regexp.Regexp
+	Action routeAction
+	// Params lists parameters containing metric expressions, which are rewritten (only for routeRewrite)
+	Params []string
+	// MatchSelector defines how requests without match[] (or SelectorParam) are handled (only for routeRewrite)
+	MatchSelector matchSelectorPolicy
+	// SelectorParam is the parameter checked according to MatchSelector, match[] is used if empty
+	SelectorParam string
+	// LogQL means that Params contain Loki LogQL queries (only for routeRewrite)
+	LogQL bool
+	// Flavors lists upstream flavors supporting the endpoint, the route is skipped for other flavors. The route applies to all flavors if empty or if the flavor is not known.
+	Flavors []string
+}
+
+// selectorParam returns the parameter checked according to MatchSelector.
+func (rt route) selectorParam() string {
+	if rt.SelectorParam != "" {
+		return rt.SelectorParam
+	}
+
+	return "match[]"
+}
+
+// defaultSelector returns the selector injected into requests with matchSelectorInject policy.
+func (rt route) defaultSelector() string {
+	if rt.LogQL {
+		return defaultLogQLSelector
+	}
+
+	return defaultMatchSelector
+}
+
+// matches returns true if the normalized path matches the route and the route applies to the upstream flavor.
+func (rt route) matches(p string, flavor string) bool {
+	if flavor != "" && len(rt.Flavors) > 0 && !containsString(rt.Flavors, flavor) {
+		return false
+	}
+
+	switch {
+	case rt.Path != "":
+		return p == rt.Path
+	case rt.Prefix != "":
+		return strings.HasPrefix(p, rt.Prefix)
+	case rt.Regexp != nil:
+		return rt.Regexp.MatchString(p)
+	default:
+		return false
+	}
+}
+
+// queryFlavors lists flavors serving Prometheus-compatible query API
+var queryFlavors = []string{flavorMimir, flavorPrometheus, flavorThanos, flavorVictoriaMetrics, flavorVictoriaMetricsCluster}
+
+// routeTable lists known endpoints of Prometheus and VictoriaMetrics, the first matching route is used. Paths are matched after normalization (see normalizeRoutePath). Unknown API paths and known data endpoints that cannot be filtered (e.g. Graphite API) are denied, other unknown paths (e.g. UI) are forwarded as is.
+var routeTable = []route{
+	// Expressions
+	{Path: "/api/v1/query", Action: routeRewrite, Params: []string{"query"}},
+	{Path: "/api/v1/query_range", Action: routeRewrite, Params: []string{"query"}},
+	{Path: "/api/v1/query_exemplars", Action: routeRewrite, Params: []string{"query"}},
+	{Path: "/federate", Action: routeRewrite, Params: []string{"match[]"}, MatchSelector: matchSelectorRequired},
+	// Without match[], the endpoints would return data for all metrics, not only for those the user has access to
+	{Path: "/api/v1/series", Action: routeRewrite, Params: []string{"match[]"}, MatchSelector: matchSelectorRequired},
+	{Path: "/api/v1/labels", Action: routeRewrite, Params: []string{"match[]"}, MatchSelector: matchSelectorInject},
+	{Regexp: regexp.MustCompile(`^/api/v1/label/[^/]+/values$`), Action: routeRewrite, Params: []string{"match[]"}, MatchSelector: matchSelectorInject},
+	{Regexp: regexp.MustCompile(`^/api/v1/export(/csv|/native)?$`), Action: routeRewrite, Params: []string{"match[]"}, MatchSelector: matchSelectorInject, Flavors: []string{flavorVictoriaMetrics, flavorVictoriaMetricsCluster}},
+	// Loki endpoints, stream selectors in LogQL queries are rewritten
+	{Path: "/loki/api/v1/query", Action: routeRewrite, Params: []string{"query"}, LogQL: true},
+	{Path: "/loki/api/v1/query_range", Action: routeRewrite, Params: []string{"query"}, LogQL: true},
+	{Path: "/loki/api/v1/tail", Action: routeRewrite, Params: []string{"query"}, LogQL: true},
+	// Loki merges match with match[]
+	{Path: "/loki/api/v1/series", Action: routeRewrite, Params: []string{"match[]", "match"}, MatchSelector: matchSelectorRequired, LogQL: true},
+	{Path: "/loki/api/v1/labels", Action: routeRewrite, Params: []string{"query"}, MatchSelector: matchSelectorInject, SelectorParam: "query", LogQL: true},
+	{Regexp: regexp.MustCompile(`^/loki/api/v1/label/[^/]+/values$`), Action: routeRewrite, Params: []string{"query"}, MatchSelector: matchSelectorInject, SelectorParam: "query", LogQL: true},
+	{Path: "/loki/api/v1/status/buildinfo", Action: routePass},
+	{Path: "/loki/api/v1/push", Action: routeUnsafe},
+	{Prefix: "/loki/api/v1/delete", Action: routeUnsafe},
+	{Prefix: "/loki/api/", Action: routeDeny},
+	// Remote read is not supported by VictoriaMetrics and Thanos Query
+	{Path: "/api/v1/read", Action: routeRemoteRead, Flavors: []string{flavorPrometheus, flavorMimir}},
+	// Endpoints that don't expose label values
+	{Path: "/api/v1/status/buildinfo", Action: routePass},
+	{Path: "/api/v1/metadata", Action: routePass},
+	// Responses contain rules and alerts of all users. Alertmanager API v1 (removed in Alertmanager 0.27) would expose all alerts.
+	{Path: "/api/v1/rules", Action: routeRules, Flavors: queryFlavors},
+	{Path: "/api/v1/alerts", Action: routeRules, Flavors: queryFlavors},
+	// Alertmanager API v2, alerts and silences are limited according to an ACL
+	{Prefix: "/api/v2/", Action: routeAlertmanager, Flavors: []string{flavorAlertmanager}},
+	// Write endpoints enforced in write mode, otherwise they're handled as unsafe ones below
+	{Path: "/api/v1/write", Action: routeRemoteWrite, Flavors: []string{flavorPrometheus, flavorVictoriaMetrics, flavorVictoriaMetricsCluster}},
+	{Path: "/api/v1/push", Action: routeRemoteWrite, Flavors: []string{flavorMimir}},
+	{Path: "/api/v1/receive", Action: routeRemoteWrite, Flavors: []string{flavorThanos}},
+	{Path: "/api/v1/import", Action: routeRemoteWrite, Flavors: []string{flavorVictoriaMetrics, flavorVictoriaMetricsCluster}},
+	// Admin and write endpoints
+	{Regexp: regexp.MustCompile(`^(/api/v1)?/admin(/.*)?$`), Action: routeUnsafe},
+	{Regexp: regexp.MustCompile(`^/api/v1/(write|import(/.*)?)$`), Action: routeUnsafe},
+	{Prefix: "/insert/", Action: routeUnsafe},
+	{Prefix: "/delete/", Action: routeUnsafe},
+	// Unknown API endpoints
+	{Prefix: "/api/", Action: routeDeny},
+	// VictoriaMetrics Graphite API (/render, /metrics/find, /tags/*, etc.) and vmalert proxy expose series, label values, rules and alerts without filtering
+	{Regexp: regexp.MustCompile(`^(/graphite)?/(render|metrics/.+|tags(/.*)?)$`), Action: routeDeny},
+	{Regexp: regexp.MustCompile(`^/(graphite|vmalert)(/.*)?$`), Action: routeDeny},
+	// Other than Prometheus-compatible API (handled above after normalization) and UI, vmselect serves Graphite API under /select/<tenant>/
+	{Regexp: regexp.MustCompile(`^/select/[^/]+/vmui(/.*)?$`), Action: routePass},
+	{Prefix: "/select/", Action: routeDeny},
+}
+
+// routePathPrefixRe matches prefixes used by VictoriaMetrics for Prometheus-compatible API (/prometheus, /select/<tenant>/prometheus, /insert/<tenant>/prometheus)
+var routePathPrefixRe = regexp.MustCompile(`^(/(?:select|insert)/[^/]+)?/prometheus(/|$)`)
+
+// cleanPath returns the path with duplicate slashes, dot segments and a trailing slash removed.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	return path.Clean("/" + p)
+}
+
+// normalizeRoutePath returns the cleaned path without prefixes used by VictoriaMetrics for Prometheus-compatible API, so that the same routes apply to all of them.
+func normalizeRoutePath(p string) string {
+	p = cleanPath(p)
+
+	if loc := routePathPrefixRe.FindStringIndex(p); loc != nil {
+		p = "/" + p[loc[1]:]
+	}
+
+	return p
+}
+
+// matchRoute returns the route for the path (considering the upstream flavor and write mode). Paths that don't match any route are forwarded as is.
+func (app *application) matchRoute(p string) route {
+	p = normalizeRoutePath(p)
+	flavor := app.upstreamFlavor()
+	writeMode := app.isWriteModeEnabled()
+
+	for _, rt := range routeTable {
+		if rt.Action == routeRemoteWrite && !writeMode {
+			continue
+		}
+		if rt.matches(p, flavor) {
+			return rt
+		}
+	}
+
+	return route{Action: routePass}
+}
+
+// containsString returns true if the slice contains the string.
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,473 @@
+package lfgw
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_normalizeRoutePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "Clean path",
+			path: "/api/v1/query",
+			want: "/api/v1/query",
+		},
+		{
+			name: "Empty path",
+			path: "",
+			want: "/",
+		},
+		{
+			name: "Duplicate slashes and a trailing slash",
+			path: "//api//v1/query/",
+			want: "/api/v1/query",
+		},
+		{
+			name: "Dot segments",
+			path: "/api/v1/status/../query",
+			want: "/api/v1/query",
+		},
+		{
+			name: "Dot segments cannot escape the root",
+			path: "/../../api/v1/query",
+			want: "/api/v1/query",
+		},
+		{
+			name: "VictoriaMetrics prefix",
+			path: "/prometheus/api/v1/query",
+			want: "/api/v1/query",
+		},
+		{
+			name: "VictoriaMetrics cluster prefix",
+			path: "/select/0/prometheus/api/v1/query",
+			want: "/api/v1/query",
+		},
+		{
+			name: "VictoriaMetrics cluster insert prefix",
+			path: "/insert/0/prometheus/api/v1/write",
+			want: "/api/v1/write",
+		},
+		{
+			name: "Similar prefix",
+			path: "/prometheus2/api/v1/query",
+			want: "/prometheus2/api/v1/query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeRoutePath(tt.path)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplication_matchRoute(t *testing.T) {
+	logger := zerolog.New(nil)
+	app := &application{
+		logger: &logger,
+	}
+
+	tests := []struct {
+		name              string
+		path              string
+		wantAction        routeAction
+		wantParams        []string
+		wantMatchSelector matchSelectorPolicy
+	}{
+		{
+			name:       "query",
+			path:       "/api/v1/query",
+			wantAction: routeRewrite,
+			wantParams: []string{"query"},
+		},
+		{
+			name:       "query_range (VictoriaMetrics cluster)",
+			path:       "/select/0/prometheus/api/v1/query_range",
+			wantAction: routeRewrite,
+			wantParams: []string{"query"},
+		},
+		{
+			name:              "federate",
+			path:              "/federate",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"match[]"},
+			wantMatchSelector: matchSelectorRequired,
+		},
+		{
+			name:              "series",
+			path:              "/api/v1/series",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"match[]"},
+			wantMatchSelector: matchSelectorRequired,
+		},
+		{
+			name:              "label values",
+			path:              "/api/v1/label/namespace/values",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"match[]"},
+			wantMatchSelector: matchSelectorInject,
+		},
+		{
+			name:              "export",
+			path:              "/api/v1/export/csv",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"match[]"},
+			wantMatchSelector: matchSelectorInject,
+		},
+		{
+			name:       "Loki query_range",
+			path:       "/loki/api/v1/query_range",
+			wantAction: routeRewrite,
+			wantParams: []string{"query"},
+		},
+		{
+			name:              "Loki series",
+			path:              "/loki/api/v1/series",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"match[]", "match"},
+			wantMatchSelector: matchSelectorRequired,
+		},
+		{
+			name:              "Loki label values",
+			path:              "/loki/api/v1/label/app/values",
+			wantAction:        routeRewrite,
+			wantParams:        []string{"query"},
+			wantMatchSelector: matchSelectorInject,
+		},
+		{
+			name:       "Loki push",
+			path:       "/loki/api/v1/push",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "unknown Loki endpoint",
+			path:       "/loki/api/v1/index/stats",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "buildinfo",
+			path:       "/api/v1/status/buildinfo",
+			wantAction: routePass,
+		},
+		{
+			name:       "tsdb",
+			path:       "/admin/tsdb/1",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "api tsdb",
+			path:       "/api/v1/admin/tsdb/delete_series",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "write",
+			path:       "/api/v1/write",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "write (VictoriaMetrics cluster)",
+			path:       "/insert/0/prometheus/api/v1/write",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "write behind dot segments",
+			path:       "/api/v1/query/../write",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "unknown API endpoint",
+			path:       "/api/v1/random",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "API endpoint with a query in the name",
+			path:       "/api/v1/query_anything",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "non-API endpoint",
+			path:       "/graph",
+			wantAction: routePass,
+		},
+		{
+			name:       "Graphite render",
+			path:       "/render",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Graphite metrics find",
+			path:       "/metrics/find",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Graphite tags",
+			path:       "/tags/autoComplete/values",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Graphite API with a prefix",
+			path:       "/graphite/tags/findSeries",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Graphite API of a tenant",
+			path:       "/select/0/graphite/tags/findSeries",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "vmalert proxy",
+			path:       "/select/0/prometheus/vmalert/api/v1/alerts",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "VictoriaMetrics UI of a tenant",
+			path:       "/select/0/vmui/",
+			wantAction: routePass,
+		},
+		{
+			name:       "VictoriaMetrics UI",
+			path:       "/vmui",
+			wantAction: routePass,
+		},
+		{
+			name:       "non-API endpoint containing /api/",
+			path:       "/fakeapi/v1/query",
+			wantAction: routePass,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := app.matchRoute(tt.path)
+			assert.Equal(t, tt.wantAction, got.Action)
+			assert.Equal(t, tt.wantParams, got.Params)
+			assert.Equal(t, tt.wantMatchSelector, got.MatchSelector)
+		})
+	}
+}
+
+func TestApplication_matchRoute_flavors(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	tests := []struct {
+		name       string
+		flavor     string
+		path       string
+		wantAction routeAction
+	}{
+		{
+			name:       "Export for VictoriaMetrics",
+			flavor:     flavorVictoriaMetrics,
+			path:       "/api/v1/export",
+			wantAction: routeRewrite,
+		},
+		{
+			name:       "Export for Prometheus",
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/export",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Export for an unknown flavor",
+			flavor:     flavorAuto,
+			path:       "/api/v1/export",
+			wantAction: routeRewrite,
+		},
+		{
+			name:       "Graphite tags for VictoriaMetrics",
+			flavor:     flavorVictoriaMetrics,
+			path:       "/tags/autoComplete/values",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Graphite API for VictoriaMetrics cluster",
+			flavor:     flavorVictoriaMetricsCluster,
+			path:       "/select/0/graphite/render",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Alertmanager API v2",
+			flavor:     flavorAlertmanager,
+			path:       "/api/v2/silences",
+			wantAction: routeAlertmanager,
+		},
+		{
+			name:       "Alertmanager API v1",
+			flavor:     flavorAlertmanager,
+			path:       "/api/v1/alerts",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Alertmanager API v2 for Prometheus",
+			flavor:     flavorPrometheus,
+			path:       "/api/v2/silences",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Alerts for Prometheus",
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/alerts",
+			wantAction: routeRules,
+		},
+		{
+			name:       "Rules for Mimir",
+			flavor:     flavorMimir,
+			path:       "/prometheus/api/v1/rules",
+			wantAction: routeRules,
+		},
+		{
+			name:       "Remote read for Prometheus",
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/read",
+			wantAction: routeRemoteRead,
+		},
+		{
+			name:       "Remote read for Mimir",
+			flavor:     flavorMimir,
+			path:       "/prometheus/api/v1/read",
+			wantAction: routeRemoteRead,
+		},
+		{
+			name:       "Remote read for VictoriaMetrics",
+			flavor:     flavorVictoriaMetrics,
+			path:       "/api/v1/read",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Remote read for Thanos",
+			flavor:     flavorThanos,
+			path:       "/api/v1/read",
+			wantAction: routeDeny,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				logger:         &logger,
+				UpstreamFlavor: tt.flavor,
+			}
+
+			got := app.matchRoute(tt.path)
+			assert.Equal(t, tt.wantAction, got.Action)
+		})
+	}
+}
+
+func TestApplication_matchRoute_writeMode(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	tests := []struct {
+		name       string
+		writeMode  string
+		flavor     string
+		path       string
+		wantAction routeAction
+	}{
+		{
+			name:       "Write with write mode disabled",
+			writeMode:  writeModeOff,
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/write",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "Write for Prometheus",
+			writeMode:  writeModeReject,
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/write",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Write for VictoriaMetrics cluster",
+			writeMode:  writeModeRewrite,
+			flavor:     flavorVictoriaMetricsCluster,
+			path:       "/insert/0/prometheus/api/v1/write",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Write for an unknown flavor",
+			writeMode:  writeModeReject,
+			flavor:     flavorAuto,
+			path:       "/api/v1/write",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Push for Mimir",
+			writeMode:  writeModeReject,
+			flavor:     flavorMimir,
+			path:       "/api/v1/push",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Push for Prometheus",
+			writeMode:  writeModeReject,
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/push",
+			wantAction: routeDeny,
+		},
+		{
+			name:       "Receive for Thanos",
+			writeMode:  writeModeReject,
+			flavor:     flavorThanos,
+			path:       "/api/v1/receive",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Import for VictoriaMetrics",
+			writeMode:  writeModeReject,
+			flavor:     flavorVictoriaMetrics,
+			path:       "/api/v1/import",
+			wantAction: routeRemoteWrite,
+		},
+		{
+			name:       "Import in other formats is not enforced",
+			writeMode:  writeModeReject,
+			flavor:     flavorVictoriaMetrics,
+			path:       "/api/v1/import/csv",
+			wantAction: routeUnsafe,
+		},
+		{
+			name:       "Import for Prometheus",
+			writeMode:  writeModeReject,
+			flavor:     flavorPrometheus,
+			path:       "/api/v1/import",
+			wantAction: routeUnsafe,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				logger:         &logger,
+				UpstreamFlavor: tt.flavor,
+				WriteMode:      tt.writeMode,
+			}
+
+			got := app.matchRoute(tt.path)
+			assert.Equal(t, tt.wantAction, got.Action)
+		})
+	}
+}
+
+func Test_route_selector(t *testing.T) {
+	logger := zerolog.New(nil)
+	app := &application{
+		logger: &logger,
+	}
+
+	rt := app.matchRoute("/api/v1/labels")
+	assert.Equal(t, "match[]", rt.selectorParam())
+	assert.Equal(t, defaultMatchSelector, rt.defaultSelector())
+
+	rt = app.matchRoute("/loki/api/v1/labels")
+	assert.Equal(t, "query", rt.selectorParam())
+	assert.Equal(t, defaultLogQLSelector, rt.defaultSelector())
+}
@@ -0,0 +1,160 @@
+package lfgw
+
+import (
+	"encoding/json"
+
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// ruleLabels describes the part of a rule used for filtering, alerts are present only for alerting rules
+type ruleLabels struct {
+	Labels map[string]string `json:"labels"`
+	Alerts []json.RawMessage `json:"alerts"`
+}
+
+// rulesResponseFilter returns a responseFilter for /api/v1/rules or /api/v1/alerts responses, the path is expected to be normalized.
+func rulesResponseFilter(p string, e *querymodifier.SeriesEnforcer) responseFilter {
+	if p == "/api/v1/alerts" {
+		return func(body []byte) ([]byte, error) {
+			return modifyResponseData(body, func(data map[string]json.RawMessage) error {
+				return filterAlertsData(data, e)
+			})
+		}
+	}
+
+	return func(body []byte) ([]byte, error) {
+		return modifyResponseData(body, func(data map[string]json.RawMessage) error {
+			return filterRuleGroupsData(data, e)
+		})
+	}
+}
+
+// modifyResponseData applies modify to the data field of a Prometheus API response, other fields are kept as is. Responses without data are returned unmodified.
+func modifyResponseData(body []byte, modify func(data map[string]json.RawMessage) error) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var data map[string]json.RawMessage
+	if raw, ok := resp["data"]; ok {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return body, nil
+	}
+
+	if err := modify(data); err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	resp["data"] = raw
+
+	return json.Marshal(resp)
+}
+
+// filterAlertsData removes alerts not allowed by the ACL from the data of an /api/v1/alerts response.
+func filterAlertsData(data map[string]json.RawMessage, e *querymodifier.SeriesEnforcer) error {
+	var alerts []json.RawMessage
+	if raw, ok := data["alerts"]; ok {
+		if err := json.Unmarshal(raw, &alerts); err != nil {
+			return err
+		}
+	}
+
+	alerts, err := filterAlertList(alerts, e)
+	if err != nil {
+		return err
+	}
+
+	data["alerts"], err = json.Marshal(alerts)
+	return err
+}
+
+// filterRuleGroupsData removes rules not allowed by the ACL from the data of an /api/v1/rules response, groups without rules are dropped. A rule is kept if its labels are allowed by the ACL or if any of its alerts are, alerts not allowed by the ACL are removed in both cases.
+func filterRuleGroupsData(data map[string]json.RawMessage, e *querymodifier.SeriesEnforcer) error {
+	var groups []map[string]json.RawMessage
+	if raw, ok := data["groups"]; ok {
+		if err := json.Unmarshal(raw, &groups); err != nil {
+			return err
+		}
+	}
+
+	filtered := make([]map[string]json.RawMessage, 0, len(groups))
+	for _, group := range groups {
+		var rules []json.RawMessage
+		if raw, ok := group["rules"]; ok {
+			if err := json.Unmarshal(raw, &rules); err != nil {
+				return err
+			}
+		}
+
+		rules, err := filterRuleList(rules, e)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			continue
+		}
+
+		group["rules"], err = json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		filtered = append(filtered, group)
+	}
+
+	var err error
+	data["groups"], err = json.Marshal(filtered)
+	return err
+}
+
+// filterRuleList returns raw rules allowed by the ACL with alerts not allowed by the ACL removed.
+func filterRuleList(rules []json.RawMessage, e *querymodifier.SeriesEnforcer) ([]json.RawMessage, error) {
+	filtered := make([]json.RawMessage, 0, len(rules))
+
+	for _, raw := range rules {
+		var rule map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return nil, err
+		}
+
+		var rl ruleLabels
+		if err := json.Unmarshal(raw, &rl); err != nil {
+			return nil, err
+		}
+		if rl.Labels == nil {
+			rl.Labels = make(map[string]string)
+		}
+
+		alerts, err := filterAlertList(rl.Alerts, e)
+		if err != nil {
+			return nil, err
+		}
+		if !e.Enforce(rl.Labels) && len(alerts) == 0 {
+			continue
+		}
+
+		// Recording rules don't have alerts
+		if _, ok := rule["alerts"]; ok {
+			rule["alerts"], err = json.Marshal(alerts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		raw, err = json.Marshal(rule)
+		if err != nil {
+			return nil, err
+		}
+		filtered = append(filtered, raw)
+	}
+
+	return filtered, nil
+}
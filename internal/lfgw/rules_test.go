@@ -0,0 +1,103 @@
+package lfgw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_rulesResponseFilter(t *testing.T) {
+	acl, err := querymodifier.NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := querymodifier.NewSeriesEnforcer(acl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Alerts",
+			path: "/api/v1/alerts",
+			body: `{"status":"success","data":{"alerts":[
+{"labels":{"alertname":"A","namespace":"minio"},"state":"firing","value":"1e+00"},
+{"labels":{"alertname":"B","namespace":"stolon"},"state":"firing","value":"1e+00"}
+]}}`,
+			want: `{"status":"success","data":{"alerts":[
+{"labels":{"alertname":"A","namespace":"minio"},"state":"firing","value":"1e+00"}
+]}}`,
+		},
+		{
+			name: "Rules",
+			path: "/api/v1/rules",
+			body: `{"status":"success","data":{"groups":[
+{"name":"minio","file":"minio.yaml","interval":30,"rules":[
+  {"name":"minio:up","query":"up{namespace=\"minio\"}","labels":{"namespace":"minio"},"type":"recording"},
+  {"name":"MinioDown","query":"up{namespace=\"minio\"} == 0","labels":{"namespace":"minio","severity":"critical"},"alerts":[],"state":"inactive","type":"alerting"}
+]},
+{"name":"stolon","file":"stolon.yaml","interval":30,"rules":[
+  {"name":"stolon:up","query":"up{namespace=\"stolon\"}","labels":{"namespace":"stolon"},"type":"recording"}
+]},
+{"name":"common","file":"common.yaml","interval":30,"rules":[
+  {"name":"TargetDown","query":"up == 0","labels":{"severity":"warning"},"state":"firing","type":"alerting","alerts":[
+    {"labels":{"alertname":"TargetDown","namespace":"minio","severity":"warning"},"state":"firing"},
+    {"labels":{"alertname":"TargetDown","namespace":"stolon","severity":"warning"},"state":"firing"}
+  ]},
+  {"name":"Watchdog","query":"vector(1)","labels":{"severity":"none"},"state":"firing","type":"alerting","alerts":[
+    {"labels":{"alertname":"Watchdog","severity":"none"},"state":"firing"}
+  ]}
+]}
+]}}`,
+			want: `{"status":"success","data":{"groups":[
+{"name":"minio","file":"minio.yaml","interval":30,"rules":[
+  {"name":"minio:up","query":"up{namespace=\"minio\"}","labels":{"namespace":"minio"},"type":"recording"},
+  {"name":"MinioDown","query":"up{namespace=\"minio\"} == 0","labels":{"namespace":"minio","severity":"critical"},"alerts":[],"state":"inactive","type":"alerting"}
+]},
+{"name":"common","file":"common.yaml","interval":30,"rules":[
+  {"name":"TargetDown","query":"up == 0","labels":{"severity":"warning"},"state":"firing","type":"alerting","alerts":[
+    {"labels":{"alertname":"TargetDown","namespace":"minio","severity":"warning"},"state":"firing"}
+  ]}
+]}
+]}}`,
+		},
+		{
+			name: "Error response",
+			path: "/api/v1/rules",
+			body: `{"status":"error","errorType":"bad_data","error":"unsupported type"}`,
+			want: `{"status":"error","errorType":"bad_data","error":"unsupported type"}`,
+		},
+		{
+			name:    "Incorrect rules",
+			path:    "/api/v1/rules",
+			body:    `{"status":"success","data":{"groups":{}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "Not JSON",
+			path:    "/api/v1/alerts",
+			body:    `<html></html>`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rulesResponseFilter(tt.path, e)([]byte(tt.body))
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package lfgw
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// safeModeRule describes requests to block (or to allow) in safe mode. Pattern follows path.Match syntax, a trailing /* also matches all nested paths. An empty Method matches all methods.
+type safeModeRule struct {
+	Method  string
+	Pattern string
+}
+
+// parseSafeModeRule parses a rule in the form of "[METHOD ]pattern", e.g. "POST /api/v1/import/*" or "/-/reload".
+func parseSafeModeRule(s string) (safeModeRule, error) {
+	fields := strings.Fields(s)
+
+	var rule safeModeRule
+	switch len(fields) {
+	case 1:
+		rule.Pattern = fields[0]
+	case 2:
+		rule.Method = strings.ToUpper(fields[0])
+		rule.Pattern = fields[1]
+	default:
+		return safeModeRule{}, fmt.Errorf("incorrect safe mode rule %q, expected format: [METHOD ]pattern", s)
+	}
+
+	if !strings.HasPrefix(rule.Pattern, "/") {
+		return safeModeRule{}, fmt.Errorf("incorrect safe mode rule %q, pattern has to start with /", s)
+	}
+
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return safeModeRule{}, fmt.Errorf("incorrect safe mode rule %q: %w", s, err)
+	}
+
+	return rule, nil
+}
+
+// parseSafeModeRules parses a list of safe mode rules.
+func parseSafeModeRules(rules []string) ([]safeModeRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]safeModeRule, 0, len(rules))
+	for _, s := range rules {
+		rule, err := parseSafeModeRule(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+// matches returns true if the request method and the normalized path match the rule.
+func (rule safeModeRule) matches(method string, p string) bool {
+	if rule.Method != "" && rule.Method != method {
+		return false
+	}
+
+	if ok, err := path.Match(rule.Pattern, p); err == nil && ok {
+		return true
+	}
+
+	// A trailing /* covers nested paths as well, e.g. /snapshot/* matches /snapshot/delete/1
+	if prefix, ok := strings.CutSuffix(rule.Pattern, "*"); ok && strings.HasSuffix(prefix, "/") && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(p, prefix)
+	}
+
+	return false
+}
+
+// matchesAnySafeModeRule returns true if the request matches any of the rules.
+func matchesAnySafeModeRule(rules []safeModeRule, method string, p string) bool {
+	for _, rule := range rules {
+		if rule.matches(method, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// safeModeRuleSets contains built-in rules per backend flavor. Paths are normalized before matching (see normalizeRoutePath), so the rules don't need to include VictoriaMetrics prefixes.
+var safeModeRuleSets = map[string][]safeModeRule{
+	flavorPrometheus: {
+		{Pattern: "/api/v1/admin/*"},
+		{Pattern: "/api/v1/write"},
+		{Pattern: "/api/v1/otlp/*"},
+		{Pattern: "/-/reload"},
+		{Pattern: "/-/quit"},
+	},
+	flavorVictoriaMetrics: {
+		{Pattern: "/api/v1/admin/*"},
+		{Pattern: "/api/v1/write"},
+		{Pattern: "/api/v1/import"},
+		{Pattern: "/api/v1/import/*"},
+		{Pattern: "/api/put"},
+		{Pattern: "/write"},
+		{Pattern: "/influx/*"},
+		{Pattern: "/datadog/*"},
+		{Pattern: "/newrelic/*"},
+		{Pattern: "/opentelemetry/*"},
+		{Pattern: "/opentsdb/*"},
+		{Pattern: "/internal/*"},
+		{Pattern: "/snapshot/*"},
+		{Pattern: "/-/reload"},
+	},
+	flavorVictoriaMetricsCluster: {
+		{Pattern: "/api/v1/admin/*"},
+		// /insert/<tenant>/prometheus prefix is stripped during normalization
+		{Pattern: "/api/v1/write"},
+		{Pattern: "/api/v1/import"},
+		{Pattern: "/api/v1/import/*"},
+		{Pattern: "/insert/*"},
+		{Pattern: "/delete/*"},
+		{Pattern: "/internal/*"},
+		{Pattern: "/snapshot/*"},
+		{Pattern: "/admin/*"},
+		{Pattern: "/-/reload"},
+	},
+	flavorThanos: {
+		{Pattern: "/api/v1/receive"},
+		{Pattern: "/-/reload"},
+		{Pattern: "/-/quit"},
+	},
+	flavorAlertmanager: {
+		{Pattern: "/-/reload"},
+	},
+	flavorMimir: {
+		{Pattern: "/api/v1/push"},
+		{Pattern: "/otlp/*"},
+		{Pattern: "/ingester/*"},
+		{Pattern: "/distributor/*"},
+		{Pattern: "/compactor/*"},
+		{Pattern: "/store-gateway/*"},
+		{Method: http.MethodPost, Pattern: "/config/v1/rules/*"},
+		{Method: http.MethodDelete, Pattern: "/config/v1/rules/*"},
+	},
+}
+
+// safeModeFlavors returns names of flavors with built-in safe mode rules in alphabetical order.
+func safeModeFlavors() []string {
+	flavors := make([]string, 0, len(safeModeRuleSets)+1)
+	for flavor := range safeModeRuleSets {
+		flavors = append(flavors, flavor)
+	}
+	flavors = append(flavors, flavorAll)
+	sort.Strings(flavors)
+
+	return flavors
+}
+
+// validateSafeModeFlavor returns an error if there are no built-in rules for the flavor. An empty flavor is treated as flavorAuto.
+func validateSafeModeFlavor(flavor string) error {
+	if flavor == "" || flavor == flavorAuto || flavor == flavorAll {
+		return nil
+	}
+
+	if _, ok := safeModeRuleSets[flavor]; !ok {
+		return fmt.Errorf("unknown flavor %q (supported: %s, %s)", flavor, flavorAuto, strings.Join(safeModeFlavors(), ", "))
+	}
+
+	return nil
+}
+
+// safeModeRulesFor returns built-in rules for the flavor, rules for all flavors are returned for flavorAll or an unknown flavor (e.g. when it's not detected yet).
+func safeModeRulesFor(flavor string) []safeModeRule {
+	if rules, ok := safeModeRuleSets[flavor]; ok {
+		return rules
+	}
+
+	rules := []safeModeRule{}
+	for _, f := range safeModeFlavors() {
+		rules = append(rules, safeModeRuleSets[f]...)
+	}
+
+	return rules
+}
+
+// safeModeFlavor returns the flavor to take built-in safe mode rules for, it's the upstream flavor unless the flavor is set explicitly.
+func (app *application) safeModeFlavor() string {
+	if app.SafeModeFlavor != "" && app.SafeModeFlavor != flavorAuto {
+		return app.SafeModeFlavor
+	}
+
+	return app.upstreamFlavor()
+}
+
+// isBlockedBySafeMode returns true if the request has to be blocked in safe mode. Users with any of the exempt roles are never blocked. User-defined allow rules take precedence over user-defined deny rules, built-in rules for the flavor (see safeModeFlavor) and unsafe endpoints from the route table. Write endpoints enforced in write mode are allowed unless they're denied by user-defined rules.
+func (app *application) isBlockedBySafeMode(r *http.Request, roles []string) bool {
+	for _, role := range roles {
+		if containsString(app.SafeModeExemptRoles, role) {
+			return false
+		}
+	}
+
+	p := normalizeRoutePath(r.URL.Path)
+
+	if matchesAnySafeModeRule(app.SafeModeAllow, r.Method, p) {
+		return false
+	}
+
+	if matchesAnySafeModeRule(app.SafeModeDeny, r.Method, p) {
+		return true
+	}
+
+	action := app.matchRoute(r.URL.Path).Action
+	if action == routeRemoteWrite {
+		return false
+	}
+
+	if matchesAnySafeModeRule(safeModeRulesFor(app.safeModeFlavor()), r.Method, p) {
+		return true
+	}
+
+	return action == routeUnsafe
+}
@@ -0,0 +1,291 @@
+package lfgw
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSafeModeRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want safeModeRule
+		fail bool
+	}{
+		{
+			name: "Pattern",
+			rule: "/-/reload",
+			want: safeModeRule{Pattern: "/-/reload"},
+		},
+		{
+			name: "Method and pattern",
+			rule: "post  /api/v1/import/*",
+			want: safeModeRule{Method: "POST", Pattern: "/api/v1/import/*"},
+		},
+		{
+			name: "Empty rule",
+			rule: "",
+			fail: true,
+		},
+		{
+			name: "Too many fields",
+			rule: "GET /api/v1/query extra",
+			fail: true,
+		},
+		{
+			name: "Relative pattern",
+			rule: "api/v1/write",
+			fail: true,
+		},
+		{
+			name: "Incorrect pattern",
+			rule: "/api/v1/[write",
+			fail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSafeModeRule(tt.rule)
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_safeModeRule_matches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   safeModeRule
+		method string
+		path   string
+		want   bool
+	}{
+		{
+			name:   "Exact path",
+			rule:   safeModeRule{Pattern: "/-/reload"},
+			method: http.MethodPost,
+			path:   "/-/reload",
+			want:   true,
+		},
+		{
+			name:   "Different path",
+			rule:   safeModeRule{Pattern: "/-/reload"},
+			method: http.MethodPost,
+			path:   "/-/ready",
+			want:   false,
+		},
+		{
+			name:   "Matching method",
+			rule:   safeModeRule{Method: http.MethodPost, Pattern: "/api/v1/import"},
+			method: http.MethodPost,
+			path:   "/api/v1/import",
+			want:   true,
+		},
+		{
+			name:   "Different method",
+			rule:   safeModeRule{Method: http.MethodPost, Pattern: "/api/v1/import"},
+			method: http.MethodGet,
+			path:   "/api/v1/import",
+			want:   false,
+		},
+		{
+			name:   "Trailing wildcard matches nested paths",
+			rule:   safeModeRule{Pattern: "/snapshot/*"},
+			method: http.MethodGet,
+			path:   "/snapshot/delete/1",
+			want:   true,
+		},
+		{
+			name:   "Trailing wildcard doesn't match the parent path",
+			rule:   safeModeRule{Pattern: "/snapshot/*"},
+			method: http.MethodGet,
+			path:   "/snapshot",
+			want:   false,
+		},
+		{
+			name:   "Wildcard in the middle matches only one segment",
+			rule:   safeModeRule{Pattern: "/api/*/write"},
+			method: http.MethodGet,
+			path:   "/api/v1/v2/write",
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.matches(tt.method, tt.path)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplication_isBlockedBySafeMode(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	tests := []struct {
+		name   string
+		app    application
+		method string
+		path   string
+		roles  []string
+		want   bool
+	}{
+		{
+			name:   "Prometheus reload",
+			app:    application{SafeModeFlavor: flavorPrometheus},
+			method: http.MethodPost,
+			path:   "/-/reload",
+			want:   true,
+		},
+		{
+			name:   "VictoriaMetrics cache reset is allowed for Prometheus",
+			app:    application{SafeModeFlavor: flavorPrometheus},
+			method: http.MethodGet,
+			path:   "/internal/resetRollupResultCache",
+			want:   false,
+		},
+		{
+			name:   "VictoriaMetrics cache reset",
+			app:    application{SafeModeFlavor: flavorVictoriaMetrics},
+			method: http.MethodGet,
+			path:   "/internal/resetRollupResultCache",
+			want:   true,
+		},
+		{
+			name:   "VictoriaMetrics import with a prefix",
+			app:    application{SafeModeFlavor: flavorVictoriaMetrics},
+			method: http.MethodPost,
+			path:   "/prometheus/api/v1/import/prometheus",
+			want:   true,
+		},
+		{
+			name:   "VictoriaMetrics cluster delete",
+			app:    application{SafeModeFlavor: flavorVictoriaMetricsCluster},
+			method: http.MethodPost,
+			path:   "/delete/0/prometheus/api/v1/admin/tsdb/delete_series",
+			want:   true,
+		},
+		{
+			name:   "VictoriaMetrics cluster write",
+			app:    application{SafeModeFlavor: flavorVictoriaMetricsCluster},
+			method: http.MethodPost,
+			path:   "/insert/0/prometheus/api/v1/write",
+			want:   true,
+		},
+		{
+			name:   "Write enforced in write mode",
+			app:    application{UpstreamFlavor: flavorVictoriaMetricsCluster, WriteMode: writeModeReject},
+			method: http.MethodPost,
+			path:   "/insert/0/prometheus/api/v1/write",
+			want:   false,
+		},
+		{
+			name:   "Import in other formats is blocked in write mode",
+			app:    application{UpstreamFlavor: flavorVictoriaMetrics, WriteMode: writeModeReject},
+			method: http.MethodPost,
+			path:   "/api/v1/import/csv",
+			want:   true,
+		},
+		{
+			name: "User-defined deny rule takes precedence over write mode",
+			app: application{
+				UpstreamFlavor: flavorPrometheus,
+				WriteMode:      writeModeReject,
+				SafeModeDeny:   []safeModeRule{{Pattern: "/api/v1/write"}},
+			},
+			method: http.MethodPost,
+			path:   "/api/v1/write",
+			want:   true,
+		},
+		{
+			name:   "All flavors",
+			app:    application{},
+			method: http.MethodGet,
+			path:   "/snapshot/create",
+			want:   true,
+		},
+		{
+			name:   "Unsafe endpoint from the route table",
+			app:    application{SafeModeFlavor: flavorPrometheus},
+			method: http.MethodPost,
+			path:   "/api/v1/import",
+			want:   true,
+		},
+		{
+			name:   "Rules for the upstream flavor",
+			app:    application{SafeModeFlavor: flavorAuto, UpstreamFlavor: flavorMimir},
+			method: http.MethodPost,
+			path:   "/api/v1/push",
+			want:   true,
+		},
+		{
+			name:   "Explicit safe mode flavor takes precedence",
+			app:    application{SafeModeFlavor: flavorPrometheus, UpstreamFlavor: flavorMimir},
+			method: http.MethodPost,
+			path:   "/api/v1/push",
+			want:   false,
+		},
+		{
+			name:   "Query",
+			app:    application{},
+			method: http.MethodGet,
+			path:   "/api/v1/query",
+			want:   false,
+		},
+		{
+			name:   "User-defined deny rule",
+			app:    application{SafeModeDeny: []safeModeRule{{Method: http.MethodPost, Pattern: "/api/v1/query"}}},
+			method: http.MethodPost,
+			path:   "/api/v1/query",
+			want:   true,
+		},
+		{
+			name: "User-defined allow rule takes precedence",
+			app: application{
+				SafeModeAllow: []safeModeRule{{Method: http.MethodGet, Pattern: "/api/v1/admin/tsdb/snapshot"}},
+			},
+			method: http.MethodGet,
+			path:   "/api/v1/admin/tsdb/snapshot",
+			want:   false,
+		},
+		{
+			name:   "Exempt role",
+			app:    application{SafeModeExemptRoles: []string{"admin"}},
+			method: http.MethodPost,
+			path:   "/-/reload",
+			roles:  []string{"team-a", "admin"},
+			want:   false,
+		},
+		{
+			name:   "Not exempt role",
+			app:    application{SafeModeExemptRoles: []string{"admin"}},
+			method: http.MethodPost,
+			path:   "/-/reload",
+			roles:  []string{"team-a"},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.app.logger = &logger
+
+			r, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := tt.app.isBlockedBySafeMode(r, tt.roles)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
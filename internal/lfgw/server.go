@@ -23,6 +23,7 @@ func (app *application) serve() error {
 	// TODO: somehow pass more context to ErrorLog (unsafe?)
 	app.proxy.ErrorLog = app.errorLog
 	app.proxy.FlushInterval = time.Millisecond * 200
+	app.proxy.ModifyResponse = app.modifyResponse
 
 	// TODO: somehow pass more context to ErrorLog
 	//#nosec G112 -- false positive, may be removed after gosec v2.12.0+ is released
@@ -74,3 +75,12 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// upstreamTransport returns the transport of the reverse proxy, so that requests sent to the upstream by lfgw itself (e.g. to fetch a silence) use the same connections and settings as proxied requests.
+func (app *application) upstreamTransport() http.RoundTripper {
+	if app.proxy != nil && app.proxy.Transport != nil {
+		return app.proxy.Transport
+	}
+
+	return http.DefaultTransport
+}
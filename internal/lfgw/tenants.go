@@ -0,0 +1,155 @@
+package lfgw
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// vmTenantPathRe matches paths of VictoriaMetrics cluster components containing a tenant (/select/<tenant>/..., /insert/<tenant>/..., /delete/<tenant>/...)
+var vmTenantPathRe = regexp.MustCompile(`^/(?:select|insert|delete)/([^/]+)(?:/|$)`)
+
+// vmAccountIDRe matches tenants consisting only of an account ID, which implies projectID 0
+var vmAccountIDRe = regexp.MustCompile(`^\d+$`)
+
+// normalizeVMTenant returns the tenant in the form of accountID:projectID, so that "1" and "1:0" are treated equally.
+func normalizeVMTenant(tenant string) string {
+	if vmAccountIDRe.MatchString(tenant) {
+		return tenant + ":0"
+	}
+
+	return tenant
+}
+
+// isVMTenantAllowed returns true if the tenant is amongst the allowed ones.
+func isVMTenantAllowed(allowed []string, tenant string) bool {
+	tenant = normalizeVMTenant(tenant)
+
+	for _, t := range allowed {
+		if t == querymodifier.AllTenants || normalizeVMTenant(t) == tenant {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vmInsertPathRe matches paths of Prometheus-compatible API, which are served by vminsert rather than vmselect
+var vmInsertPathRe = regexp.MustCompile(`^/api/v1/(write|import(/.*)?)$`)
+
+// routeVMTenant checks the tenant in the path of the request against tenants of the ACL. If the path doesn't contain a tenant, the upstream is VictoriaMetrics cluster and the ACL allows exactly one tenant, then the request is routed to that tenant's Prometheus-compatible API (of vminsert for write endpoints, of vmselect otherwise). An error is returned if the tenant is not allowed. Requests without a tenant, which cannot be routed to the only tenant, are rejected as well when tenants are restricted, unless tenants are passed in the tenant header (see setTenantHeader).
+func (app *application) routeVMTenant(r *http.Request, acl querymodifier.ACL) error {
+	if acl.AllowsAllTenants() {
+		return nil
+	}
+
+	if m := vmTenantPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		if !isVMTenantAllowed(acl.Tenants, m[1]) {
+			return fmt.Errorf("tenant %s is not allowed for the user", m[1])
+		}
+		return nil
+	}
+
+	if app.TenantHeader != "" || app.isTenantHeaderFlavor() {
+		return nil
+	}
+
+	// Otherwise, a tenant-routing proxy in front of the upstream (e.g. vmauth) would receive requests without any tenant checks
+	errNoTenant := fmt.Errorf("a tenant has to be specified in the path of %s", r.URL.Path)
+
+	if len(acl.Tenants) != 1 || app.upstreamFlavor() != flavorVictoriaMetricsCluster {
+		return errNoTenant
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/prometheus")
+	if !strings.HasPrefix(p, "/api/v1/") && p != "/federate" {
+		return errNoTenant
+	}
+
+	component := "select"
+	if vmInsertPathRe.MatchString(p) {
+		component = "insert"
+	}
+
+	r.URL.Path = "/" + component + "/" + acl.Tenants[0] + "/prometheus" + p
+	r.URL.RawPath = ""
+
+	return nil
+}
+
+// tenantHeaderRe is used to validate the name of the tenant header
+var tenantHeaderRe = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// tenantsSeparator is used by Mimir, Cortex and Loki for joining tenants in federated (cross-tenant) queries
+const tenantsSeparator = "|"
+
+// validateTenantHeader returns an error if the header name is not valid. An empty name means that the header is not set.
+func validateTenantHeader(name string) error {
+	if name != "" && !tenantHeaderRe.MatchString(name) {
+		return fmt.Errorf("incorrect header name %q", name)
+	}
+
+	return nil
+}
+
+// defaultTenantHeader is used by Mimir, Cortex and Loki, it's set for restricted tenants even if the tenant header is not configured
+const defaultTenantHeader = "X-Scope-OrgID"
+
+// isTenantHeaderFlavor returns true if the upstream flavor is known and it's not VictoriaMetrics, so tenants cannot be passed in the path.
+func (app *application) isTenantHeaderFlavor() bool {
+	switch app.upstreamFlavor() {
+	case "", flavorAuto, flavorVictoriaMetrics, flavorVictoriaMetricsCluster:
+		return false
+	}
+
+	return true
+}
+
+// tenantHeader returns the name of the header tenants of the ACL are passed in, an empty string means that the header is not set. If the header is not configured, but tenants are restricted, defaultTenantHeader is used unless the upstream is VictoriaMetrics, otherwise tenant restrictions could be bypassed with a client-provided header.
+func (app *application) tenantHeader(acl querymodifier.ACL) string {
+	if app.TenantHeader != "" {
+		return app.TenantHeader
+	}
+
+	switch app.upstreamFlavor() {
+	case flavorVictoriaMetrics, flavorVictoriaMetricsCluster:
+		return ""
+	}
+
+	if acl.TenantsRestricted {
+		return defaultTenantHeader
+	}
+
+	return ""
+}
+
+// setTenantHeader overwrites the tenant header (e.g. X-Scope-OrgID, see tenantHeader) with tenants of the ACL joined with "|". Client-provided values are never forwarded, so the header is removed if the ACL doesn't restrict tenants. defaultTenantHeader is removed from requests of users without full access even if the tenant header is not set. An error is returned if the ACL doesn't allow any tenant.
+func (app *application) setTenantHeader(r *http.Request, acl querymodifier.ACL) error {
+	if !acl.Fullaccess {
+		r.Header.Del(defaultTenantHeader)
+	}
+
+	header := app.tenantHeader(acl)
+	if header == "" {
+		return nil
+	}
+
+	r.Header.Del(header)
+
+	if acl.AllowsAllTenants() {
+		return nil
+	}
+
+	if len(acl.Tenants) == 0 {
+		return fmt.Errorf("no tenants are allowed for the user")
+	}
+
+	tenants := strings.Join(acl.Tenants, tenantsSeparator)
+	r.Header.Set(header, tenants)
+	app.enrichDebugLogContext(r, "tenants", tenants)
+
+	return nil
+}
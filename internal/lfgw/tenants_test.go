@@ -0,0 +1,280 @@
+package lfgw
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_isVMTenantAllowed(t *testing.T) {
+	allowed := []string{"1", "2:3"}
+
+	assert.True(t, isVMTenantAllowed(allowed, "1"))
+	assert.True(t, isVMTenantAllowed(allowed, "1:0"))
+	assert.True(t, isVMTenantAllowed(allowed, "2:3"))
+	assert.False(t, isVMTenantAllowed(allowed, "2"))
+	assert.False(t, isVMTenantAllowed(allowed, "1:1"))
+	assert.False(t, isVMTenantAllowed(allowed, "multitenant"))
+}
+
+func TestApplication_routeVMTenant(t *testing.T) {
+	tests := []struct {
+		name         string
+		flavor       string
+		tenants      []string
+		restricted   bool
+		tenantHeader string
+		path         string
+		wantPath     string
+		fail         bool
+	}{
+		{
+			name:     "Tenants are not restricted",
+			flavor:   flavorVictoriaMetricsCluster,
+			path:     "/select/5/prometheus/api/v1/query",
+			wantPath: "/select/5/prometheus/api/v1/query",
+		},
+		{
+			name:       "No tenants are allowed if tenants are restricted",
+			flavor:     flavorVictoriaMetricsCluster,
+			restricted: true,
+			path:       "/select/5/prometheus/api/v1/query",
+			fail:       true,
+		},
+		{
+			name:       "All tenants are allowed",
+			flavor:     flavorVictoriaMetricsCluster,
+			tenants:    []string{"*"},
+			restricted: true,
+			path:       "/select/5/prometheus/api/v1/query",
+			wantPath:   "/select/5/prometheus/api/v1/query",
+		},
+		{
+			name:     "Allowed tenant",
+			flavor:   flavorVictoriaMetricsCluster,
+			tenants:  []string{"1", "2"},
+			path:     "/select/2:0/prometheus/api/v1/query",
+			wantPath: "/select/2:0/prometheus/api/v1/query",
+		},
+		{
+			name:    "Tenant is not allowed",
+			flavor:  flavorVictoriaMetricsCluster,
+			tenants: []string{"1", "2"},
+			path:    "/select/3/prometheus/api/v1/query",
+			fail:    true,
+		},
+		{
+			name:    "Tenant is not allowed for deletion",
+			flavor:  flavorVictoriaMetricsCluster,
+			tenants: []string{"1"},
+			path:    "/delete/3/prometheus/api/v1/admin/tsdb/delete_series",
+			fail:    true,
+		},
+		{
+			name:     "Request is routed to the only tenant",
+			flavor:   flavorVictoriaMetricsCluster,
+			tenants:  []string{"1:2"},
+			path:     "/api/v1/query_range",
+			wantPath: "/select/1:2/prometheus/api/v1/query_range",
+		},
+		{
+			name:     "Request with the /prometheus prefix is routed to the only tenant",
+			flavor:   flavorVictoriaMetricsCluster,
+			tenants:  []string{"1:2"},
+			path:     "/prometheus/federate",
+			wantPath: "/select/1:2/prometheus/federate",
+		},
+		{
+			name:     "Write request is routed to vminsert of the only tenant",
+			flavor:   flavorVictoriaMetricsCluster,
+			tenants:  []string{"1:2"},
+			path:     "/api/v1/import",
+			wantPath: "/insert/1:2/prometheus/api/v1/import",
+		},
+		{
+			name:    "Tenant is not allowed for writes",
+			flavor:  flavorVictoriaMetricsCluster,
+			tenants: []string{"1"},
+			path:    "/insert/3/prometheus/api/v1/write",
+			fail:    true,
+		},
+		{
+			name:    "Request without a tenant is rejected if there are multiple tenants",
+			flavor:  flavorVictoriaMetricsCluster,
+			tenants: []string{"1", "2"},
+			path:    "/api/v1/query",
+			fail:    true,
+		},
+		{
+			name:    "Request without a tenant is rejected for VictoriaMetrics single-node",
+			flavor:  flavorVictoriaMetrics,
+			tenants: []string{"1"},
+			path:    "/api/v1/query",
+			fail:    true,
+		},
+		{
+			name:     "Tenants are passed in the default header for other flavors",
+			flavor:   flavorMimir,
+			tenants:  []string{"1", "2"},
+			path:     "/api/v1/query",
+			wantPath: "/api/v1/query",
+		},
+		{
+			name:    "Request without a tenant is rejected until the flavor is detected",
+			flavor:  flavorAuto,
+			tenants: []string{"1"},
+			path:    "/api/v1/query",
+			fail:    true,
+		},
+		{
+			name:    "Request to a path other than Prometheus API without a tenant is rejected",
+			flavor:  flavorVictoriaMetricsCluster,
+			tenants: []string{"1"},
+			path:    "/graphite/render",
+			fail:    true,
+		},
+		{
+			name:         "Tenants are passed in the header",
+			flavor:       flavorMimir,
+			tenants:      []string{"1", "2"},
+			tenantHeader: "X-Scope-OrgID",
+			path:         "/api/v1/query",
+			wantPath:     "/api/v1/query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{UpstreamFlavor: tt.flavor, TenantHeader: tt.tenantHeader}
+
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = app.routeVMTenant(r, querymodifier.ACL{Tenants: tt.tenants, TenantsRestricted: tt.restricted})
+			if tt.fail {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantPath, r.URL.Path)
+		})
+	}
+}
+
+func Test_validateTenantHeader(t *testing.T) {
+	assert.Nil(t, validateTenantHeader(""))
+	assert.Nil(t, validateTenantHeader("X-Scope-OrgID"))
+	assert.NotNil(t, validateTenantHeader("X-Scope OrgID"))
+	assert.NotNil(t, validateTenantHeader("X-Scope-OrgID:"))
+}
+
+func TestApplication_setTenantHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		tenantHeader string
+		flavor       string
+		tenants      []string
+		restricted   bool
+		fullaccess   bool
+		clientValue  string
+		want         []string
+		fail         bool
+	}{
+		{
+			name:         "Header is disabled",
+			tenantHeader: "",
+			fullaccess:   true,
+			clientValue:  "team-b",
+			want:         []string{"team-b"},
+		},
+		{
+			name:         "Header is removed for users without full access even if it's disabled",
+			tenantHeader: "",
+			clientValue:  "team-b",
+			want:         nil,
+		},
+		{
+			name:         "Default header is used for restricted tenants",
+			tenantHeader: "",
+			flavor:       flavorMimir,
+			tenants:      []string{"team-a"},
+			restricted:   true,
+			clientValue:  "team-b",
+			want:         []string{"team-a"},
+		},
+		{
+			name:         "Default header is not used for VictoriaMetrics",
+			tenantHeader: "",
+			flavor:       flavorVictoriaMetricsCluster,
+			tenants:      []string{"1"},
+			restricted:   true,
+			clientValue:  "team-b",
+			want:         nil,
+		},
+		{
+			name:         "Client-provided value is overwritten",
+			tenantHeader: "X-Scope-OrgID",
+			tenants:      []string{"team-a"},
+			clientValue:  "team-b",
+			want:         []string{"team-a"},
+		},
+		{
+			name:         "Multiple tenants are joined",
+			tenantHeader: "X-Scope-OrgID",
+			tenants:      []string{"team-a", "team-b"},
+			want:         []string{"team-a|team-b"},
+		},
+		{
+			name:         "Client-provided value is removed if tenants are not restricted",
+			tenantHeader: "X-Scope-OrgID",
+			clientValue:  "team-b",
+			want:         nil,
+		},
+		{
+			name:         "Client-provided value is removed if all tenants are allowed",
+			tenantHeader: "X-Scope-OrgID",
+			tenants:      []string{"*"},
+			restricted:   true,
+			clientValue:  "team-b",
+			want:         nil,
+		},
+		{
+			name:         "No tenants are allowed if tenants are restricted",
+			tenantHeader: "X-Scope-OrgID",
+			restricted:   true,
+			clientValue:  "team-b",
+			fail:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zerolog.New(nil)
+			app := &application{logger: &logger, TenantHeader: tt.tenantHeader, UpstreamFlavor: tt.flavor}
+
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.clientValue != "" {
+				r.Header.Set("X-Scope-OrgID", tt.clientValue)
+			}
+
+			err = app.setTenantHeader(r, querymodifier.ACL{Fullaccess: tt.fullaccess, Tenants: tt.tenants, TenantsRestricted: tt.restricted})
+			if tt.fail {
+				assert.NotNil(t, err)
+				assert.Empty(t, r.Header.Values("X-Scope-OrgID"))
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, r.Header.Values("X-Scope-OrgID"))
+		})
+	}
+}
@@ -2,8 +2,12 @@ package querymodifier
 
 import (
 	"fmt"
+	"path"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/VictoriaMetrics/metricsql"
 )
@@ -11,78 +15,366 @@ import (
 // RegexpSymbols is used to determine whether ACL definition is a regexp or whether LF contains a fake regexp
 const RegexpSymbols = `.+*?^$()[]{}|\`
 
+// DefaultLabel is the label that ACL definitions are applied to unless another label is specified explicitly
+const DefaultLabel = "namespace"
+
+// AllTenants is a tenant that gives access to all tenants
+const AllTenants = "*"
+
+// labelNameRe is used to validate label names in ACL definitions
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 // ACL stores a role definition
 type ACL struct {
-	Fullaccess  bool
-	LabelFilter metricsql.LabelFilter
-	RawACL      string
+	Fullaccess bool
+	// LabelFilters contains label filters for restricted labels (sorted by label name; a positive filter goes before a negative one), all of them are applied to a metric expression
+	LabelFilters []metricsql.LabelFilter
+	// RawACLs contains normalized rule definitions per label
+	RawACLs map[string]string
+	// Description and Owner are informational fields, which are set only for roles defined through a versioned acl.yaml
+	Description string
+	Owner       string
+	// AllowedEndpoints contains path patterns (path.Match syntax) the role is allowed to access, all paths are allowed if empty
+	AllowedEndpoints []string
+	// Tenants contains tenant IDs the role is allowed to access (e.g. accountID:projectID for VictoriaMetrics cluster), AllTenants allows any tenant. All tenants are allowed if empty, unless TenantsRestricted is set
+	Tenants []string
+	// TenantsRestricted is set for user ACLs if any role in acl.yaml declares tenants, then no tenant is allowed if Tenants is empty
+	TenantsRestricted bool
+	// EnableDeduplication and OptimizeExpressions override global settings unless nil
+	EnableDeduplication *bool
+	OptimizeExpressions *bool
+	// Expires is the time after which the role is no longer considered, zero value means the role never expires
+	Expires time.Time
 }
 
-// NewACL returns an ACL based on a rule definition (non-regexp for one namespace, regexp - for many). .RawACL in the resulting value will contain a normalized value (anchors stripped, implicit admin will have only .*).
+// NewACL returns an ACL based on a rule definition for the default label (non-regexp for one namespace, regexp - for many). .RawACLs in the resulting value will contain a normalized value (anchors stripped, implicit admin will have only .*).
 func NewACL(rawACL string) (ACL, error) {
-	lf := metricsql.LabelFilter{
-		Label:      "namespace",
-		IsNegative: false,
-		IsRegexp:   false,
+	return NewMultiLabelACL(map[string]string{DefaultLabel: rawACL})
+}
+
+// NewMultiLabelACL returns an ACL based on rule definitions for multiple labels (label name -> rule definition). Labels with full access (.*) are not restricted, so they're omitted from the resulting ACL. If none of the labels are restricted, then a fullaccess ACL is returned.
+func NewMultiLabelACL(rawACLs map[string]string) (ACL, error) {
+	if len(rawACLs) == 0 {
+		return ACL{}, fmt.Errorf("ACL has to contain at least one label")
+	}
+
+	labels := make([]string, 0, len(rawACLs))
+	for label := range rawACLs {
+		labels = append(labels, label)
+	}
+	// Stable order simplifies comparison of ACLs and makes the resulting expressions predictable
+	sort.Strings(labels)
+
+	acl := ACL{
+		Fullaccess:   false,
+		LabelFilters: make([]metricsql.LabelFilter, 0, len(labels)),
+		RawACLs:      make(map[string]string, len(labels)),
+	}
+
+	for _, label := range labels {
+		lfs, rawACL, err := newLabelFilters(label, rawACLs[label])
+		if err != nil {
+			return ACL{}, err
+		}
+
+		// The label is not restricted
+		if len(lfs) == 0 {
+			continue
+		}
+
+		acl.LabelFilters = append(acl.LabelFilters, lfs...)
+		acl.RawACLs[label] = rawACL
+	}
+
+	if len(acl.LabelFilters) == 0 {
+		return getFullaccessACL(), nil
+	}
+
+	return acl, nil
+}
+
+// newLabelFilters returns label filters for the specified label along with a normalized rule definition (anchors stripped, implicit admin will have only .*). Values prefixed with ! are exclusions, they're converted into a negative regexp filter (e.g. "!kube-system, !vault" -> namespace!~"kube-system|vault"). If a definition contains only exclusions, then all other values are allowed, so the normalized definition will contain .* as well.
+func newLabelFilters(label string, rawACL string) ([]metricsql.LabelFilter, string, error) {
+	if !labelNameRe.MatchString(label) {
+		return nil, "", fmt.Errorf("incorrect label name %q", label)
 	}
 
 	buffer, err := toSlice(rawACL)
 	if err != nil {
-		return ACL{}, err
+		return nil, "", err
 	}
 
-	// If .* is in the slice, then we can omit any other value
+	grants := []string{}
+	exclusions := []string{}
+	seenExclusions := make(map[string]struct{})
 	for _, v := range buffer {
+		if !strings.HasPrefix(v, "!") {
+			grants = append(grants, v)
+			continue
+		}
+		// The same value might be excluded by a role and by a global deny rule
+		if _, ok := seenExclusions[v]; !ok {
+			seenExclusions[v] = struct{}{}
+			exclusions = append(exclusions, v)
+		}
+	}
+
+	filters := make([]metricsql.LabelFilter, 0, 2)
+	normalized := make([]string, 0, len(buffer))
+
+	if len(grants) == 0 {
+		grants = []string{".*"}
+	}
+
+	lf, err := newPositiveLabelFilter(label, grants, rawACL)
+	if err != nil {
+		return nil, "", err
+	}
+	if lf.Value == ".*" {
+		normalized = append(normalized, ".*")
+	} else {
+		filters = append(filters, lf)
+		normalized = append(normalized, grants...)
+	}
+
+	if len(exclusions) > 0 {
+		lf, err := newNegativeLabelFilter(label, exclusions, rawACL)
+		if err != nil {
+			return nil, "", err
+		}
+		filters = append(filters, lf)
+		for _, v := range exclusions {
+			normalized = append(normalized, "!"+strings.TrimPrefix(v, "!"))
+		}
+	}
+
+	return filters, strings.Join(normalized, ", "), nil
+}
+
+// newPositiveLabelFilter returns a label filter matching any of the specified values (non-regexp for one value, regexp - for many). If .* is amongst the values, then a full access filter (.*) is returned. Values are normalized in place (anchors stripped).
+func newPositiveLabelFilter(label string, values []string, rawACL string) (metricsql.LabelFilter, error) {
+	lf := metricsql.LabelFilter{
+		Label:      label,
+		IsNegative: false,
+		IsRegexp:   false,
+	}
+
+	// If .* is in the slice, then we can omit any other value
+	for _, v := range values {
 		// TODO: move to a helper?
 		if v == ".*" {
 			// Note: with this approach, we intentionally omit other values in the resulting ACL
-			return getFullaccessACL(), nil
+			lf.Value = ".*"
+			lf.IsRegexp = true
+			return lf, nil
 		}
 	}
 
-	if len(buffer) == 1 {
+	if len(values) == 1 {
 		// TODO: move to a helper?
-		if strings.ContainsAny(buffer[0], RegexpSymbols) {
+		if strings.ContainsAny(values[0], RegexpSymbols) {
 			lf.IsRegexp = true
-			// Trim anchors as they're not needed for Prometheus, and not expected in the app.shouldBeModified function
-			buffer[0] = strings.TrimLeft(buffer[0], "^")
-			buffer[0] = strings.TrimLeft(buffer[0], "(")
-			buffer[0] = strings.TrimRight(buffer[0], "$")
-			buffer[0] = strings.TrimRight(buffer[0], ")")
+			values[0] = trimAnchors(values[0])
 		}
-		lf.Value = buffer[0]
+		lf.Value = values[0]
 	} else {
 		// "Regex matches are fully anchored. A match of env=~"foo" is treated as env=~"^foo$"." https://prometheus.io/docs/prometheus/latest/querying/basics/
-		lf.Value = strings.Join(buffer, "|")
+		lf.Value = strings.Join(values, "|")
 		lf.IsRegexp = true
 	}
 
 	if lf.IsRegexp {
 		_, err := regexp.Compile(lf.Value)
 		if err != nil {
-			return ACL{}, fmt.Errorf("%s in %q (converted from %q)", err, lf.Value, rawACL)
+			return metricsql.LabelFilter{}, fmt.Errorf("%s in %q (converted from %q)", err, lf.Value, rawACL)
 		}
 	}
 
-	acl := ACL{
-		Fullaccess:  false,
-		LabelFilter: lf,
-		RawACL:      strings.Join(buffer, ", "),
+	return lf, nil
+}
+
+// newNegativeLabelFilter returns a negative regexp label filter excluding all specified values (with or without the ! prefix). Values are normalized in place (prefix and anchors stripped). A negative regexp is used even for one value, so that it's merged with other negative filters instead of replacing them.
+func newNegativeLabelFilter(label string, values []string, rawACL string) (metricsql.LabelFilter, error) {
+	for i, v := range values {
+		v = trimAnchors(strings.TrimPrefix(v, "!"))
+		if v == "" || v == ".*" {
+			return metricsql.LabelFilter{}, fmt.Errorf("exclusion %q denies everything (%q)", values[i], rawACL)
+		}
+		values[i] = v
 	}
 
-	return acl, nil
+	lf := metricsql.LabelFilter{
+		Label:      label,
+		Value:      strings.Join(values, "|"),
+		IsNegative: true,
+		IsRegexp:   true,
+	}
+
+	_, err := regexp.Compile(lf.Value)
+	if err != nil {
+		return metricsql.LabelFilter{}, fmt.Errorf("%s in %q (converted from %q)", err, lf.Value, rawACL)
+	}
+
+	return lf, nil
+}
+
+// trimAnchors trims anchors as they're not needed for Prometheus, and not expected in the app.shouldBeModified function
+func trimAnchors(s string) string {
+	s = strings.TrimLeft(s, "^")
+	s = strings.TrimLeft(s, "(")
+	s = strings.TrimRight(s, "$")
+	s = strings.TrimRight(s, ")")
+	return s
+}
+
+// LabelFiltersString returns label filters of the ACL as a comma-separated string, e.g. `cluster=~"eu-.*", namespace="minio"`.
+func (a ACL) LabelFiltersString() string {
+	var dst []byte
+	for i, lf := range a.LabelFilters {
+		if i > 0 {
+			dst = append(dst, ", "...)
+		}
+		dst = lf.AppendString(dst)
+	}
+	return string(dst)
+}
+
+// ExtraFilter returns label filters of the ACL as a series selector, which can be passed to VictoriaMetrics through extra_filters[], e.g. `{cluster=~"eu-.*", namespace="minio"}`.
+func (a ACL) ExtraFilter() string {
+	return "{" + a.LabelFiltersString() + "}"
+}
+
+// AllowsAllTenants returns true if the ACL doesn't restrict tenants.
+func (a ACL) AllowsAllTenants() bool {
+	if len(a.Tenants) == 0 {
+		return !a.TenantsRestricted
+	}
+
+	return slices.Contains(a.Tenants, AllTenants)
+}
+
+// IsExpired returns true if the ACL has an expiration time and it has already passed.
+func (a ACL) IsExpired(now time.Time) bool {
+	return !a.Expires.IsZero() && !now.Before(a.Expires)
+}
+
+// IsEndpointAllowed returns true if the ACL does not restrict endpoints or if the path matches one of the allowed endpoints.
+func (a ACL) IsEndpointAllowed(p string) bool {
+	if len(a.AllowedEndpoints) == 0 {
+		return true
+	}
+
+	for _, pattern := range a.AllowedEndpoints {
+		// Patterns are validated while loading ACLs, so errors are not expected here
+		if ok, err := path.Match(pattern, p); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsConfined returns true if all series matching the label filters (e.g. matchers of an Alertmanager silence) are allowed by the ACL. For each label restricted by the ACL, at least one of the filters has to be either an equality with an allowed value or a positive regexp listing only allowed values (e.g. "minio|stolon"). Other filters can only narrow down the matched series, so they're not considered.
+func (a ACL) IsConfined(filters []metricsql.LabelFilter) bool {
+	if a.Fullaccess {
+		return true
+	}
+
+	aclFilters := make(map[string][]metricsql.LabelFilter, len(a.LabelFilters))
+	for _, lf := range a.LabelFilters {
+		aclFilters[lf.Label] = append(aclFilters[lf.Label], lf)
+	}
+
+	for label, lfs := range aclFilters {
+		confined := false
+		for _, f := range filters {
+			if f.Label == label && !f.IsNegative && isConfinedFilter(lfs, f) {
+				confined = true
+				break
+			}
+		}
+
+		if !confined {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsApplied returns true if the label filters (e.g. of a rewritten match[] selector) are limited by the ACL: either all label filters of the ACL are present amongst them, or they're confined to the ACL (see IsConfined).
+func (a ACL) IsApplied(filters []metricsql.LabelFilter) bool {
+	if a.IsConfined(filters) {
+		return true
+	}
+
+	for _, lf := range a.LabelFilters {
+		present := false
+		for _, f := range filters {
+			if f == lf {
+				present = true
+				break
+			}
+		}
+
+		if !present {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isConfinedFilter returns true if all values matched by the positive filter are allowed by the label filters of an ACL.
+func isConfinedFilter(lfs []metricsql.LabelFilter, f metricsql.LabelFilter) bool {
+	values := []string{f.Value}
+	if f.IsRegexp {
+		values = strings.Split(f.Value, "|")
+	}
+
+	for _, v := range values {
+		if f.IsRegexp && strings.ContainsAny(v, RegexpSymbols) {
+			return false
+		}
+		if !matchesLabelFilters(lfs, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// QueryModifier returns a QueryModifier for the ACL. Per-role settings, if any, take precedence over the supplied global settings.
+func (a ACL) QueryModifier(enableDeduplication bool, optimizeExpressions bool) QueryModifier {
+	if a.EnableDeduplication != nil {
+		enableDeduplication = *a.EnableDeduplication
+	}
+
+	if a.OptimizeExpressions != nil {
+		optimizeExpressions = *a.OptimizeExpressions
+	}
+
+	return QueryModifier{
+		ACL:                 a,
+		EnableDeduplication: enableDeduplication,
+		OptimizeExpressions: optimizeExpressions,
+	}
 }
 
 // getFullaccessACL returns a fullaccess ACL
 func getFullaccessACL() ACL {
 	return ACL{
 		Fullaccess: true,
-		LabelFilter: metricsql.LabelFilter{
-			Label:      "namespace",
-			Value:      ".*",
-			IsRegexp:   true,
-			IsNegative: false,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      DefaultLabel,
+				Value:      ".*",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+		},
+		RawACLs: map[string]string{
+			DefaultLabel: ".*",
 		},
-		RawACL: ".*",
 	}
 }
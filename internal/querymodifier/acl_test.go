@@ -2,6 +2,7 @@ package querymodifier
 
 import (
 	"testing"
+	"time"
 
 	"github.com/VictoriaMetrics/metricsql"
 	"github.com/stretchr/testify/assert"
@@ -19,13 +20,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: ".*",
 			want: ACL{
 				Fullaccess: true,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      ".*",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      ".*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: ".*",
+				RawACLs: map[string]string{"namespace": ".*"},
 			},
 			fail: false,
 		},
@@ -34,13 +37,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "min.*, .*, stolon",
 			want: ACL{
 				Fullaccess: true,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      ".*",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      ".*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: ".*",
+				RawACLs: map[string]string{"namespace": ".*"},
 			},
 			fail: false,
 		},
@@ -49,13 +54,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "minio",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "minio",
-					IsRegexp:   false,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "minio",
+						IsRegexp:   false,
+						IsNegative: false,
+					},
 				},
-				RawACL: "minio",
+				RawACLs: map[string]string{"namespace": "minio"},
 			},
 			fail: false,
 		},
@@ -64,13 +71,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "min.*",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "min.*",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "min.*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: "min.*",
+				RawACLs: map[string]string{"namespace": "min.*"},
 			},
 			fail: false,
 		},
@@ -79,13 +88,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "^(min.*)$",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "min.*",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "min.*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: "min.*",
+				RawACLs: map[string]string{"namespace": "min.*"},
 			},
 			fail: false,
 		},
@@ -94,13 +105,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "minio, stolon",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "minio|stolon",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "minio|stolon",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: "minio, stolon",
+				RawACLs: map[string]string{"namespace": "minio, stolon"},
 			},
 			fail: false,
 		},
@@ -109,13 +122,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "min.*, stolon",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "min.*|stolon",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "min.*|stolon",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: "min.*, stolon",
+				RawACLs: map[string]string{"namespace": "min.*, stolon"},
 			},
 			fail: false,
 		},
@@ -125,13 +140,15 @@ func Test_NewACL(t *testing.T) {
 			rawACL: ".+",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      ".+",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      ".+",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: ".+",
+				RawACLs: map[string]string{"namespace": ".+"},
 			},
 			fail: false,
 		},
@@ -140,16 +157,93 @@ func Test_NewACL(t *testing.T) {
 			rawACL: "a,b",
 			want: ACL{
 				Fullaccess: false,
-				LabelFilter: metricsql.LabelFilter{
-					Label:      "namespace",
-					Value:      "a|b",
-					IsRegexp:   true,
-					IsNegative: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "a|b",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
 				},
-				RawACL: "a, b",
+				RawACLs: map[string]string{"namespace": "a, b"},
 			},
 			fail: false,
 		},
+		{
+			name:   "!kube-system, !vault (everything except kube-system and vault)",
+			rawACL: "!kube-system, !vault",
+			want: ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "kube-system|vault",
+						IsRegexp:   true,
+						IsNegative: true,
+					},
+				},
+				RawACLs: map[string]string{"namespace": ".*, !kube-system, !vault"},
+			},
+			fail: false,
+		},
+		{
+			name:   "team-.*, !^(team-secret)$ (grants and exclusions)",
+			rawACL: "team-.*, !^(team-secret)$",
+			want: ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "team-.*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
+					{
+						Label:      "namespace",
+						Value:      "team-secret",
+						IsRegexp:   true,
+						IsNegative: true,
+					},
+				},
+				RawACLs: map[string]string{"namespace": "team-.*, !team-secret"},
+			},
+			fail: false,
+		},
+		{
+			name:   ".*, !vault (full access minus exclusions is not full access)",
+			rawACL: ".*, !vault",
+			want: ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "namespace",
+						Value:      "vault",
+						IsRegexp:   true,
+						IsNegative: true,
+					},
+				},
+				RawACLs: map[string]string{"namespace": ".*, !vault"},
+			},
+			fail: false,
+		},
+		{
+			name:   "!.* (denies everything)",
+			rawACL: "!.*",
+			want:   ACL{},
+			fail:   true,
+		},
+		{
+			name:   "! (empty exclusion)",
+			rawACL: "minio, !",
+			want:   ACL{},
+			fail:   true,
+		},
+		{
+			name:   "!( (incorrect regexp in exclusion)",
+			rawACL: "!(",
+			want:   ACL{},
+			fail:   true,
+		},
 		{
 			name:   "[ (incorrect regexp)",
 			rawACL: "[",
@@ -169,3 +263,292 @@ func Test_NewACL(t *testing.T) {
 		})
 	}
 }
+
+func Test_NewMultiLabelACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACLs map[string]string
+		want    ACL
+		fail    bool
+	}{
+		{
+			name:    "cluster and namespace",
+			rawACLs: map[string]string{"namespace": "team-a, team-b", "cluster": "eu-.*"},
+			want: ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "cluster",
+						Value:      "eu-.*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
+					{
+						Label:      "namespace",
+						Value:      "team-a|team-b",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
+				},
+				RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-a, team-b"},
+			},
+			fail: false,
+		},
+		{
+			name:    "one of the labels is not restricted",
+			rawACLs: map[string]string{"namespace": ".*", "tenant": "acme"},
+			want: ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "tenant",
+						Value:      "acme",
+						IsRegexp:   false,
+						IsNegative: false,
+					},
+				},
+				RawACLs: map[string]string{"tenant": "acme"},
+			},
+			fail: false,
+		},
+		{
+			name:    "none of the labels are restricted (full access)",
+			rawACLs: map[string]string{"namespace": ".*", "env": "prod, .*"},
+			want:    getFullaccessACL(),
+			fail:    false,
+		},
+		{
+			name:    "no labels",
+			rawACLs: map[string]string{},
+			want:    ACL{},
+			fail:    true,
+		},
+		{
+			name:    "incorrect label name",
+			rawACLs: map[string]string{"cluster-name": "eu"},
+			want:    ACL{},
+			fail:    true,
+		},
+		{
+			name:    "incorrect regexp for one of the labels",
+			rawACLs: map[string]string{"namespace": "minio", "cluster": "["},
+			want:    ACL{},
+			fail:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMultiLabelACL(tt.rawACLs)
+			if tt.fail {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestACL_LabelFiltersString(t *testing.T) {
+	acl, err := NewMultiLabelACL(map[string]string{"namespace": "minio", "cluster": "eu-.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `cluster=~"eu-.*", namespace="minio"`
+	got := acl.LabelFiltersString()
+	assert.Equal(t, want, got)
+}
+
+func TestACL_ExtraFilter(t *testing.T) {
+	acl, err := NewMultiLabelACL(map[string]string{"namespace": "minio", "cluster": "eu-.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{cluster=~"eu-.*", namespace="minio"}`
+	got := acl.ExtraFilter()
+	assert.Equal(t, want, got)
+}
+
+func TestACL_IsExpired(t *testing.T) {
+	now := time.Now()
+
+	assert.False(t, ACL{}.IsExpired(now), "ACL without expiration time never expires")
+	assert.False(t, ACL{Expires: now.Add(time.Hour)}.IsExpired(now))
+	assert.True(t, ACL{Expires: now}.IsExpired(now))
+	assert.True(t, ACL{Expires: now.Add(-time.Hour)}.IsExpired(now))
+}
+
+func TestACL_IsEndpointAllowed(t *testing.T) {
+	t.Run("No restrictions", func(t *testing.T) {
+		acl := ACL{}
+		assert.True(t, acl.IsEndpointAllowed("/api/v1/query"))
+		assert.True(t, acl.IsEndpointAllowed("/federate"))
+	})
+
+	t.Run("Restricted endpoints", func(t *testing.T) {
+		acl := ACL{
+			AllowedEndpoints: []string{"/api/v1/query", "/api/v1/label/*/values"},
+		}
+		assert.True(t, acl.IsEndpointAllowed("/api/v1/query"))
+		assert.True(t, acl.IsEndpointAllowed("/api/v1/label/namespace/values"))
+		assert.False(t, acl.IsEndpointAllowed("/api/v1/query_range"))
+		assert.False(t, acl.IsEndpointAllowed("/federate"))
+	})
+}
+
+func TestACL_IsConfined(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACLs map[string]string
+		filters []metricsql.LabelFilter
+		want    bool
+	}{
+		{
+			name:    "Full access",
+			rawACLs: map[string]string{"namespace": ".*"},
+			filters: []metricsql.LabelFilter{},
+			want:    true,
+		},
+		{
+			name:    "Equality with an allowed value",
+			rawACLs: map[string]string{"namespace": "minio, stolon"},
+			filters: []metricsql.LabelFilter{
+				{Label: "alertname", Value: "Watchdog"},
+				{Label: "namespace", Value: "minio"},
+			},
+			want: true,
+		},
+		{
+			name:    "Equality with a value matching an ACL regexp",
+			rawACLs: map[string]string{"namespace": "min.*"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "minio"}},
+			want:    true,
+		},
+		{
+			name:    "Equality with another value",
+			rawACLs: map[string]string{"namespace": "minio"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "stolon"}},
+			want:    false,
+		},
+		{
+			name:    "Missing label",
+			rawACLs: map[string]string{"namespace": "minio"},
+			filters: []metricsql.LabelFilter{{Label: "alertname", Value: "Watchdog"}},
+			want:    false,
+		},
+		{
+			name:    "Negative filter doesn't confine",
+			rawACLs: map[string]string{"namespace": "minio"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "stolon", IsNegative: true}},
+			want:    false,
+		},
+		{
+			name:    "Regexp listing allowed values",
+			rawACLs: map[string]string{"namespace": "minio, stolon"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "minio|stolon", IsRegexp: true}},
+			want:    true,
+		},
+		{
+			name:    "Regexp with special symbols",
+			rawACLs: map[string]string{"namespace": "minio, stolon"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "min.*", IsRegexp: true}},
+			want:    false,
+		},
+		{
+			name:    "Excluded value",
+			rawACLs: map[string]string{"namespace": "!kube-system"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "kube-system"}},
+			want:    false,
+		},
+		{
+			name:    "All labels have to be confined",
+			rawACLs: map[string]string{"namespace": "minio", "cluster": "eu-.*"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "minio"}},
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewMultiLabelACL(tt.rawACLs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.want, acl.IsConfined(tt.filters))
+		})
+	}
+}
+
+func TestACL_IsApplied(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACLs map[string]string
+		filters []metricsql.LabelFilter
+		want    bool
+	}{
+		{
+			name:    "Filter of the ACL",
+			rawACLs: map[string]string{"namespace": "min.*"},
+			filters: []metricsql.LabelFilter{
+				{Label: "__name__", Value: "up"},
+				{Label: "namespace", Value: "min.*", IsRegexp: true},
+			},
+			want: true,
+		},
+		{
+			name:    "Confined filters",
+			rawACLs: map[string]string{"namespace": "minio, stolon"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "minio"}},
+			want:    true,
+		},
+		{
+			name:    "Another regexp",
+			rawACLs: map[string]string{"namespace": "min.*"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "m.*", IsRegexp: true}},
+			want:    false,
+		},
+		{
+			name:    "All filters of the ACL have to be present",
+			rawACLs: map[string]string{"namespace": "min.*", "cluster": "eu-.*"},
+			filters: []metricsql.LabelFilter{{Label: "namespace", Value: "min.*", IsRegexp: true}},
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewMultiLabelACL(tt.rawACLs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.want, acl.IsApplied(tt.filters))
+		})
+	}
+}
+
+func TestACL_QueryModifier(t *testing.T) {
+	enabled := true
+	disabled := false
+
+	t.Run("Global settings", func(t *testing.T) {
+		acl := ACL{}
+		qm := acl.QueryModifier(true, false)
+		assert.True(t, qm.EnableDeduplication)
+		assert.False(t, qm.OptimizeExpressions)
+	})
+
+	t.Run("Per-role settings take precedence", func(t *testing.T) {
+		acl := ACL{
+			EnableDeduplication: &disabled,
+			OptimizeExpressions: &enabled,
+		}
+		qm := acl.QueryModifier(true, false)
+		assert.False(t, qm.EnableDeduplication)
+		assert.True(t, qm.OptimizeExpressions)
+		assert.Equal(t, acl, qm.ACL)
+	})
+}
@@ -0,0 +1,334 @@
+package querymodifier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ACLFileVersion is the version of the structured acl.yaml format
+const ACLFileVersion = 2
+
+// aclFile describes a versioned acl.yaml, where each role is defined by an object
+type aclFile struct {
+	Version int                       `yaml:"version"`
+	Deny    map[string]string         `yaml:"deny"`
+	Roles   map[string]roleDefinition `yaml:"roles"`
+}
+
+// roleDefinition describes a role in a versioned acl.yaml
+type roleDefinition struct {
+	Description         string            `yaml:"description"`
+	Owner               string            `yaml:"owner"`
+	Labels              map[string]string `yaml:"labels"`
+	Endpoints           []string          `yaml:"endpoints"`
+	Tenants             []string          `yaml:"tenants"`
+	EnableDeduplication *bool             `yaml:"enable_deduplication"`
+	OptimizeExpressions *bool             `yaml:"optimize_expressions"`
+	Expires             *time.Time        `yaml:"expires"`
+}
+
+// RoleError describes an invalid role definition in acl.yaml.
+type RoleError struct {
+	Role string
+	Line int
+	Err  error
+}
+
+// newRoleError returns a RoleError for the role defined at the line.
+func newRoleError(role string, line int, err error) *RoleError {
+	return &RoleError{
+		Role: role,
+		Line: line,
+		Err:  err,
+	}
+}
+
+// Error implements the error interface.
+func (e *RoleError) Error() string {
+	return fmt.Sprintf("%s role (line %d): %s", e.Role, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RoleError) Unwrap() error {
+	return e.Err
+}
+
+// NewACLsFromYAML parses the content of acl.yaml. Both the versioned format (version: 2) and the flat one (role: namespace, namespace2) are supported, the latter is converted into the same ACL structures with default per-role settings.
+func NewACLsFromYAML(content []byte) (ACLs, error) {
+	var doc yaml.Node
+
+	err := yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return ACLs{}, err
+	}
+
+	// An empty file
+	if len(doc.Content) == 0 {
+		return NewACLs(make(map[string]ACL)), nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return ACLs{}, fmt.Errorf("acl.yaml has to contain a mapping of roles (line %d)", root.Line)
+	}
+
+	if isVersionedACLFile(root) {
+		return newACLsFromVersionedYAML(content, root)
+	}
+
+	return newACLsFromFlatYAML(root)
+}
+
+// aclFileKeys contains top-level keys of a versioned acl.yaml (see aclFile)
+var aclFileKeys = map[string]struct{}{"version": {}, "deny": {}, "roles": {}}
+
+// isVersionedACLFile returns true if the top-level mapping contains an integer version and no keys other than those of a versioned acl.yaml. Otherwise, a flat file with a role named version would be treated as a versioned one.
+func isVersionedACLFile(root *yaml.Node) bool {
+	version := mappingValue(root, "version")
+	if version == nil || version.Kind != yaml.ScalarNode || version.ShortTag() != "!!int" {
+		return false
+	}
+
+	for _, key := range mappingKeys(root) {
+		if _, ok := aclFileKeys[key.Value]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mappingValue returns the value node for the key or nil if the mapping doesn't contain the key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// mappingKeys returns key nodes of the mapping node in the order they're defined, nil is returned for other kinds of nodes.
+func mappingKeys(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	keys := make([]*yaml.Node, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i])
+	}
+
+	return keys
+}
+
+// newACLsFromFlatYAML returns ACLs based on a flat acl.yaml, where each role is defined either by a string or by a mapping of labels to rules. All invalid role definitions are reported (see RoleError).
+func newACLsFromFlatYAML(root *yaml.Node) (ACLs, error) {
+	acls := NewACLs(make(map[string]ACL, len(root.Content)/2))
+	errs := []error{}
+	seen := make(map[string]int)
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		role := key.Value
+
+		// Decoding into a map would catch duplicates, though it also loses the order of keys
+		if line, ok := seen[role]; ok {
+			errs = append(errs, newRoleError(role, key.Line, fmt.Errorf("role is already defined at line %d", line)))
+			continue
+		}
+		seen[role] = key.Line
+
+		rawACLs, err := rawACLsFromYAMLNode(*node)
+		if err != nil {
+			errs = append(errs, newRoleError(role, key.Line, err))
+			continue
+		}
+
+		if isRolePattern(role) {
+			p, err := NewRolePattern(role, rawACLs)
+			if err != nil {
+				errs = append(errs, newRoleError(role, key.Line, err))
+				continue
+			}
+			acls.Patterns = append(acls.Patterns, p)
+			continue
+		}
+
+		acl, err := NewMultiLabelACL(rawACLs)
+		if err != nil {
+			errs = append(errs, newRoleError(role, key.Line, err))
+			continue
+		}
+
+		acls.Roles[role] = acl
+	}
+
+	if len(errs) > 0 {
+		return ACLs{}, errors.Join(errs...)
+	}
+
+	return acls, nil
+}
+
+// rawACLsFromYAMLNode returns rules per label based on a role definition from a flat acl.yaml. A definition is either a string with rules for the default label (e.g. "minio, stolon") or a mapping of label names to rules (e.g. {cluster: "eu-.*", namespace: "minio, stolon"}).
+func rawACLsFromYAMLNode(node yaml.Node) (map[string]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var rawACL string
+		if err := node.Decode(&rawACL); err != nil {
+			return nil, err
+		}
+		return map[string]string{DefaultLabel: rawACL}, nil
+	case yaml.MappingNode:
+		var rawACLs map[string]string
+		if err := node.Decode(&rawACLs); err != nil {
+			return nil, err
+		}
+		return rawACLs, nil
+	default:
+		return nil, fmt.Errorf("role definition has to be either a string or a mapping of labels to rules")
+	}
+}
+
+// newACLsFromVersionedYAML returns ACLs based on a versioned acl.yaml. Unknown fields are treated as errors to catch typos in role definitions.
+func newACLsFromVersionedYAML(content []byte, root *yaml.Node) (ACLs, error) {
+	var f aclFile
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	errs := []error{}
+
+	err := decoder.Decode(&f)
+	if err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return ACLs{}, err
+		}
+
+		// Report each unknown field / type mismatch separately and carry on with the other checks, so that all errors are reported at once
+		for _, e := range typeErr.Errors {
+			errs = append(errs, errors.New(e))
+		}
+	}
+
+	if f.Version != ACLFileVersion {
+		return ACLs{}, fmt.Errorf("unsupported acl.yaml version %d (supported: %d)", f.Version, ACLFileVersion)
+	}
+
+	acls := NewACLs(make(map[string]ACL, len(f.Roles)))
+
+	for _, key := range mappingKeys(mappingValue(root, "roles")) {
+		role := key.Value
+		def := f.Roles[role]
+
+		err := def.validate()
+		if err != nil {
+			errs = append(errs, newRoleError(role, key.Line, err))
+			continue
+		}
+
+		if isRolePattern(role) {
+			p, err := NewRolePattern(role, def.Labels)
+			if err != nil {
+				errs = append(errs, newRoleError(role, key.Line, err))
+				continue
+			}
+			p.Template = def.applyOptions(p.Template)
+			acls.Patterns = append(acls.Patterns, p)
+			continue
+		}
+
+		acl, err := NewMultiLabelACL(def.Labels)
+		if err != nil {
+			errs = append(errs, newRoleError(role, key.Line, err))
+			continue
+		}
+
+		acls.Roles[role] = def.applyOptions(acl)
+	}
+
+	err = validateDeny(f.Deny)
+	if err != nil {
+		line := 0
+		if deny := mappingValue(root, "deny"); deny != nil {
+			line = deny.Line
+		}
+		errs = append(errs, fmt.Errorf("deny (line %d): %w", line, err))
+	}
+
+	if len(errs) > 0 {
+		return ACLs{}, errors.Join(errs...)
+	}
+
+	if len(f.Deny) > 0 {
+		acls.Deny = f.Deny
+	}
+
+	return acls, nil
+}
+
+// validateDeny checks that global deny rules can be converted into label filters.
+func validateDeny(deny map[string]string) error {
+	for label, rawDeny := range deny {
+		denied, err := toSlice(rawDeny)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range denied {
+			denied[i] = "!" + strings.TrimPrefix(v, "!")
+		}
+
+		_, _, err = newLabelFilters(label, strings.Join(denied, ", "))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks the role definition for errors, which are not caught while building label filters.
+func (d roleDefinition) validate() error {
+	if len(d.Labels) == 0 {
+		return fmt.Errorf("labels cannot be empty, use {%s: .*} to give full access", DefaultLabel)
+	}
+
+	for _, e := range d.Endpoints {
+		if _, err := path.Match(e, ""); err != nil {
+			return fmt.Errorf("incorrect endpoint pattern %q: %w", e, err)
+		}
+	}
+
+	for _, t := range d.Tenants {
+		if t == "" || strings.ContainsAny(t, "/|") {
+			return fmt.Errorf("incorrect tenant %q, it cannot be empty or contain / and |", t)
+		}
+	}
+
+	return nil
+}
+
+// applyOptions returns the acl with per-role settings from the role definition.
+func (d roleDefinition) applyOptions(acl ACL) ACL {
+	acl.Description = d.Description
+	acl.Owner = d.Owner
+	acl.AllowedEndpoints = d.Endpoints
+	acl.Tenants = d.Tenants
+	acl.EnableDeduplication = d.EnableDeduplication
+	acl.OptimizeExpressions = d.OptimizeExpressions
+	if d.Expires != nil {
+		acl.Expires = *d.Expires
+	}
+
+	return acl
+}
@@ -0,0 +1,252 @@
+package querymodifier
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewACLsFromYAML(t *testing.T) {
+	disabled := false
+
+	t.Run("Versioned format", func(t *testing.T) {
+		content := `version: 2
+roles:
+  team-a:
+    description: Team A developers
+    owner: team-a@localhost
+    labels:
+      cluster: eu-.*
+      namespace: team-a, team-b
+    endpoints:
+      - /api/v1/query
+      - /api/v1/query_range
+    tenants:
+      - "1:0"
+    enable_deduplication: false
+    optimize_expressions: false
+    expires: 2030-01-01
+  admin:
+    labels:
+      namespace: .*
+`
+		want := NewACLs(map[string]ACL{
+			"team-a": ACL{
+				Fullaccess: false,
+				LabelFilters: []metricsql.LabelFilter{
+					{
+						Label:      "cluster",
+						Value:      "eu-.*",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
+					{
+						Label:      "namespace",
+						Value:      "team-a|team-b",
+						IsRegexp:   true,
+						IsNegative: false,
+					},
+				},
+				RawACLs:             map[string]string{"cluster": "eu-.*", "namespace": "team-a, team-b"},
+				Description:         "Team A developers",
+				Owner:               "team-a@localhost",
+				AllowedEndpoints:    []string{"/api/v1/query", "/api/v1/query_range"},
+				Tenants:             []string{"1:0"},
+				EnableDeduplication: &disabled,
+				OptimizeExpressions: &disabled,
+				Expires:             time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			"admin": getFullaccessACL(),
+		})
+
+		got, err := NewACLsFromYAML([]byte(content))
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Flat format is converted into the same structures", func(t *testing.T) {
+		flat := `team-a: team-a, team-b`
+		versioned := `version: 2
+roles:
+  team-a:
+    labels:
+      namespace: team-a, team-b
+`
+		want, err := NewACLsFromYAML([]byte(versioned))
+		assert.Nil(t, err)
+
+		got, err := NewACLsFromYAML([]byte(flat))
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Global deny rules", func(t *testing.T) {
+		content := `version: 2
+deny:
+  namespace: kube-system, vault
+roles:
+  admin:
+    labels:
+      namespace: .*
+`
+		want := NewACLs(map[string]ACL{"admin": getFullaccessACL()})
+		want.Deny = map[string]string{"namespace": "kube-system, vault"}
+
+		got, err := NewACLsFromYAML([]byte(content))
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Role patterns", func(t *testing.T) {
+		disabled := false
+		flat := `team-(.+)-viewer: $1-prod, $1-stage
+grafana-admin: .*
+"(.+)-(dev|prod)":
+  namespace: $1
+  env: $2
+`
+		versioned := `version: 2
+roles:
+  team-(.+)-viewer:
+    labels:
+      namespace: $1-prod, $1-stage
+    enable_deduplication: false
+`
+		got, err := NewACLsFromYAML([]byte(flat))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"grafana-admin"}, mapKeys(got.Roles))
+		assert.Equal(t, 2, len(got.Patterns))
+		// In the order they're defined
+		assert.Equal(t, "team-(.+)-viewer", got.Patterns[0].Name)
+		assert.Equal(t, "(.+)-(dev|prod)", got.Patterns[1].Name)
+		assert.Equal(t, map[string]string{"namespace": "$1", "env": "$2"}, got.Patterns[1].RawACLs)
+
+		got, err = NewACLsFromYAML([]byte(versioned))
+		assert.Nil(t, err)
+		assert.Empty(t, got.Roles)
+		assert.Equal(t, 1, len(got.Patterns))
+		assert.Equal(t, &disabled, got.Patterns[0].Template.EnableDeduplication)
+	})
+
+	t.Run("All invalid roles are reported", func(t *testing.T) {
+		flat := `minio: minio
+broken1: "["
+broken2: a b
+minio: stolon
+`
+		_, err := NewACLsFromYAML([]byte(flat))
+		assert.NotNil(t, err)
+
+		var roleErr *RoleError
+		assert.ErrorAs(t, err, &roleErr)
+		assert.Equal(t, "broken1", roleErr.Role)
+		assert.Equal(t, 2, roleErr.Line)
+
+		errs := err.(interface{ Unwrap() []error }).Unwrap()
+		assert.Equal(t, 3, len(errs))
+		assert.Contains(t, errs[1].Error(), "broken2 role (line 3)")
+		assert.Contains(t, errs[2].Error(), "minio role (line 4): role is already defined at line 1")
+
+		versioned := `version: 2
+roles:
+  broken:
+    labels:
+      namespace: "["
+  typo:
+    lables:
+      namespace: minio
+`
+		_, err = NewACLsFromYAML([]byte(versioned))
+		assert.NotNil(t, err)
+
+		errs = err.(interface{ Unwrap() []error }).Unwrap()
+		assert.Equal(t, 3, len(errs))
+		assert.Contains(t, errs[0].Error(), "line 7: field lables not found")
+		assert.Contains(t, errs[1].Error(), "broken role (line 3)")
+		assert.Contains(t, errs[2].Error(), "typo role (line 6)")
+	})
+
+	t.Run("Flat file with a role named version", func(t *testing.T) {
+		for _, content := range []string{"version: minio\nteam-a: stolon", "version: 2\nteam-a: stolon"} {
+			got, err := NewACLsFromYAML([]byte(content))
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"team-a", "version"}, mapKeys(got.Roles), content)
+		}
+	})
+
+	t.Run("Empty content", func(t *testing.T) {
+		got, err := NewACLsFromYAML([]byte(""))
+		assert.Nil(t, err)
+		assert.Equal(t, NewACLs(map[string]ACL{}), got)
+	})
+
+	incorrect := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "Not a mapping",
+			content: "- a\n- b",
+		},
+		{
+			name:    "Unsupported version",
+			content: "version: 3\nroles: {}",
+		},
+		{
+			name:    "Unknown field",
+			content: "version: 2\nroles:\n  team-a:\n    label:\n      namespace: team-a",
+		},
+		{
+			name:    "No labels",
+			content: "version: 2\nroles:\n  team-a:\n    description: test",
+		},
+		{
+			name:    "Incorrect endpoint pattern",
+			content: "version: 2\nroles:\n  team-a:\n    labels:\n      namespace: team-a\n    endpoints: ['/api/v1/[']",
+		},
+		{
+			name:    "Incorrect tenant",
+			content: "version: 2\nroles:\n  team-a:\n    labels:\n      namespace: team-a\n    tenants: ['1|2']",
+		},
+		{
+			name:    "Incorrect role pattern",
+			content: "team-(.+: $1",
+		},
+		{
+			name:    "Incorrect rules in a role pattern",
+			content: "version: 2\nroles:\n  team-(.+):\n    labels:\n      namespace: $1-[",
+		},
+		{
+			name:    "Deny rule denies everything",
+			content: "version: 2\ndeny:\n  namespace: .*\nroles: {}",
+		},
+		{
+			name:    "Deny rule for an incorrect label name",
+			content: "version: 2\ndeny:\n  cluster-name: eu\nroles: {}",
+		},
+		{
+			name:    "Incorrect expiration time",
+			content: "version: 2\nroles:\n  team-a:\n    labels:\n      namespace: team-a\n    expires: tomorrow",
+		},
+	}
+
+	for _, tt := range incorrect {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewACLsFromYAML([]byte(tt.content))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+// mapKeys returns sorted keys of the map
+func mapKeys(m map[string]ACL) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
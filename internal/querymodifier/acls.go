@@ -3,59 +3,271 @@ package querymodifier
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/VictoriaMetrics/metricsql"
 )
 
 // ACLs stores a parsed YAML with role defitions
-type ACLs map[string]ACL
+type ACLs struct {
+	// Roles contains role definitions by role name
+	Roles map[string]ACL
+	// Patterns contains role definitions, which apply to roles matching the patterns (in the order they're defined in acl.yaml). They're considered only if there's no role with the exact name
+	Patterns []RolePattern
+	// Deny contains global deny rules (label name -> comma-separated list of denied values), they're added to every user ACL and take precedence over any grants, including full access
+	Deny map[string]string
+}
+
+// NewACLs returns ACLs with the specified role definitions and without any global deny rules
+func NewACLs(roles map[string]ACL) ACLs {
+	return ACLs{
+		Roles: roles,
+	}
+}
+
+// lookupRole returns a role definition either by the exact role name or, if there's none, by the first matching role pattern. The second value is false if the role is not defined.
+func (a ACLs) lookupRole(role string) (ACL, bool, error) {
+	if acl, exists := a.Roles[role]; exists {
+		return acl, true, nil
+	}
+
+	for _, p := range a.Patterns {
+		acl, matched, err := p.apply(role)
+		if matched {
+			return acl, true, err
+		}
+	}
 
-// rolesToRawACL returns a comma-separated list of ACL definitions for all specified roles. Basically, it lets you dynamically generate a raw ACL as if it was supplied through acl.yaml. To support Assumed Roles, unknown roles are treated as ACL definitions.
-func (a ACLs) rolesToRawACL(roles []string) (string, error) {
-	rawACLs := make([]string, 0, len(roles))
+	return ACL{}, false, nil
+}
+
+// CheckRole returns an error if the role matches a role pattern, but the pattern cannot be applied to it (e.g. a captured value contains a comma). Such roles are skipped by GetUserACL.
+func (a ACLs) CheckRole(role string) error {
+	_, _, err := a.lookupRole(role)
+	return err
+}
+
+// IsKnownRole returns true if the role is defined in acl.yaml either by its exact name or through a role pattern. Expired roles are still considered known.
+func (a ACLs) IsKnownRole(role string) bool {
+	if _, exists := a.Roles[role]; exists {
+		return true
+	}
+
+	for _, p := range a.Patterns {
+		if p.Regexp.MatchString(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RoleDefinition returns the name of the acl.yaml definition the role matches: the role itself if it's defined by its exact name, the name of the first matching role pattern otherwise. The returned value is bounded by the content of acl.yaml, so it can be used as a metric label.
+func (a ACLs) RoleDefinition(role string) (string, bool) {
+	if _, exists := a.Roles[role]; exists {
+		return role, true
+	}
+
+	for _, p := range a.Patterns {
+		if p.Regexp.MatchString(role) {
+			return p.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// rolesToRawACLs returns comma-separated lists of ACL definitions per label for all specified roles. Basically, it lets you dynamically generate raw ACLs as if they were supplied through acl.yaml. To support Assumed Roles, unknown roles are treated as ACL definitions for the default label. Labels are merged one by one, so roles that cannot be merged without widening access are rejected (see checkMergeable). Grants and exclusions for the same label are merged through mergeRawACLs.
+func (a ACLs) rolesToRawACLs(roles []string) (map[string]string, error) {
+	roleRawACLs := make([]map[string]string, 0, len(roles))
+	labels := make(map[string]struct{})
 
 	for _, role := range roles {
-		acl, exists := a[role]
+		acl, exists, err := a.lookupRole(role)
+		if err != nil {
+			return nil, err
+		}
 		if exists {
-			// NOTE: You should never see an empty definitions in .RawACL as those should be removed by toSlice further down the process. The error check below is not necessary, is left as an additional safeguard for now and might get removed in the future.
-			if acl.RawACL == "" {
-				return "", fmt.Errorf("%s role contains empty rawACL", role)
+			// NOTE: You should never see an empty definitions in .RawACLs as those should be removed by toSlice further down the process. The error check below is not necessary, is left as an additional safeguard for now and might get removed in the future.
+			if len(acl.RawACLs) == 0 {
+				return nil, fmt.Errorf("%s role contains empty rawACL", role)
 			}
-			rawACLs = append(rawACLs, acl.RawACL)
+			for label, rawACL := range acl.RawACLs {
+				if rawACL == "" {
+					return nil, fmt.Errorf("%s role contains empty rawACL for label %s", role, label)
+				}
+				labels[label] = struct{}{}
+			}
+			roleRawACLs = append(roleRawACLs, acl.RawACLs)
 		} else {
 			// NOTE: Role names are not linted, so they may contain regular expressions, including the admin definition: .*
-			rawACLs = append(rawACLs, role)
+			roleRawACLs = append(roleRawACLs, map[string]string{DefaultLabel: role})
+			labels[DefaultLabel] = struct{}{}
 		}
 	}
 
-	rawACL := strings.Join(rawACLs, ", ")
-	if rawACL == "" {
-		return "", fmt.Errorf("constructed empty rawACL")
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("constructed empty rawACL")
+	}
+
+	if err := checkMergeable(roleRawACLs); err != nil {
+		return nil, fmt.Errorf("roles %s cannot be combined: %w", strings.Join(roles, ", "), err)
 	}
 
-	return rawACL, nil
+	rawACLs := make(map[string]string, len(labels))
+	for label := range labels {
+		buffer := make([]string, 0, len(roleRawACLs))
+		same := true
+		for _, r := range roleRawACLs {
+			buffer = append(buffer, r[label])
+			same = same && r[label] == buffer[0]
+		}
+
+		// Labels with the same rules in all roles are kept as is
+		if same {
+			rawACLs[label] = buffer[0]
+			continue
+		}
+
+		rawACL, err := mergeRawACLs(label, buffer)
+		if err != nil {
+			return nil, err
+		}
+		rawACLs[label] = rawACL
+	}
+
+	return rawACLs, nil
+}
+
+// checkMergeable returns an error if merging rules of the roles one label at a time would give access to more than the roles do. That's the case if the roles restrict different sets of labels (a label unrestricted by one role would become unrestricted for all of them) or if their rules differ for more than one label (e.g. {cluster: eu, namespace: a} and {cluster: us, namespace: b} would also give access to cluster eu, namespace b).
+func checkMergeable(roleRawACLs []map[string]string) error {
+	if len(roleRawACLs) < 2 {
+		return nil
+	}
+
+	first := roleRawACLs[0]
+	differing := make(map[string]struct{})
+
+	for _, r := range roleRawACLs[1:] {
+		if len(r) != len(first) {
+			return fmt.Errorf("they restrict different sets of labels")
+		}
+
+		for label, rawACL := range first {
+			other, ok := r[label]
+			if !ok {
+				return fmt.Errorf("they restrict different sets of labels")
+			}
+			if other != rawACL {
+				differing[label] = struct{}{}
+			}
+		}
+	}
+
+	if len(differing) > 1 {
+		labels := make([]string, 0, len(differing))
+		for label := range differing {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		return fmt.Errorf("they restrict different values of several labels (%s)", strings.Join(labels, ", "))
+	}
+
+	return nil
 }
 
-// GetUserACL takes a list of roles found in an OIDC claim and constructs and ACL based on them. If assumed roles are disabled, then only known roles (present in app.ACLs) are considered.
+// mergeRawACLs merges rule definitions of several roles for the same label. Grants are combined, whereas an exclusion is kept unless any of the roles grants access to the excluded value, so the result never gives access to more than the roles do. Exclusions defined as regular expressions cannot be compared with grants, thus they're always kept.
+func mergeRawACLs(label string, rawACLs []string) (string, error) {
+	roleFilters := make([][]metricsql.LabelFilter, 0, len(rawACLs))
+	grants := []string{}
+	exclusions := []string{}
+	seenExclusions := make(map[string]struct{})
+
+	for _, rawACL := range rawACLs {
+		lfs, normalized, err := newLabelFilters(label, rawACL)
+		if err != nil {
+			return "", err
+		}
+		roleFilters = append(roleFilters, lfs)
+
+		for _, v := range strings.Split(normalized, ", ") {
+			if !strings.HasPrefix(v, "!") {
+				grants = append(grants, v)
+				continue
+			}
+			if _, ok := seenExclusions[v]; !ok {
+				seenExclusions[v] = struct{}{}
+				exclusions = append(exclusions, v)
+			}
+		}
+	}
+
+	buffer := grants
+	for _, v := range exclusions {
+		value := strings.TrimPrefix(v, "!")
+		if !strings.ContainsAny(value, RegexpSymbols) && isGrantedByAny(roleFilters, value) {
+			continue
+		}
+		buffer = append(buffer, v)
+	}
+
+	return strings.Join(buffer, ", "), nil
+}
+
+// isGrantedByAny returns true if the value matches all label filters of at least one of the roles.
+func isGrantedByAny(roleFilters [][]metricsql.LabelFilter, value string) bool {
+	for _, lfs := range roleFilters {
+		if matchesLabelFilters(lfs, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetUserACL takes a list of roles found in an OIDC claim and constructs and ACL based on them. If assumed roles are disabled, then only known roles (present in app.ACLs or matching one of the role patterns) are considered. Expired roles and roles, to which a matching role pattern cannot be applied, are ignored.
 func (a ACLs) GetUserACL(oidcRoles []string, assumedRolesEnabled bool) (ACL, error) {
 	roles := []string{}
 	assumedRoles := []string{}
+	roleACLs := []ACL{}
+	now := time.Now()
 
 	for _, role := range oidcRoles {
-		_, exists := a[role]
+		acl, exists, err := a.lookupRole(role)
+		if err != nil {
+			// NOTE: a bad value captured by a role pattern must not lock the user out, other roles are still considered (see CheckRole). Such roles must not be treated as assumed roles either
+			continue
+		}
 		if exists {
-			if a[role].Fullaccess {
-				return a[role], nil
+			// NOTE: expired roles must not be treated as assumed roles
+			if acl.IsExpired(now) {
+				continue
+			}
+			if acl.Fullaccess {
+				acl.TenantsRestricted = a.restrictsTenants()
+				return a.applyDeny(acl)
 			}
 			roles = append(roles, role)
+			roleACLs = append(roleACLs, acl)
 		} else {
+			// NOTE: otherwise, a role like "!kube-system" would give access to everything else
+			if strings.Contains(role, "!") {
+				continue
+			}
 			assumedRoles = append(assumedRoles, role)
 		}
 	}
 
-	if assumedRolesEnabled {
+	// Assumed roles are not bound to tenants, so they don't give access to any tenant
+	tenants := mergeTenants(roleACLs)
+
+	if assumedRolesEnabled && len(assumedRoles) > 0 {
 		roles = append(roles, assumedRoles...)
+		// Assumed roles do not have any per-role options, thus they don't restrict endpoints either
+		roleACLs = append(roleACLs, ACL{})
 	}
 
 	if len(roles) == 0 {
@@ -65,54 +277,173 @@ func (a ACLs) GetUserACL(oidcRoles []string, assumedRolesEnabled bool) (ACL, err
 	// We can return a prebuilt ACL if there's only one role and it's known
 	if len(roles) == 1 {
 		role := roles[0]
-		acl, exists := a[role]
+		acl, exists, err := a.lookupRole(role)
+		if err != nil {
+			return ACL{}, err
+		}
 		if exists {
-			return acl, nil
+			acl.TenantsRestricted = a.restrictsTenants()
+			return a.applyDeny(acl)
 		}
 	}
 
-	// To simplify creation of composite ACLs, we need to form a raw ACL, so the further process would be equal to what we have for processing acl.yaml
-	rawACL, err := a.rolesToRawACL(roles)
+	// To simplify creation of composite ACLs, we need to form raw ACLs, so the further process would be equal to what we have for processing acl.yaml
+	rawACLs, err := a.rolesToRawACLs(roles)
+	if err != nil {
+		return ACL{}, err
+	}
+
+	acl, err := NewMultiLabelACL(rawACLs)
 	if err != nil {
 		return ACL{}, err
 	}
 
-	acl, err := NewACL(rawACL)
+	acl = mergeRoleOptions(acl, roleACLs)
+	acl.Tenants = tenants
+	acl.TenantsRestricted = a.restrictsTenants()
+
+	return a.applyDeny(acl)
+}
+
+// restrictsTenants returns true if any of the roles or role patterns declares tenants. Then tenants are denied by default, so that roles without tenants (and assumed roles) don't give access to tenants of other users.
+func (a ACLs) restrictsTenants() bool {
+	for _, acl := range a.Roles {
+		if len(acl.Tenants) > 0 {
+			return true
+		}
+	}
+
+	for _, p := range a.Patterns {
+		if len(p.Template.Tenants) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyDeny returns the acl with global deny rules added as exclusions. Per-role options are preserved. If there are no deny rules, the acl is returned as is.
+func (a ACLs) applyDeny(acl ACL) (ACL, error) {
+	if len(a.Deny) == 0 {
+		return acl, nil
+	}
+
+	rawACLs := make(map[string]string, len(acl.RawACLs)+len(a.Deny))
+	if !acl.Fullaccess {
+		for label, rawACL := range acl.RawACLs {
+			rawACLs[label] = rawACL
+		}
+	}
+
+	for label, rawDeny := range a.Deny {
+		denied, err := toSlice(rawDeny)
+		if err != nil {
+			return ACL{}, err
+		}
+
+		rawACL, ok := rawACLs[label]
+		if !ok {
+			rawACL = ".*"
+		}
+		for _, v := range denied {
+			rawACL += ", !" + strings.TrimPrefix(v, "!")
+		}
+		rawACLs[label] = rawACL
+	}
+
+	denyACL, err := NewMultiLabelACL(rawACLs)
 	if err != nil {
 		return ACL{}, err
 	}
 
+	acl.Fullaccess = denyACL.Fullaccess
+	acl.LabelFilters = denyACL.LabelFilters
+	acl.RawACLs = denyACL.RawACLs
+
 	return acl, nil
 }
 
 // NewACLsFromFile loads ACL from a file or returns an empty ACLs instance if path is empty
 func NewACLsFromFile(path string) (ACLs, error) {
-	acls := make(ACLs)
-
 	path = strings.TrimSpace(path)
 	if path == "" {
-		return acls, nil
+		return NewACLs(make(map[string]ACL)), nil
 	}
 
 	yamlFile, err := os.ReadFile(path)
 	if err != nil {
 		return ACLs{}, err
 	}
-	var aclYaml map[string]string
 
-	err = yaml.Unmarshal(yamlFile, &aclYaml)
-	if err != nil {
-		return ACLs{}, err
+	return NewACLsFromYAML(yamlFile)
+}
+
+// mergeRoleOptions returns the acl with per-role options merged from the ACLs it was built from. Endpoints are restricted only if all ACLs restrict them, a setting stays disabled if it's disabled for any of the ACLs, the earliest expiration time is kept.
+func mergeRoleOptions(acl ACL, acls []ACL) ACL {
+	endpoints := []string{}
+	seenEndpoints := make(map[string]struct{})
+	unrestrictedEndpoints := false
+
+	for _, a := range acls {
+		if len(a.AllowedEndpoints) == 0 {
+			unrestrictedEndpoints = true
+		}
+		for _, e := range a.AllowedEndpoints {
+			if _, ok := seenEndpoints[e]; !ok {
+				seenEndpoints[e] = struct{}{}
+				endpoints = append(endpoints, e)
+			}
+		}
+
+		acl.EnableDeduplication = mergeBoolOption(acl.EnableDeduplication, a.EnableDeduplication)
+		acl.OptimizeExpressions = mergeBoolOption(acl.OptimizeExpressions, a.OptimizeExpressions)
+
+		if !a.Expires.IsZero() && (acl.Expires.IsZero() || a.Expires.Before(acl.Expires)) {
+			acl.Expires = a.Expires
+		}
 	}
 
-	for role, rawACL := range aclYaml {
-		acl, err := NewACL(rawACL)
-		if err != nil {
-			return ACLs{}, err
+	if !unrestrictedEndpoints {
+		acl.AllowedEndpoints = endpoints
+	}
+
+	return acl
+}
+
+// mergeTenants returns tenants allowed by any of the ACLs, ACLs without tenants don't add any. If one of the ACLs allows all tenants (AllTenants), only AllTenants is returned. nil is returned if there are no tenants.
+func mergeTenants(acls []ACL) []string {
+	tenants := []string{}
+	seen := make(map[string]struct{})
+
+	for _, a := range acls {
+		for _, t := range a.Tenants {
+			if t == AllTenants {
+				return []string{AllTenants}
+			}
+			if _, ok := seen[t]; !ok {
+				seen[t] = struct{}{}
+				tenants = append(tenants, t)
+			}
 		}
+	}
+
+	if len(tenants) == 0 {
+		return nil
+	}
+
+	return tenants
+}
+
+// mergeBoolOption merges optional settings, false takes precedence over true, nil values are ignored.
+func mergeBoolOption(a *bool, b *bool) *bool {
+	if a == nil {
+		return b
+	}
 
-		acls[role] = acl
+	if b == nil || *a == *b {
+		return a
 	}
 
-	return acls, nil
+	disabled := false
+	return &disabled
 }
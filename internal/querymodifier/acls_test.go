@@ -3,114 +3,215 @@ package querymodifier
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/VictoriaMetrics/metricsql"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestACL_rolesToRawACL(t *testing.T) {
-	a := ACLs{
+func TestACL_rolesToRawACLs(t *testing.T) {
+	a := NewACLs(map[string]ACL{
 		"admin": ACL{
 			Fullaccess: true,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      ".*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      ".*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: ".*",
+			RawACLs: map[string]string{"namespace": ".*"},
 		},
 		"multiple-values": ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "ku.*|min.*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "ku.*|min.*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: "ku.*, min.*",
+			RawACLs: map[string]string{"namespace": "ku.*, min.*"},
 		},
 		"single-value": ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "default",
-				IsRegexp:   false,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "default",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
 			},
-			RawACL: "default",
+			RawACLs: map[string]string{"namespace": "default"},
 		},
-	}
+	})
 
 	t.Run("0 roles", func(t *testing.T) {
 		roles := []string{}
-		_, err := a.rolesToRawACL(roles)
+		_, err := a.rolesToRawACLs(roles)
 		assert.NotNil(t, err)
 	})
 
 	t.Run("1 known role", func(t *testing.T) {
 		roles := []string{"multiple-values"}
-		want := "ku.*, min.*"
+		want := map[string]string{"namespace": "ku.*, min.*"}
 
-		got, err := a.rolesToRawACL(roles)
+		got, err := a.rolesToRawACLs(roles)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
 	})
 
 	t.Run("multiple known roles", func(t *testing.T) {
 		roles := []string{"multiple-values", "single-value"}
-		want := "ku.*, min.*, default"
+		want := map[string]string{"namespace": "ku.*, min.*, default"}
+
+		got, err := a.rolesToRawACLs(roles)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("multiple known roles with different labels", func(t *testing.T) {
+		a := NewACLs(map[string]ACL{
+			"eu-team": ACL{
+				RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-a"},
+			},
+			"us-team": ACL{
+				RawACLs: map[string]string{"cluster": "us-.*", "namespace": "team-b"},
+			},
+			"namespace-only": ACL{
+				RawACLs: map[string]string{"namespace": "team-c"},
+			},
+		})
+
+		// Otherwise, cluster eu-.* and namespace team-b would be allowed as well
+		roles := []string{"eu-team", "us-team"}
+		_, err := a.rolesToRawACLs(roles)
+		assert.NotNil(t, err)
+
+		// Otherwise, cluster would become unrestricted for eu-team
+		roles = []string{"eu-team", "namespace-only"}
+		_, err = a.rolesToRawACLs(roles)
+		assert.NotNil(t, err)
+
+		// Otherwise, cluster would become unrestricted for eu-team
+		roles = []string{"eu-team", "assumed-role"}
+		_, err = a.rolesToRawACLs(roles)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("multiple known roles differing in one label", func(t *testing.T) {
+		a := NewACLs(map[string]ACL{
+			"eu-team-a": ACL{
+				RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-a"},
+			},
+			"eu-team-b": ACL{
+				RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-b"},
+			},
+			"eu-team-c": ACL{
+				RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-c"},
+			},
+		})
 
-		got, err := a.rolesToRawACL(roles)
+		roles := []string{"eu-team-a", "eu-team-b", "eu-team-c"}
+		want := map[string]string{"cluster": "eu-.*", "namespace": "team-a, team-b, team-c"}
+
+		got, err := a.rolesToRawACLs(roles)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("multiple known roles with exclusions", func(t *testing.T) {
+		a := NewACLs(map[string]ACL{
+			"all-but-system": ACL{
+				RawACLs: map[string]string{"namespace": ".*, !kube-system, !vault"},
+			},
+			"system": ACL{
+				RawACLs: map[string]string{"namespace": "kube-system"},
+			},
+			"team": ACL{
+				RawACLs: map[string]string{"namespace": "team-.*, !team-secret, !team-.*-private"},
+			},
+		})
+
+		// kube-system is granted by another role, so the exclusion is dropped
+		roles := []string{"all-but-system", "system"}
+		want := map[string]string{"namespace": ".*, kube-system, !vault"}
+
+		got, err := a.rolesToRawACLs(roles)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+
+		// None of the roles grant team-secret, regexp exclusions are always kept
+		roles = []string{"team", "system"}
+		want = map[string]string{"namespace": "team-.*, kube-system, !team-secret, !team-.*-private"}
+
+		got, err = a.rolesToRawACLs(roles)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+
+		// team-secret is granted by all-but-system, whereas team does not grant kube-system and vault
+		roles = []string{"all-but-system", "team"}
+		want = map[string]string{"namespace": ".*, team-.*, !kube-system, !vault, !team-.*-private"}
+
+		got, err = a.rolesToRawACLs(roles)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
 	})
 
 	t.Run("Empty rawACL", func(t *testing.T) {
-		a := ACLs{
+		a := NewACLs(map[string]ACL{
 			"empty-acl": ACL{},
-		}
+		})
 
 		roles := []string{"empty-acl"}
 
-		_, err := a.rolesToRawACL(roles)
+		_, err := a.rolesToRawACLs(roles)
 		assert.NotNil(t, err)
 	})
 }
 
 func TestACL_GetUserACL(t *testing.T) {
-	a := ACLs{
+	a := NewACLs(map[string]ACL{
 		"admin": ACL{
 			Fullaccess: true,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      ".*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      ".*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: ".*",
+			RawACLs: map[string]string{"namespace": ".*"},
 		},
 		"multiple-values": ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "ku.*|min.*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "ku.*|min.*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: "ku.*, min.*",
+			RawACLs: map[string]string{"namespace": "ku.*, min.*"},
 		},
 		"single-value": ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "default",
-				IsRegexp:   false,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "default",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
 			},
-			RawACL: "default",
+			RawACLs: map[string]string{"namespace": "default"},
 		},
-	}
+	})
 
 	// Assumed roles disabled
 	t.Run("0 roles", func(t *testing.T) {
@@ -127,7 +228,7 @@ func TestACL_GetUserACL(t *testing.T) {
 
 	t.Run("1 role", func(t *testing.T) {
 		roles := []string{"single-value"}
-		want := a["single-value"]
+		want := a.Roles["single-value"]
 		got, err := a.GetUserACL(roles, false)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
@@ -135,7 +236,7 @@ func TestACL_GetUserACL(t *testing.T) {
 
 	t.Run("multiple roles, full access", func(t *testing.T) {
 		roles := []string{"admin", "multiple-values"}
-		want := a["admin"]
+		want := a.Roles["admin"]
 		got, err := a.GetUserACL(roles, false)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
@@ -145,18 +246,20 @@ func TestACL_GetUserACL(t *testing.T) {
 		roles := []string{"single-value", "multiple-values", "unknown-role"}
 		knownRoles := []string{"single-value", "multiple-values"}
 
-		rawACL, err := a.rolesToRawACL(knownRoles)
+		rawACLs, err := a.rolesToRawACLs(knownRoles)
 		assert.Nil(t, err)
 
 		want := ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "default|ku.*|min.*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "default|ku.*|min.*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: rawACL,
+			RawACLs: rawACLs,
 		}
 
 		got, err := a.GetUserACL(roles, false)
@@ -170,13 +273,15 @@ func TestACL_GetUserACL(t *testing.T) {
 
 		want := ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "unknown-role",
-				IsRegexp:   false,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "unknown-role",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
 			},
-			RawACL: "unknown-role",
+			RawACLs: map[string]string{"namespace": "unknown-role"},
 		}
 
 		got, err := a.GetUserACL(roles, true)
@@ -189,13 +294,15 @@ func TestACL_GetUserACL(t *testing.T) {
 
 		want := ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "ku.*|min.*|default|unknown-role",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "ku.*|min.*|default|unknown-role",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: "ku.*, min.*, default, unknown-role",
+			RawACLs: map[string]string{"namespace": "ku.*, min.*, default, unknown-role"},
 		}
 
 		got, err := a.GetUserACL(roles, true)
@@ -229,13 +336,15 @@ func TestACL_GetUserACL(t *testing.T) {
 
 		want := ACL{
 			Fullaccess: false,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      "ku.*|min.*|default|unknown-role1|unknown-role2",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "ku.*|min.*|default|unknown-role1|unknown-role2",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: "ku.*, min.*, default, unknown-role1, unknown-role2",
+			RawACLs: map[string]string{"namespace": "ku.*, min.*, default, unknown-role1, unknown-role2"},
 		}
 
 		got, err := a.GetUserACL(roles, true)
@@ -248,19 +357,338 @@ func TestACL_GetUserACL(t *testing.T) {
 
 		want := ACL{
 			Fullaccess: true,
-			LabelFilter: metricsql.LabelFilter{
-				Label:      "namespace",
-				Value:      ".*",
-				IsRegexp:   true,
-				IsNegative: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      ".*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
 			},
-			RawACL: ".*",
+			RawACLs: map[string]string{"namespace": ".*"},
 		}
 
 		got, err := a.GetUserACL(roles, true)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
 	})
+
+	t.Run("multiple roles with different labels", func(t *testing.T) {
+		aclEU, err := NewMultiLabelACL(map[string]string{"cluster": "eu-.*", "namespace": "team-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := NewACLs(map[string]ACL{
+			"eu-team":         aclEU,
+			"multiple-values": a.Roles["multiple-values"],
+		})
+
+		roles := []string{"eu-team", "multiple-values"}
+
+		// cluster is not restricted by multiple-values, merging the roles would give access to all clusters
+		_, err = a.GetUserACL(roles, false)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestACL_GetUserACL_roleOptions(t *testing.T) {
+	enabled := true
+	disabled := false
+	expires := time.Now().Add(time.Hour)
+
+	a := NewACLs(map[string]ACL{
+		"expired": ACL{
+			Fullaccess: true,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      ".*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+			},
+			RawACLs: map[string]string{"namespace": ".*"},
+			Expires: time.Now().Add(-time.Hour),
+		},
+		"query-only": ACL{
+			Fullaccess: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "minio",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+			},
+			RawACLs:             map[string]string{"namespace": "minio"},
+			AllowedEndpoints:    []string{"/api/v1/query"},
+			Tenants:             []string{"1:0"},
+			EnableDeduplication: &enabled,
+			Expires:             expires,
+		},
+		"federate-only": ACL{
+			Fullaccess: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "stolon",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+			},
+			RawACLs:             map[string]string{"namespace": "stolon"},
+			AllowedEndpoints:    []string{"/federate"},
+			Tenants:             []string{"2:0", "1:0"},
+			EnableDeduplication: &disabled,
+			OptimizeExpressions: &enabled,
+		},
+	})
+
+	t.Run("Expired roles are ignored", func(t *testing.T) {
+		_, err := a.GetUserACL([]string{"expired"}, false)
+		assert.NotNil(t, err)
+
+		// Must not be treated as an assumed role either
+		got, err := a.GetUserACL([]string{"expired", "minio"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"namespace": "minio"}, got.RawACLs)
+	})
+
+	t.Run("Options are merged", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"query-only", "federate-only"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"/api/v1/query", "/federate"}, got.AllowedEndpoints)
+		assert.Equal(t, []string{"1:0", "2:0"}, got.Tenants)
+		assert.Equal(t, &disabled, got.EnableDeduplication)
+		assert.Equal(t, &enabled, got.OptimizeExpressions)
+		assert.Equal(t, expires, got.Expires)
+	})
+
+	t.Run("Assumed roles do not restrict endpoints", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"query-only", "unknown-role"}, true)
+		assert.Nil(t, err)
+		assert.Empty(t, got.AllowedEndpoints)
+	})
+
+	t.Run("Assumed roles do not lift tenant restrictions", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"query-only", "unknown-role"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"1:0"}, got.Tenants)
+		assert.True(t, got.TenantsRestricted)
+	})
+
+	t.Run("Assumed roles do not give access to any tenant", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"minio", "stolon"}, true)
+		assert.Nil(t, err)
+		assert.Empty(t, got.Tenants)
+		assert.True(t, got.TenantsRestricted)
+		assert.False(t, got.AllowsAllTenants())
+	})
+
+	t.Run("Roles without tenants do not give access to any tenant", func(t *testing.T) {
+		minio, err := NewACL("minio")
+		assert.Nil(t, err)
+		admin, err := NewACL(".*")
+		assert.Nil(t, err)
+
+		b := NewACLs(map[string]ACL{
+			"query-only": a.Roles["query-only"],
+			"minio":      minio,
+			"admin":      admin,
+		})
+
+		for _, roles := range [][]string{{"minio"}, {"admin"}, {"minio", "stolon"}} {
+			got, err := b.GetUserACL(roles, true)
+			assert.Nil(t, err)
+			assert.Empty(t, got.Tenants)
+			assert.False(t, got.AllowsAllTenants(), roles)
+		}
+	})
+
+	t.Run("Tenants are not restricted if no roles declare them", func(t *testing.T) {
+		b := NewACLs(map[string]ACL{})
+		got, err := b.GetUserACL([]string{"minio"}, true)
+		assert.Nil(t, err)
+		assert.False(t, got.TenantsRestricted)
+		assert.True(t, got.AllowsAllTenants())
+	})
+}
+
+func Test_mergeTenants(t *testing.T) {
+	tests := []struct {
+		name string
+		acls []ACL
+		want []string
+	}{
+		{
+			name: "No ACLs",
+			acls: []ACL{},
+			want: nil,
+		},
+		{
+			name: "All ACLs restrict tenants",
+			acls: []ACL{{Tenants: []string{"1:0", "2:0"}}, {Tenants: []string{"2:0", "3"}}},
+			want: []string{"1:0", "2:0", "3"},
+		},
+		{
+			name: "ACLs without tenants don't add any",
+			acls: []ACL{{Tenants: []string{"1:0"}}, {}},
+			want: []string{"1:0"},
+		},
+		{
+			name: "No ACLs have tenants",
+			acls: []ACL{{}, {}},
+			want: nil,
+		},
+		{
+			name: "One of the ACLs allows all tenants",
+			acls: []ACL{{Tenants: []string{"1:0"}}, {Tenants: []string{"*"}}},
+			want: []string{"*"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeTenants(tt.acls)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestACL_GetUserACL_deny(t *testing.T) {
+	newTestACL := func(rawACL string) ACL {
+		acl, err := NewACL(rawACL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acl
+	}
+
+	a := NewACLs(map[string]ACL{
+		"admin":          newTestACL(".*"),
+		"all-but-system": newTestACL("!kube-system, !vault"),
+		"team":           newTestACL("team-.*, !team-secret"),
+	})
+	a.Deny = map[string]string{"namespace": "vault", "cluster": "secret"}
+
+	t.Run("Deny rules restrict full access", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"admin"}, false)
+		assert.Nil(t, err)
+		assert.False(t, got.Fullaccess)
+		assert.Equal(t, `cluster!~"secret", namespace!~"vault"`, got.LabelFiltersString())
+	})
+
+	t.Run("Deny rules are merged with exclusions", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"team"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, `cluster!~"secret", namespace=~"team-.*", namespace!~"team-secret|vault"`, got.LabelFiltersString())
+	})
+
+	t.Run("Deny rules take precedence over grants of other roles", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"all-but-system", "team"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, `cluster!~"secret", namespace!~"kube-system|vault"`, got.LabelFiltersString())
+
+		got, err = a.GetUserACL([]string{"team", "vault"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, `cluster!~"secret", namespace=~"team-.*|vault", namespace!~"team-secret|vault"`, got.LabelFiltersString())
+	})
+
+	t.Run("Assumed roles cannot contain exclusions", func(t *testing.T) {
+		_, err := a.GetUserACL([]string{"!kube-system"}, true)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestACL_GetUserACL_patterns(t *testing.T) {
+	newTestPattern := func(name string, rawACL string) RolePattern {
+		p, err := NewRolePattern(name, map[string]string{"namespace": rawACL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	aclExact, err := NewACL("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewACLs(map[string]ACL{
+		"team-legacy-viewer": aclExact,
+	})
+	a.Patterns = []RolePattern{
+		newTestPattern("team-(.+)-admin", "$1-.*"),
+		newTestPattern("team-(.+)-viewer", "$1-prod, $1-stage"),
+		newTestPattern("team-(.+)", "$1"),
+	}
+
+	t.Run("Exact role name takes precedence over patterns", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"team-legacy-viewer"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, aclExact, got)
+	})
+
+	t.Run("First matching pattern", func(t *testing.T) {
+		// team-(.+) also matches, but goes after team-(.+)-admin
+		got, err := a.GetUserACL([]string{"team-payments-admin"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace=~"payments-.*"`, got.LabelFiltersString())
+	})
+
+	t.Run("Pattern-based roles are not assumed roles", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"team-payments-viewer"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace=~"payments-prod|payments-stage"`, got.LabelFiltersString())
+	})
+
+	t.Run("Pattern-based roles are merged with other roles", func(t *testing.T) {
+		got, err := a.GetUserACL([]string{"team-payments-viewer", "team-legacy-viewer", "team-search"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace=~"payments-prod|payments-stage|legacy|search"`, got.LabelFiltersString())
+	})
+
+	t.Run("Roles with incorrect captured values are skipped", func(t *testing.T) {
+		b := a
+		b.Patterns = append([]RolePattern{newTestPattern("team-(.+)-viewer(-ro)?", "$1")}, a.Patterns...)
+
+		assert.Nil(t, b.CheckRole("team-payments-viewer"))
+		assert.NotNil(t, b.CheckRole("team-a,kube-system-viewer"))
+
+		got, err := b.GetUserACL([]string{"team-a,kube-system-viewer", "team-payments-viewer"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace="payments"`, got.LabelFiltersString())
+
+		_, err = b.GetUserACL([]string{"team-a,kube-system-viewer"}, true)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("No matching patterns", func(t *testing.T) {
+		_, err := a.GetUserACL([]string{"payments-viewer"}, false)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Known roles", func(t *testing.T) {
+		assert.True(t, a.IsKnownRole("team-legacy-viewer"))
+		assert.True(t, a.IsKnownRole("team-payments-viewer"))
+		assert.False(t, a.IsKnownRole("payments-viewer"))
+	})
+
+	t.Run("Role definitions", func(t *testing.T) {
+		for role, want := range map[string]string{
+			"team-legacy-viewer":   "team-legacy-viewer",
+			"team-payments-viewer": "team-(.+)-viewer",
+			"team-payments-admin":  "team-(.+)-admin",
+		} {
+			got, ok := a.RoleDefinition(role)
+			assert.True(t, ok)
+			assert.Equal(t, want, got)
+		}
+
+		_, ok := a.RoleDefinition("payments-viewer")
+		assert.False(t, ok)
+	})
 }
 
 func TestACL_NewACLsFromFile(t *testing.T) {
@@ -272,66 +700,100 @@ func TestACL_NewACLsFromFile(t *testing.T) {
 		{
 			name:    "admin",
 			content: "admin: .*",
-			want: ACLs{
+			want: NewACLs(map[string]ACL{
 				"admin": ACL{
 					Fullaccess: true,
-					LabelFilter: metricsql.LabelFilter{
-						Label:      "namespace",
-						Value:      ".*",
-						IsRegexp:   true,
-						IsNegative: false,
+					LabelFilters: []metricsql.LabelFilter{
+						{
+							Label:      "namespace",
+							Value:      ".*",
+							IsRegexp:   true,
+							IsNegative: false,
+						},
 					},
-					RawACL: ".*",
+					RawACLs: map[string]string{"namespace": ".*"},
 				},
-			},
+			}),
 		},
 		{
 			name:    "implicit-admin",
 			content: `implicit-admin: ku.*, .*, min.*`,
-			want: ACLs{
+			want: NewACLs(map[string]ACL{
 				"implicit-admin": ACL{
 					Fullaccess: true,
-					LabelFilter: metricsql.LabelFilter{
-						Label:      "namespace",
-						Value:      ".*",
-						IsRegexp:   true,
-						IsNegative: false,
+					LabelFilters: []metricsql.LabelFilter{
+						{
+							Label:      "namespace",
+							Value:      ".*",
+							IsRegexp:   true,
+							IsNegative: false,
+						},
 					},
-					RawACL: ".*",
+					RawACLs: map[string]string{"namespace": ".*"},
 				},
-			},
+			}),
 		},
 		{
 			name:    "multiple-values",
 			content: "multiple-values: ku.*, min.*",
-			want: ACLs{
+			want: NewACLs(map[string]ACL{
 				"multiple-values": ACL{
 					Fullaccess: false,
-					LabelFilter: metricsql.LabelFilter{
-						Label:      "namespace",
-						Value:      "ku.*|min.*",
-						IsRegexp:   true,
-						IsNegative: false,
+					LabelFilters: []metricsql.LabelFilter{
+						{
+							Label:      "namespace",
+							Value:      "ku.*|min.*",
+							IsRegexp:   true,
+							IsNegative: false,
+						},
 					},
-					RawACL: "ku.*, min.*",
+					RawACLs: map[string]string{"namespace": "ku.*, min.*"},
 				},
-			},
+			}),
 		},
 		{
 			name:    "single-value",
 			content: "single-value: default",
-			want: ACLs{
+			want: NewACLs(map[string]ACL{
 				"single-value": ACL{
 					Fullaccess: false,
-					LabelFilter: metricsql.LabelFilter{
-						Label:      "namespace",
-						Value:      "default",
-						IsRegexp:   false,
-						IsNegative: false,
+					LabelFilters: []metricsql.LabelFilter{
+						{
+							Label:      "namespace",
+							Value:      "default",
+							IsRegexp:   false,
+							IsNegative: false,
+						},
 					},
-					RawACL: "default",
+					RawACLs: map[string]string{"namespace": "default"},
 				},
-			},
+			}),
+		},
+		{
+			name: "multiple-labels",
+			content: `multiple-labels:
+  cluster: eu-.*
+  namespace: team-a, team-b`,
+			want: NewACLs(map[string]ACL{
+				"multiple-labels": ACL{
+					Fullaccess: false,
+					LabelFilters: []metricsql.LabelFilter{
+						{
+							Label:      "cluster",
+							Value:      "eu-.*",
+							IsRegexp:   true,
+							IsNegative: false,
+						},
+						{
+							Label:      "namespace",
+							Value:      "team-a|team-b",
+							IsRegexp:   true,
+							IsNegative: false,
+						},
+					},
+					RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "team-a, team-b"},
+				},
+			}),
 		},
 	}
 
@@ -353,7 +815,7 @@ func TestACL_NewACLsFromFile(t *testing.T) {
 	t.Run("empty path", func(t *testing.T) {
 		got, err := NewACLsFromFile("")
 		assert.Nil(t, err)
-		assert.Equal(t, ACLs{}, got)
+		assert.Equal(t, NewACLs(map[string]ACL{}), got)
 	})
 
 	t.Run("incorrect ACL", func(t *testing.T) {
@@ -364,6 +826,14 @@ func TestACL_NewACLsFromFile(t *testing.T) {
 		saveACLToFile(t, f, "test-role: a b")
 		_, err = NewACLsFromFile(f.Name())
 		assert.NotNil(t, err)
+
+		saveACLToFile(t, f, "test-role: [a, b]")
+		_, err = NewACLsFromFile(f.Name())
+		assert.NotNil(t, err)
+
+		saveACLToFile(t, f, "test-role:\n  cluster-name: eu")
+		_, err = NewACLsFromFile(f.Name())
+		assert.NotNil(t, err)
 	})
 
 	if err := f.Close(); err != nil {
@@ -2,8 +2,11 @@ package querymodifier
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"unicode"
+
+	"github.com/VictoriaMetrics/metricsql"
 )
 
 // toSlice converts namespace rules to string slices.
@@ -31,3 +34,23 @@ func toSlice(str string) ([]string, error) {
 
 	return buffer, nil
 }
+
+// matchesLabelFilters returns true if the value satisfies all label filters (regular expressions are fully anchored, as in PromQL).
+func matchesLabelFilters(lfs []metricsql.LabelFilter, value string) bool {
+	for _, lf := range lfs {
+		matched := lf.Value == value
+		if lf.IsRegexp {
+			re, err := regexp.Compile("^(?:" + lf.Value + ")$")
+			if err != nil {
+				return false
+			}
+			matched = re.MatchString(value)
+		}
+
+		if matched == lf.IsNegative {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,293 @@
+package querymodifier
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// lintProbes are values used to detect regular expressions that match anything
+var lintProbes = []string{"", "x", "lfgw-probe-7f3c", "A.B/C:D_E-1", "kube-system"}
+
+// maxLintSamples limits the number of sample strings generated from a role pattern
+const maxLintSamples = 16
+
+// LintWarning describes a valid, but probably unintended role definition.
+type LintWarning struct {
+	Role    string
+	Message string
+}
+
+// String returns the warning in a human-readable form.
+func (w LintWarning) String() string {
+	return fmt.Sprintf("%s role: %s", w.Role, w.Message)
+}
+
+// Lint returns warnings about role definitions, which give full access (explicitly or effectively), role patterns shadowed by earlier patterns, roles whose grants are fully denied by global deny rules, expired roles and pairs of roles that cannot be combined for a user (see checkMergeable). Roles are reported in alphabetical order, followed by patterns in the order they're defined.
+func (a ACLs) Lint(now time.Time) []LintWarning {
+	warnings := []LintWarning{}
+
+	roles := make([]string, 0, len(a.Roles))
+	for role := range a.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	denyFilters := a.denyFilters()
+
+	for _, role := range roles {
+		acl := a.Roles[role]
+		for _, msg := range lintACL(acl, denyFilters, now) {
+			warnings = append(warnings, LintWarning{Role: role, Message: msg})
+		}
+	}
+
+	// Roles giving full access are never merged with other roles
+	for i, role := range roles {
+		if a.Roles[role].Fullaccess {
+			continue
+		}
+
+		for _, other := range roles[i+1:] {
+			if a.Roles[other].Fullaccess {
+				continue
+			}
+
+			if err := checkMergeable([]map[string]string{a.Roles[role].RawACLs, a.Roles[other].RawACLs}); err != nil {
+				warnings = append(warnings, LintWarning{Role: role, Message: fmt.Sprintf("cannot be combined with %s, users with both roles are denied: %s", other, err)})
+			}
+		}
+	}
+
+	for i, p := range a.Patterns {
+		if matchesAll(p.Regexp) {
+			warnings = append(warnings, LintWarning{Role: p.Name, Message: "pattern matches any role name"})
+		}
+
+		for _, earlier := range a.Patterns[:i] {
+			if isShadowedBy(p, earlier) {
+				warnings = append(warnings, LintWarning{Role: p.Name, Message: fmt.Sprintf("pattern is probably shadowed by %s, which is defined earlier", earlier.Name)})
+				break
+			}
+		}
+
+		if p.Template.IsExpired(now) {
+			warnings = append(warnings, LintWarning{Role: p.Name, Message: fmt.Sprintf("expired at %s", p.Template.Expires)})
+		}
+	}
+
+	return warnings
+}
+
+// lintACL returns warnings for a single role definition.
+func lintACL(acl ACL, denyFilters []metricsql.LabelFilter, now time.Time) []string {
+	warnings := []string{}
+
+	if acl.IsExpired(now) {
+		warnings = append(warnings, fmt.Sprintf("expired at %s", acl.Expires))
+	}
+
+	if acl.Fullaccess {
+		return append(warnings, "gives full access")
+	}
+
+	unrestricted := 0
+	for _, lf := range acl.LabelFilters {
+		if lf.IsNegative {
+			continue
+		}
+
+		if lf.IsRegexp && matchesAllValues(lf.Value) {
+			unrestricted++
+			warnings = append(warnings, fmt.Sprintf("%s is effectively not restricted (%q matches any value)", lf.Label, lf.Value))
+			continue
+		}
+
+		if isDeniedLabelFilter(lf, denyFilters) {
+			warnings = append(warnings, fmt.Sprintf("all values of %s granted by the role are denied by global deny rules", lf.Label))
+		}
+	}
+
+	hasNegative := false
+	for _, lf := range acl.LabelFilters {
+		if lf.IsNegative {
+			hasNegative = true
+			break
+		}
+	}
+
+	if !hasNegative && unrestricted > 0 && unrestricted == len(acl.LabelFilters) {
+		warnings = append(warnings, "effectively gives full access")
+	}
+
+	return warnings
+}
+
+// denyFilters returns global deny rules as label filters, invalid rules are skipped as they're reported while loading acl.yaml.
+func (a ACLs) denyFilters() []metricsql.LabelFilter {
+	if len(a.Deny) == 0 {
+		return nil
+	}
+
+	rawACLs := make(map[string]string, len(a.Deny))
+	for label, rawDeny := range a.Deny {
+		denied, err := toSlice(rawDeny)
+		if err != nil {
+			continue
+		}
+		for i, v := range denied {
+			denied[i] = "!" + strings.TrimPrefix(v, "!")
+		}
+		rawACLs[label] = strings.Join(denied, ", ")
+	}
+
+	acl, err := NewMultiLabelACL(rawACLs)
+	if err != nil {
+		return nil
+	}
+
+	return acl.LabelFilters
+}
+
+// isDeniedLabelFilter returns true if all values of a positive label filter are literal and denied by one of the deny filters. Filters matching arbitrary values are never reported.
+func isDeniedLabelFilter(lf metricsql.LabelFilter, denyFilters []metricsql.LabelFilter) bool {
+	values := []string{lf.Value}
+	if lf.IsRegexp {
+		values = strings.Split(lf.Value, "|")
+		for _, v := range values {
+			if strings.ContainsAny(v, RegexpSymbols) {
+				return false
+			}
+		}
+	}
+
+	for _, v := range values {
+		denied := false
+		for _, deny := range denyFilters {
+			if deny.Label == lf.Label && !matchesLabelFilters([]metricsql.LabelFilter{deny}, v) {
+				denied = true
+				break
+			}
+		}
+		if !denied {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesAllValues returns true if the label filter regexp is likely to match any value.
+func matchesAllValues(value string) bool {
+	re, err := metricsql.CompileRegexpAnchored(value)
+	if err != nil {
+		return false
+	}
+
+	return matchesAll(re)
+}
+
+// matchesAll returns true if the regexp matches all probe values.
+func matchesAll(re *regexp.Regexp) bool {
+	for _, probe := range lintProbes {
+		if !re.MatchString(probe) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isShadowedBy returns true if the earlier pattern matches all sample role names generated from the pattern. It's a sampling heuristic: only a few names are generated, so a shadowed pattern might be missed, and a pattern might be reported even though some role names it matches aren't matched by the earlier one (hence "probably" in the warning).
+func isShadowedBy(p RolePattern, earlier RolePattern) bool {
+	re, err := syntax.Parse(p.Name, syntax.Perl)
+	if err != nil {
+		return false
+	}
+
+	samples := regexpSamples(re.Simplify())
+	if len(samples) == 0 {
+		return false
+	}
+
+	for _, s := range samples {
+		if !earlier.Regexp.MatchString(s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// regexpSamples returns a limited set of strings matching the regexp (each optional or repeated part is taken both in its shortest and in a longer form).
+func regexpSamples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return []string{""}
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return nil
+		}
+		samples := []string{string(re.Rune[0])}
+		if last := re.Rune[len(re.Rune)-1]; last != re.Rune[0] && last < 0x80 {
+			samples = append(samples, string(last))
+		}
+		return samples
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"x", "-"}
+	case syntax.OpCapture:
+		return regexpSamples(re.Sub[0])
+	case syntax.OpStar, syntax.OpQuest:
+		return limitSamples(append([]string{""}, regexpSamples(re.Sub[0])...))
+	case syntax.OpPlus:
+		sub := regexpSamples(re.Sub[0])
+		return limitSamples(append(sub, concatSamples(sub, sub)...))
+	case syntax.OpRepeat:
+		sub := regexpSamples(re.Sub[0])
+		samples := []string{""}
+		for i := 0; i < re.Min; i++ {
+			samples = concatSamples(samples, sub)
+		}
+		return samples
+	case syntax.OpConcat:
+		samples := []string{""}
+		for _, sub := range re.Sub {
+			samples = concatSamples(samples, regexpSamples(sub))
+		}
+		return samples
+	case syntax.OpAlternate:
+		samples := []string{}
+		for _, sub := range re.Sub {
+			samples = append(samples, regexpSamples(sub)...)
+		}
+		return limitSamples(samples)
+	default:
+		return nil
+	}
+}
+
+// concatSamples returns all combinations of prefixes and suffixes (limited to maxLintSamples).
+func concatSamples(prefixes []string, suffixes []string) []string {
+	samples := make([]string, 0, len(prefixes)*len(suffixes))
+	for _, p := range prefixes {
+		for _, s := range suffixes {
+			samples = append(samples, p+s)
+		}
+	}
+	return limitSamples(samples)
+}
+
+// limitSamples truncates samples to maxLintSamples.
+func limitSamples(samples []string) []string {
+	if len(samples) > maxLintSamples {
+		return samples[:maxLintSamples]
+	}
+	return samples
+}
@@ -0,0 +1,102 @@
+package querymodifier
+
+import (
+	"regexp/syntax"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLs_Lint(t *testing.T) {
+	content := `version: 2
+deny:
+  namespace: vault, secrets
+roles:
+  admin:
+    labels:
+      namespace: .*
+  team-a:
+    labels:
+      namespace: team-a
+  wildcard:
+    labels:
+      namespace: minio|.*
+  cluster-wide:
+    labels:
+      cluster: .*|eu
+      namespace: team-b
+  vault:
+    labels:
+      namespace: vault, secrets
+  expired:
+    labels:
+      namespace: minio
+    expires: 2020-01-01
+  team-(.+):
+    labels:
+      namespace: $1
+  team-(.+)-admin:
+    labels:
+      namespace: $1-.*
+  (.*):
+    labels:
+      namespace: $1
+`
+	acls, err := NewACLsFromYAML([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []LintWarning{
+		{Role: "admin", Message: "gives full access"},
+		{Role: "cluster-wide", Message: `cluster is effectively not restricted (".*|eu" matches any value)`},
+		{Role: "expired", Message: "expired at 2020-01-01 00:00:00 +0000 UTC"},
+		{Role: "vault", Message: "all values of namespace granted by the role are denied by global deny rules"},
+		{Role: "wildcard", Message: `namespace is effectively not restricted ("minio|.*" matches any value)`},
+		{Role: "wildcard", Message: "effectively gives full access"},
+		{Role: "cluster-wide", Message: "cannot be combined with expired, users with both roles are denied: they restrict different sets of labels"},
+		{Role: "cluster-wide", Message: "cannot be combined with team-a, users with both roles are denied: they restrict different sets of labels"},
+		{Role: "cluster-wide", Message: "cannot be combined with vault, users with both roles are denied: they restrict different sets of labels"},
+		{Role: "cluster-wide", Message: "cannot be combined with wildcard, users with both roles are denied: they restrict different sets of labels"},
+		{Role: "team-(.+)-admin", Message: "pattern is probably shadowed by team-(.+), which is defined earlier"},
+		{Role: "(.*)", Message: "pattern matches any role name"},
+	}
+
+	got := acls.Lint(time.Now())
+	assert.Equal(t, want, got)
+}
+
+func Test_regexpSamples(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{
+			pattern: "team-a",
+			want:    []string{"team-a"},
+		},
+		{
+			pattern: "team-(a|b)",
+			want:    []string{"team-a", "team-b"},
+		},
+		{
+			pattern: "team-[a-z]?",
+			want:    []string{"team-", "team-a", "team-z"},
+		},
+		{
+			pattern: "t.+",
+			want:    []string{"tx", "t-", "txx", "tx-", "t-x", "t--"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			re, err := syntax.Parse(tt.pattern, syntax.Perl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, regexpSamples(re.Simplify()))
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package querymodifier
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// modifyLogQL applies the ACL to all stream selectors of the Loki LogQL query. The query is parsed and serialized by the Loki parser, so that stream selectors are found exactly the way Loki finds them (a hand-written scanner could be fooled by strings, comments or templates). match[] (and match, which is merged with match[] by Loki) values have to be stream selectors.
+func (qm *QueryModifier) modifyLogQL(param string, value string) (string, error) {
+	if param == "match[]" || param == "match" {
+		matchers, err := syntax.ParseMatchers(value, false)
+		if err != nil {
+			return "", fmt.Errorf("%s has to be a stream selector, got %q: %s", param, value, err)
+		}
+
+		matchers, err = qm.modifyLogQLMatchers(matchers)
+		if err != nil {
+			return "", err
+		}
+
+		return syntax.MatchersString(matchers), nil
+	}
+
+	// NOTE: Loki validates the query on its own, while the validation here would reject queries that become valid once the ACL is applied (e.g. {})
+	expr, err := syntax.ParseExprWithoutValidation(value)
+	if err != nil {
+		return "", err
+	}
+
+	expr.Walk(func(e syntax.Expr) {
+		me, ok := e.(*syntax.MatchersExpr)
+		if !ok || err != nil {
+			return
+		}
+		me.Mts, err = qm.modifyLogQLMatchers(me.Mts)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return expr.String(), nil
+}
+
+// modifyLogQLMatchers applies label filters of the ACL to matchers of a single stream selector.
+func (qm *QueryModifier) modifyLogQLMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	filters := make([]metricsql.LabelFilter, 0, len(matchers))
+	for _, m := range matchers {
+		filters = append(filters, metricsql.LabelFilter{
+			Label:      m.Name,
+			Value:      m.Value,
+			IsRegexp:   m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp,
+			IsNegative: m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp,
+		})
+	}
+
+	filters = qm.modifyLabelFilters(filters)
+
+	modified := make([]*labels.Matcher, 0, len(filters))
+	for _, lf := range filters {
+		t := labels.MatchEqual
+		switch {
+		case lf.IsRegexp && lf.IsNegative:
+			t = labels.MatchNotRegexp
+		case lf.IsRegexp:
+			t = labels.MatchRegexp
+		case lf.IsNegative:
+			t = labels.MatchNotEqual
+		}
+
+		m, err := labels.NewMatcher(t, lf.Label, lf.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a matcher for %s: %s", lf.Label, err)
+		}
+		modified = append(modified, m)
+	}
+
+	return modified, nil
+}
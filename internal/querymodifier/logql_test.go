@@ -0,0 +1,230 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryModifier_modifyLogQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACL  string
+		dedup   bool
+		param   string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Stream selector",
+			rawACL: "minio",
+			param:  "query",
+			query:  `{app="nginx",namespace="other"}`,
+			want:   `{app="nginx", namespace="minio"}`,
+		},
+		{
+			name:   "Empty stream selector",
+			rawACL: "minio, stolon",
+			param:  "query",
+			query:  `{}`,
+			want:   `{namespace=~"minio|stolon"}`,
+		},
+		{
+			name:   "Pipeline is left as is",
+			rawACL: "minio",
+			param:  "query",
+			query:  `{app="nginx"} |= "{not a selector}" | json | line_format "{{.msg}}" | label_format x=` + "`{{.y}}`",
+			want:   `{app="nginx", namespace="minio"} |= "{not a selector}" | json | line_format "{{.msg}}" | label_format x="{{.y}}"`,
+		},
+		{
+			name:   "Metric query with multiple selectors",
+			rawACL: "minio, stolon",
+			param:  "query",
+			query:  `sum by (app) (rate({app="nginx"} |~ "err\"or" [5m])) / sum by (app) (count_over_time({ app = "nginx" }[5m]))`,
+			want:   `(sum by (app)(rate({app="nginx", namespace=~"minio|stolon"} |~ "err\"or"[5m])) / sum by (app)(count_over_time({app="nginx", namespace=~"minio|stolon"}[5m])))`,
+		},
+		{
+			name:   "Regexp matchers and raw strings",
+			rawACL: "minio",
+			param:  "query",
+			query:  "{app=~`ng.+\\d`, env!~\"dev|test\", job!=\"x\"}",
+			want:   `{app=~"ng.+\\d", env!~"dev|test", job!="x", namespace="minio"}`,
+		},
+		{
+			name:   "Comment",
+			rawACL: "minio",
+			param:  "query",
+			query:  "{app=\"nginx\"} # {namespace=\"other\"}\n|= \"error\"",
+			want:   `{app="nginx", namespace="minio"} |= "error"`,
+		},
+		{
+			name:   "Deduplication",
+			rawACL: "min.*, stolon",
+			dedup:  true,
+			param:  "query",
+			query:  `{namespace="minio"}`,
+			want:   `{namespace="minio"}`,
+		},
+		{
+			name:   "Series selector",
+			rawACL: "minio",
+			param:  "match[]",
+			query:  ` {app="nginx"} `,
+			want:   `{app="nginx", namespace="minio"}`,
+		},
+		{
+			name:   "Series selector in match",
+			rawACL: "minio",
+			param:  "match",
+			query:  `{namespace="kube-system"}`,
+			want:   `{namespace="minio"}`,
+		},
+		{
+			name:    "match is not a stream selector",
+			rawACL:  "minio",
+			param:   "match",
+			query:   `{app="nginx"} |= "error"`,
+			wantErr: true,
+		},
+		{
+			name:    "match[] is not a stream selector",
+			rawACL:  "minio",
+			param:   "match[]",
+			query:   `{app="nginx"} |= "error"`,
+			wantErr: true,
+		},
+		{
+			name:    "Unterminated string",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `{app="nginx}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unterminated selector",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `{app="nginx"`,
+			wantErr: true,
+		},
+		{
+			name:    "Incorrect matcher",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `{app}`,
+			wantErr: true,
+		},
+		{
+			name:    "Trailing comma",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `{app="nginx",}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:                 acl,
+				EnableDeduplication: tt.dedup,
+				LogQL:               true,
+			}
+
+			got, err := qm.modifyLogQL(tt.param, tt.query)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestQueryModifier_modifyLogQL_allSelectors(t *testing.T) {
+	acl, err := NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qm := QueryModifier{ACL: acl, LogQL: true}
+
+	// Queries, in which braces, quotes and comment signs appear outside of stream selectors
+	queries := []string{
+		"{app=\"a\"} |= `{namespace=\"other\"}` or `}`",
+		`{app="a"} |= "\"{" != "#" |= "}"`,
+		"{app=\"a\"} # {namespace=\"other\"} \"\n|= `#{`",
+		`{app="a"} | label_format x="{{ .y }}{" | line_format "{{ if eq .a \"}\" }}{{ end }}"`,
+		"{app=\"a\", env=`}`} | json y=`{`",
+		`sum by (app) (count_over_time({app="a"}[5m])) / on () group_left count_over_time({namespace="other"} | logfmt [1h])`,
+		`label_replace(rate({namespace=~"other|minio"} |= "x" [5m]), "dst", "$1", "src", "(.*)")`,
+		`{app="a"} |> "<_>{<_>" !> "}"`,
+	}
+
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			got, err := qm.modifyLogQL("query", query)
+			assert.Nil(t, err)
+
+			// The result is checked against the Loki parser, every stream selector has to be restricted
+			expr, err := syntax.ParseExprWithoutValidation(got)
+			if !assert.Nil(t, err, got) {
+				return
+			}
+
+			selectors := 0
+			expr.Walk(func(e syntax.Expr) {
+				me, ok := e.(*syntax.MatchersExpr)
+				if !ok {
+					return
+				}
+				selectors++
+
+				namespaces := []string{}
+				for _, m := range me.Mts {
+					if m.Name == "namespace" {
+						namespaces = append(namespaces, m.String())
+					}
+				}
+				assert.Equal(t, []string{`namespace="minio"`}, namespaces, got)
+			})
+			assert.NotZero(t, selectors)
+		})
+	}
+}
+
+func TestQueryModifier_GetModifiedEncodedURLValues_LogQL(t *testing.T) {
+	acl, err := NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qm := QueryModifier{
+		ACL:          acl,
+		LogQL:        true,
+		StrictPromQL: true,
+	}
+
+	params := url.Values{
+		"query": []string{`count_over_time({app="nginx"}[5m])`},
+		"limit": []string{"100"},
+	}
+
+	want := url.Values{
+		"query": []string{`count_over_time({app="nginx", namespace="minio"}[5m])`},
+		"limit": []string{"100"},
+	}
+
+	got, err := qm.GetModifiedEncodedURLValues(params)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Encode(), got)
+}
@@ -0,0 +1,90 @@
+package querymodifier
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// modifyPromQL parses the value of the parameter with the Prometheus PromQL parser, applies the ACL to all selectors and returns the expression in the PromQL syntax. match[] and extra_filters[] values have to be series selectors. Expression optimizations are not supported by the parser, so they're skipped.
+func (qm *QueryModifier) modifyPromQL(param string, value string) (string, error) {
+	expr, err := parser.ParseExpr(value)
+	if err != nil {
+		return "", err
+	}
+
+	if param == "match[]" || isExtraFilterParam(param) {
+		if _, ok := expr.(*parser.VectorSelector); !ok {
+			return "", fmt.Errorf("%s has to be a series selector, got %s", param, parser.DocumentedType(expr.Type()))
+		}
+	}
+
+	var modifyErr error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok || modifyErr != nil {
+			return nil
+		}
+
+		filters := labelFiltersFromMatchers(vs.LabelMatchers)
+		filters = qm.modifyLabelFilters(filters)
+
+		matchers, err := matchersFromLabelFilters(filters)
+		if err != nil {
+			modifyErr = err
+			return nil
+		}
+		vs.LabelMatchers = matchers
+
+		return nil
+	})
+
+	if modifyErr != nil {
+		return "", modifyErr
+	}
+
+	return expr.String(), nil
+}
+
+// labelFiltersFromMatchers converts PromQL label matchers into metricsql label filters, so that the same rewrite rules apply to both dialects.
+func labelFiltersFromMatchers(matchers []*labels.Matcher) []metricsql.LabelFilter {
+	filters := make([]metricsql.LabelFilter, 0, len(matchers))
+
+	for _, m := range matchers {
+		filters = append(filters, metricsql.LabelFilter{
+			Label:      m.Name,
+			Value:      m.Value,
+			IsRegexp:   m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp,
+			IsNegative: m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp,
+		})
+	}
+
+	return filters
+}
+
+// matchersFromLabelFilters converts metricsql label filters into PromQL label matchers.
+func matchersFromLabelFilters(filters []metricsql.LabelFilter) ([]*labels.Matcher, error) {
+	matchers := make([]*labels.Matcher, 0, len(filters))
+
+	for _, lf := range filters {
+		t := labels.MatchEqual
+		switch {
+		case lf.IsRegexp && lf.IsNegative:
+			t = labels.MatchNotRegexp
+		case lf.IsRegexp:
+			t = labels.MatchRegexp
+		case lf.IsNegative:
+			t = labels.MatchNotEqual
+		}
+
+		m, err := labels.NewMatcher(t, lf.Label, lf.Value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
@@ -0,0 +1,137 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryModifier_modifyPromQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACL  string
+		dedup   bool
+		param   string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Single selector",
+			rawACL: "minio",
+			param:  "query",
+			query:  `request_duration{job="demo", namespace="other"}`,
+			want:   `request_duration{job="demo",namespace="minio"}`,
+		},
+		{
+			name:   "Regexp is appended",
+			rawACL: "minio, stolon",
+			param:  "query",
+			query:  `sum(rate(request_duration{job="demo"}[5m])) / on(job) group_left sum(up)`,
+			want:   `sum(rate(request_duration{job="demo",namespace=~"minio|stolon"}[5m])) / on (job) group_left () sum(up{namespace=~"minio|stolon"})`,
+		},
+		{
+			name:   "Subquery and offset",
+			rawACL: "minio",
+			param:  "query",
+			query:  `max_over_time(up[1h:5m] offset 1d)`,
+			want:   `max_over_time(up{namespace="minio"}[1h:5m] offset 1d)`,
+		},
+		{
+			name:   "Deduplication",
+			rawACL: "min.*",
+			dedup:  true,
+			param:  "query",
+			query:  `up{namespace="minio"}`,
+			want:   `up{namespace="minio"}`,
+		},
+		{
+			name:   "Series selector without a metric name",
+			rawACL: "minio",
+			param:  "match[]",
+			query:  `{__name__=~".+"}`,
+			want:   `{__name__=~".+",namespace="minio"}`,
+		},
+		{
+			name:    "match[] is not a selector",
+			rawACL:  "minio",
+			param:   "match[]",
+			query:   `sum(up)`,
+			wantErr: true,
+		},
+		{
+			name:    "extra_filters[] is not a selector",
+			rawACL:  "minio",
+			param:   "extra_filters[]",
+			query:   `rate(up[5m])`,
+			wantErr: true,
+		},
+		{
+			name:    "MetricsQL extension",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `rate(up)`,
+			wantErr: true,
+		},
+		{
+			name:    "MetricsQL function",
+			rawACL:  "minio",
+			param:   "query",
+			query:   `range_median(up[5m])`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:                 acl,
+				EnableDeduplication: tt.dedup,
+				StrictPromQL:        true,
+			}
+
+			got, err := qm.modifyPromQL(tt.param, tt.query)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestQueryModifier_GetModifiedEncodedURLValues_StrictPromQL(t *testing.T) {
+	acl, err := NewACL("minio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qm := QueryModifier{
+		ACL:          acl,
+		StrictPromQL: true,
+	}
+
+	params := url.Values{
+		"query": []string{`rate(request_duration{namespace="other"}[5m])`},
+		"time":  []string{"1"},
+	}
+
+	want := url.Values{
+		"query": []string{`rate(request_duration{namespace="minio"}[5m])`},
+		"time":  []string{"1"},
+	}
+
+	got, err := qm.GetModifiedEncodedURLValues(params)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Encode(), got)
+
+	_, err = qm.GetModifiedEncodedURLValues(url.Values{"query": []string{`up default 0`}})
+	assert.NotNil(t, err)
+}
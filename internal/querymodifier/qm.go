@@ -8,39 +8,77 @@ import (
 	"github.com/VictoriaMetrics/metricsql"
 )
 
-// QueryModifier is used for modifying PromQL / MetricsQL requests. The exact changes are determined by an ACL and further tuned by deduplication and expression optimizations.
+// DefaultExprParams lists GET/POST parameters containing metric expressions, which are rewritten unless QueryModifier.ExprParams is set
+var DefaultExprParams = []string{"query", "match[]"}
+
+// ExtraFiltersParam is the VictoriaMetrics parameter used for passing label filters of an ACL in QueryModifier.ExtraFilters mode
+const ExtraFiltersParam = "extra_filters[]"
+
+// extraLabelParam is the VictoriaMetrics parameter applying an extra label filter (name=value) on the server side
+const extraLabelParam = "extra_label"
+
+// ExtraFilterParams lists VictoriaMetrics parameters applying extra label filters on the server side. Multiple extra_filters[] are combined with "or", so client-supplied values could widen the scope of an ACL unless they're rewritten or stripped (see RewriteClientExtraFilters).
+var ExtraFilterParams = []string{extraLabelParam, "extra_filters", ExtraFiltersParam}
+
+// QueryModifier is used for modifying PromQL / MetricsQL / LogQL requests. The exact changes are determined by an ACL and further tuned by deduplication and expression optimizations.
 type QueryModifier struct {
 	ACL                 ACL
 	EnableDeduplication bool
 	OptimizeExpressions bool
+	// ExprParams lists parameters to rewrite, DefaultExprParams are used if empty
+	ExprParams []string
+	// ExtraFilters makes expressions to be left untouched, label filters of the ACL are supposed to be passed to VictoriaMetrics through extra_filters[] instead (see ACL.ExtraFilter)
+	ExtraFilters bool
+	// RewriteClientExtraFilters makes client-supplied extra_filters[] to be rewritten like other selectors and extra_label to be validated, otherwise they're stripped
+	RewriteClientExtraFilters bool
+	// StrictPromQL makes expressions to be parsed and rewritten with the Prometheus PromQL parser, so that MetricsQL extensions are rejected and the resulting expressions are valid PromQL
+	StrictPromQL bool
+	// LogQL makes expressions to be treated as Loki LogQL queries, only stream selectors are rewritten
+	LogQL bool
+}
+
+// isExprParam returns true if the parameter contains a metric expression to rewrite.
+func (qm *QueryModifier) isExprParam(name string) bool {
+	exprParams := qm.ExprParams
+	if len(exprParams) == 0 {
+		exprParams = DefaultExprParams
+	}
+
+	for _, p := range exprParams {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
 }
 
-// GetModifiedEncodedURLValues rewrites GET/POST "query" and "match" parameters to filter out metrics.
+// GetModifiedEncodedURLValues rewrites GET/POST parameters containing metric expressions ("query" and "match[]" by default, see ExprParams) to filter out metrics. Client-supplied extra filters (extra_label, extra_filters[]) are either stripped or rewritten (see RewriteClientExtraFilters).
 func (qm *QueryModifier) GetModifiedEncodedURLValues(params url.Values) (string, error) {
 	newParams := url.Values{}
 
-	if qm.ACL.RawACL == "" || string(qm.ACL.LabelFilter.AppendString(nil)) == "" {
+	if len(qm.ACL.RawACLs) == 0 || len(qm.ACL.LabelFilters) == 0 {
 		return "", fmt.Errorf("ACL cannot be empty")
 	}
 
 	for k, vv := range params {
-		switch k {
-		case "query", "match[]":
+		switch {
+		case isExtraFilterParam(k) && !qm.RewriteClientExtraFilters:
+			continue
+		case k == extraLabelParam:
 			for _, v := range vv {
-				{
-					expr, err := metricsql.Parse(v)
-					if err != nil {
-						return "", err
-					}
-
-					expr = qm.modifyMetricExpr(expr)
-					if qm.OptimizeExpressions {
-						expr = metricsql.Optimize(expr)
-					}
-
-					newVal := string(expr.AppendString(nil))
-					newParams.Add(k, newVal)
+				if err := validateExtraLabel(v); err != nil {
+					return "", err
+				}
+				newParams.Add(k, v)
+			}
+		case isExtraFilterParam(k), qm.isExprParam(k) && !qm.ExtraFilters:
+			for _, v := range vv {
+				newVal, err := qm.modifyExpr(k, v)
+				if err != nil {
+					return "", err
 				}
+				newParams.Add(k, newVal)
 			}
 		default:
 			for _, v := range vv {
@@ -52,7 +90,51 @@ func (qm *QueryModifier) GetModifiedEncodedURLValues(params url.Values) (string,
 	return newParams.Encode(), nil
 }
 
-// modifyMetricExpr walks through the query and modifies only metricsql.Expr based on the supplied acl with label filter.
+// modifyExpr returns the metric expression from the parameter modified according to the ACL.
+func (qm *QueryModifier) modifyExpr(param string, value string) (string, error) {
+	if qm.LogQL {
+		return qm.modifyLogQL(param, value)
+	}
+
+	if qm.StrictPromQL {
+		return qm.modifyPromQL(param, value)
+	}
+
+	expr, err := metricsql.Parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	expr = qm.modifyMetricExpr(expr)
+	if qm.OptimizeExpressions {
+		expr = metricsql.Optimize(expr)
+	}
+
+	return string(expr.AppendString(nil)), nil
+}
+
+// validateExtraLabel returns an error if the value of extra_label is not in the form of name=value. The filter can only narrow down the results, so it doesn't need to be rewritten.
+func validateExtraLabel(value string) error {
+	name, _, ok := strings.Cut(value, "=")
+	if !ok || !labelNameRe.MatchString(name) {
+		return fmt.Errorf("incorrect extra_label %q, expected format: name=value", value)
+	}
+
+	return nil
+}
+
+// isExtraFilterParam returns true if the parameter applies extra label filters in VictoriaMetrics.
+func isExtraFilterParam(name string) bool {
+	for _, p := range ExtraFilterParams {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// modifyMetricExpr walks through the query and modifies only metricsql.Expr based on the supplied acl with label filters. Each label filter of the ACL is applied independently, so deduplication for one label doesn't affect the others.
 func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr) metricsql.Expr {
 	newExpr := metricsql.Clone(expr)
 
@@ -60,13 +142,7 @@ func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr) metricsql.Expr {
 	// to say which label filter to add
 	modifyLabelFilter := func(expr metricsql.Expr) {
 		if me, ok := expr.(*metricsql.MetricExpr); ok {
-			if qm.ACL.LabelFilter.IsRegexp {
-				if !qm.EnableDeduplication || !qm.shouldNotBeModified(me.LabelFilters) {
-					me.LabelFilters = appendOrMergeRegexpLF(me.LabelFilters, qm.ACL.LabelFilter)
-				}
-			} else {
-				me.LabelFilters = replaceLFByName(me.LabelFilters, qm.ACL.LabelFilter)
-			}
+			me.LabelFilters = qm.modifyLabelFilters(me.LabelFilters)
 		}
 	}
 
@@ -76,9 +152,24 @@ func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr) metricsql.Expr {
 	return newExpr
 }
 
+// modifyLabelFilters applies label filters of the ACL to label filters of a single selector.
+func (qm *QueryModifier) modifyLabelFilters(filters []metricsql.LabelFilter) []metricsql.LabelFilter {
+	for _, lf := range qm.ACL.LabelFilters {
+		if lf.IsRegexp {
+			if !qm.EnableDeduplication || !qm.shouldNotBeModified(filters, lf) {
+				filters = appendOrMergeRegexpLF(filters, lf)
+			}
+		} else {
+			filters = replaceLFByName(filters, lf)
+		}
+	}
+
+	return filters
+}
+
 // TODO: simplify description
-// shouldNotBeModified helps to understand whether the original label filters have to be modified. The function returns false if any of the original filters do not match expectations described further. It returns true if [the list of original filters contains either a fake positive regexp (no special symbols, e.g. namespace=~"kube-system") or a non-regexp filter] and [acl.LabelFilter is a matching positive regexp]. Also, if original filter is a subfilter of the new filter or has the same value; if acl gives full access. Target label is taken from the acl.LabelFilter.
-func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter) bool {
+// shouldNotBeModified helps to understand whether the original label filters have to be modified. The function returns false if any of the original filters do not match expectations described further. It returns true if [the list of original filters contains either a fake positive regexp (no special symbols, e.g. namespace=~"kube-system") or a non-regexp filter] and [newLF is a matching positive regexp]. Also, if original filter is a subfilter of the new filter or has the same value; if acl gives full access. Target label is taken from newLF, which is expected to be one of the acl.LabelFilters.
+func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter, newLF metricsql.LabelFilter) bool {
 	if qm.ACL.Fullaccess {
 		return true
 	}
@@ -87,8 +178,7 @@ func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter) bo
 	seenUnmodified := 0
 
 	// TODO: move to a map? Might not be worth doing as filters of the same type are unlikely
-	rawSubACLs := strings.Split(qm.ACL.RawACL, ", ")
-	newLF := qm.ACL.LabelFilter
+	rawSubACLs := strings.Split(qm.ACL.RawACLs[newLF.Label], ", ")
 
 	for _, filter := range filters {
 		// For filter, only positive regexps and non-regexps considered, for newLF - positive regexps.
@@ -109,6 +199,10 @@ func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter) bo
 			// Target: both are positive regexps, filter is a subfilter of the newLF or has the same value
 			if filter.IsRegexp {
 				for _, rawSubACL := range rawSubACLs {
+					// Exclusions (!value) are not grants, so they cannot make a filter a subfilter
+					if strings.HasPrefix(rawSubACL, "!") {
+						continue
+					}
 					if filter.Value == rawSubACL {
 						seenUnmodified++
 						continue
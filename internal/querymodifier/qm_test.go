@@ -78,6 +78,141 @@ func TestQueryModifier_GetModifiedEncodedURLValues(t *testing.T) {
 		assert.Equal(t, want, got)
 	})
 
+	t.Run("Custom expression parameters", func(t *testing.T) {
+		query := `request_duration{job="demo", namespace="other"}`
+
+		params := url.Values{
+			"query":   []string{query},
+			"match[]": []string{query},
+		}
+
+		newParams := url.Values{
+			"query":   []string{query},
+			"match[]": []string{`request_duration{job="demo", namespace="minio"}`},
+		}
+
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{
+			ACL:        acl,
+			ExprParams: []string{"match[]"},
+		}
+		want := newParams.Encode()
+		got, err := qm.GetModifiedEncodedURLValues(params)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Client-supplied extra filters are stripped", func(t *testing.T) {
+		params := url.Values{
+			"query":           []string{`up`},
+			"extra_label":     []string{"namespace=kube-system"},
+			"extra_filters":   []string{`{namespace="kube-system"}`},
+			"extra_filters[]": []string{`{namespace="kube-system"}`},
+		}
+
+		newParams := url.Values{
+			"query": []string{`up{namespace="minio"}`},
+		}
+
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{
+			ACL: acl,
+		}
+		want := newParams.Encode()
+		got, err := qm.GetModifiedEncodedURLValues(params)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+
+		// Label filters of the ACL are passed separately in extra-filters mode
+		qm.ExtraFilters = true
+		want = url.Values{"query": []string{`up`}}.Encode()
+		got, err = qm.GetModifiedEncodedURLValues(params)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Client-supplied extra filters are rewritten", func(t *testing.T) {
+		params := url.Values{
+			"query":           []string{`up`},
+			"extra_label":     []string{"job=node"},
+			"extra_filters[]": []string{`{namespace="kube-system"}`, `{job="node"}`},
+		}
+
+		newParams := url.Values{
+			"query":           []string{`up{namespace="minio"}`},
+			"extra_label":     []string{"job=node"},
+			"extra_filters[]": []string{`{namespace="minio"}`, `{job="node", namespace="minio"}`},
+		}
+
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{
+			ACL:                       acl,
+			RewriteClientExtraFilters: true,
+		}
+		want := newParams.Encode()
+		got, err := qm.GetModifiedEncodedURLValues(params)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Incorrect extra_label", func(t *testing.T) {
+		params := url.Values{
+			"query":       []string{`up`},
+			"extra_label": []string{"job"},
+		}
+
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{
+			ACL:                       acl,
+			RewriteClientExtraFilters: true,
+		}
+		_, err = qm.GetModifiedEncodedURLValues(params)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Extra filters mode", func(t *testing.T) {
+		query := `sum(rate(request_duration{namespace="other"}[5m]))`
+
+		params := url.Values{
+			"query":           []string{query},
+			"extra_filters[]": []string{`{namespace=~".*"}`},
+		}
+
+		newParams := url.Values{
+			"query": []string{query},
+		}
+
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{
+			ACL:          acl,
+			ExtraFilters: true,
+		}
+		want := newParams.Encode()
+		got, err := qm.GetModifiedEncodedURLValues(params)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
 	t.Run("Deduplicate", func(t *testing.T) {
 		query := `request_duration{job="demo", namespace=~"minio"}`
 
@@ -171,36 +306,80 @@ func TestQueryModifier_GetModifiedEncodedURLValues(t *testing.T) {
 func TestQueryModifier_modifyMetricExpr(t *testing.T) {
 	newACLPlain := ACL{
 		Fullaccess: false,
-		LabelFilter: metricsql.LabelFilter{
-			Label:      "namespace",
-			Value:      "default",
-			IsRegexp:   false,
-			IsNegative: false,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "default",
+				IsRegexp:   false,
+				IsNegative: false,
+			},
 		},
-		RawACL: "default",
+		RawACLs: map[string]string{"namespace": "default"},
 	}
 
 	newACLPositiveRegexp := ACL{
 		Fullaccess: false,
-		LabelFilter: metricsql.LabelFilter{
-			Label:      "namespace",
-			Value:      "min.*|stolon",
-			IsRegexp:   true,
-			IsNegative: false,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "min.*|stolon",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
 		},
-		RawACL: "min.*, stolon",
+		RawACLs: map[string]string{"namespace": "min.*, stolon"},
 	}
 
-	// Technically, it's not really possible to create such ACL, but better to keep an eye on it anyway
+	// Produced by exclusions (!min.*, !stolon)
 	newACLNegativeRegexp := ACL{
 		Fullaccess: false,
-		LabelFilter: metricsql.LabelFilter{
-			Label:      "namespace",
-			Value:      "min.*|stolon",
-			IsRegexp:   true,
-			IsNegative: true,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "min.*|stolon",
+				IsRegexp:   true,
+				IsNegative: true,
+			},
+		},
+		RawACLs: map[string]string{"namespace": ".*, !min.*, !stolon"},
+	}
+
+	newACLGrantsAndExclusions := ACL{
+		Fullaccess: false,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "team-.*",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+			{
+				Label:      "namespace",
+				Value:      "team-secret",
+				IsRegexp:   true,
+				IsNegative: true,
+			},
+		},
+		RawACLs: map[string]string{"namespace": "team-.*, !team-secret"},
+	}
+
+	newACLMultiLabel := ACL{
+		Fullaccess: false,
+		LabelFilters: []metricsql.LabelFilter{
+			{
+				Label:      "cluster",
+				Value:      "eu-.*",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+			{
+				Label:      "namespace",
+				Value:      "default",
+				IsRegexp:   false,
+				IsNegative: false,
+			},
 		},
-		RawACL: "min.*, stolon",
+		RawACLs: map[string]string{"cluster": "eu-.*", "namespace": "default"},
 	}
 
 	tests := []struct {
@@ -310,6 +489,50 @@ func TestQueryModifier_modifyMetricExpr(t *testing.T) {
 			acl:                 newACLPositiveRegexp,
 			want:                `request_duration{namespace=~"min.*|stolon"}`,
 		},
+		// Multiple labels
+		{
+			name:                "Multiple labels, no matching labels; append all",
+			query:               `request_duration{job="demo"}`,
+			EnableDeduplication: true,
+			acl:                 newACLMultiLabel,
+			want:                `request_duration{job="demo", cluster=~"eu-.*", namespace="default"}`,
+		},
+		{
+			name:                "Multiple labels, one of the filters matches policy (deduplicated), the other one is replaced",
+			query:               `request_duration{cluster="eu-1", namespace="other"}`,
+			EnableDeduplication: true,
+			acl:                 newACLMultiLabel,
+			want:                `request_duration{cluster="eu-1", namespace="default"}`,
+		},
+		{
+			name:                "Multiple labels, deduplication is disabled; append and replace",
+			query:               `request_duration{cluster="eu-1", namespace="other"}`,
+			EnableDeduplication: false,
+			acl:                 newACLMultiLabel,
+			want:                `request_duration{cluster="eu-1", cluster=~"eu-.*", namespace="default"}`,
+		},
+		// Grants and exclusions
+		{
+			name:                "Grants and exclusions, no matching labels; append both",
+			query:               `request_duration{job="demo"}`,
+			EnableDeduplication: true,
+			acl:                 newACLGrantsAndExclusions,
+			want:                `request_duration{job="demo", namespace=~"team-.*", namespace!~"team-secret"}`,
+		},
+		{
+			name:                "Grants and exclusions, original filter matches the grant (deduplicated); exclusion is still appended",
+			query:               `request_duration{namespace="team-secret"}`,
+			EnableDeduplication: true,
+			acl:                 newACLGrantsAndExclusions,
+			want:                `request_duration{namespace="team-secret", namespace!~"team-secret"}`,
+		},
+		{
+			name:                "Grants and exclusions, original negative regexp; merge with the exclusion",
+			query:               `request_duration{namespace!~"team-a"}`,
+			EnableDeduplication: true,
+			acl:                 newACLGrantsAndExclusions,
+			want:                `request_duration{namespace!~"team-a|team-secret", namespace=~"team-.*"}`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -480,15 +703,15 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 			}
 
 			if tt.isNegativeACL {
-				// 1. NewACL cannot produce negative ACLs
+				// 1. Test data contains only grants, exclusions are tested separately
 				// 2. Cannot convert non-regexp to a negative regexp
-				if qm.ACL.LabelFilter.IsNegative || !qm.ACL.LabelFilter.IsRegexp {
+				if qm.ACL.LabelFilters[0].IsNegative || !qm.ACL.LabelFilters[0].IsRegexp {
 					t.Fatal("Incorrect test data")
 				}
-				qm.ACL.LabelFilter.IsNegative = tt.isNegativeACL
+				qm.ACL.LabelFilters[0].IsNegative = tt.isNegativeACL
 			}
 
-			got := qm.shouldNotBeModified(tt.filters)
+			got := qm.shouldNotBeModified(tt.filters, qm.ACL.LabelFilters[0])
 			assert.Equal(t, tt.want, got, tt.comment)
 		})
 	}
@@ -515,7 +738,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should be modified, because the original filters contain regexp filters, which are not subfilters of the new filter")
 	})
 
@@ -541,7 +764,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should be modified, because the original filters are regexps, one of which is not a subfilter of the new filter")
 	})
 
@@ -567,7 +790,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should be modified, because amongst the original filters with the same label (regexp, non-regexp) there is a regexp, which is not a subfilter of the new filter")
 	})
 
@@ -580,7 +803,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filtersNonRegexp)
+		got := qm.shouldNotBeModified(filtersNonRegexp, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is not a regexp and the new filter is a matching positive regexp")
 	})
 
@@ -600,7 +823,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is a fake positive regexp (it doesn't contain any special characters, should have been a non-regexp expression, e.g. namespace=~\"kube-system\") and the new filter is a matching positive regexp")
 	})
 
@@ -620,7 +843,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is a regexp subfilter of the ACL")
 	})
 
@@ -646,7 +869,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filters are subfilters of the new filter")
 	})
 
@@ -672,7 +895,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter contains the same non-regexp label filter multiple times and the new filter matches")
 	})
 
@@ -698,7 +921,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because original filters contain a mix of a fake regexp and a non-regexp filters (basically, they're equal in results)")
 	})
 
@@ -718,10 +941,39 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters)
+		got := qm.shouldNotBeModified(filters, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because original filter and the new filter contain the same regexp")
 	})
 
+	t.Run("Multiple labels, only filters with the target label are considered", func(t *testing.T) {
+		filters := []metricsql.LabelFilter{
+			{
+				Label:      "cluster",
+				Value:      "eu-1",
+				IsRegexp:   false,
+				IsNegative: false,
+			},
+			{
+				Label:      "namespace",
+				Value:      "other",
+				IsRegexp:   false,
+				IsNegative: false,
+			},
+		}
+
+		acl, err := NewMultiLabelACL(map[string]string{"cluster": "eu-.*", "namespace": "min.*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		qm := QueryModifier{ACL: acl}
+
+		got := qm.shouldNotBeModified(filters, acl.LabelFilters[0])
+		assert.True(t, got, "Filters with the cluster label should NOT be modified, because the original filter matches the cluster policy")
+
+		got = qm.shouldNotBeModified(filters, acl.LabelFilters[1])
+		assert.False(t, got, "Filters with the namespace label should be modified, because the original filter doesn't match the namespace policy")
+	})
+
 	t.Run("The new filter gives full access", func(t *testing.T) {
 		qm, err := NewQueryModifier(".*")
 		if err != nil {
@@ -729,7 +981,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filtersNoTargetLabel)
+		got := qm.shouldNotBeModified(filtersNoTargetLabel, qm.ACL.LabelFilters[0])
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the new filter gives full access")
 	})
 }
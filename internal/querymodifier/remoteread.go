@@ -0,0 +1,80 @@
+package querymodifier
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ModifyReadRequest applies the ACL to matchers of every query in a Prometheus remote read request. The same rules (including deduplication) are used as for selectors in metric expressions.
+func (qm *QueryModifier) ModifyReadRequest(req *prompb.ReadRequest) error {
+	if len(qm.ACL.RawACLs) == 0 || len(qm.ACL.LabelFilters) == 0 {
+		return fmt.Errorf("ACL cannot be empty")
+	}
+
+	for _, q := range req.Queries {
+		filters, err := labelFiltersFromPrompbMatchers(q.Matchers)
+		if err != nil {
+			return err
+		}
+
+		q.Matchers = prompbMatchersFromLabelFilters(qm.modifyLabelFilters(filters))
+	}
+
+	return nil
+}
+
+// labelFiltersFromPrompbMatchers converts remote read matchers into metricsql label filters.
+func labelFiltersFromPrompbMatchers(matchers []*prompb.LabelMatcher) ([]metricsql.LabelFilter, error) {
+	filters := make([]metricsql.LabelFilter, 0, len(matchers))
+
+	for _, m := range matchers {
+		lf := metricsql.LabelFilter{
+			Label: m.Name,
+			Value: m.Value,
+		}
+
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+		case prompb.LabelMatcher_NEQ:
+			lf.IsNegative = true
+		case prompb.LabelMatcher_RE:
+			lf.IsRegexp = true
+		case prompb.LabelMatcher_NRE:
+			lf.IsRegexp = true
+			lf.IsNegative = true
+		default:
+			return nil, fmt.Errorf("unknown matcher type %s", m.Type)
+		}
+
+		filters = append(filters, lf)
+	}
+
+	return filters, nil
+}
+
+// prompbMatchersFromLabelFilters converts metricsql label filters into remote read matchers.
+func prompbMatchersFromLabelFilters(filters []metricsql.LabelFilter) []*prompb.LabelMatcher {
+	matchers := make([]*prompb.LabelMatcher, 0, len(filters))
+
+	for _, lf := range filters {
+		t := prompb.LabelMatcher_EQ
+		switch {
+		case lf.IsRegexp && lf.IsNegative:
+			t = prompb.LabelMatcher_NRE
+		case lf.IsRegexp:
+			t = prompb.LabelMatcher_RE
+		case lf.IsNegative:
+			t = prompb.LabelMatcher_NEQ
+		}
+
+		matchers = append(matchers, &prompb.LabelMatcher{
+			Type:  t,
+			Name:  lf.Label,
+			Value: lf.Value,
+		})
+	}
+
+	return matchers
+}
@@ -0,0 +1,108 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryModifier_ModifyReadRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawACL string
+		dedup  bool
+		in     []*prompb.LabelMatcher
+		want   []*prompb.LabelMatcher
+	}{
+		{
+			name:   "Non-regexp ACL replaces matchers",
+			rawACL: "minio",
+			in: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "kube-system"},
+			},
+			want: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "minio"},
+			},
+		},
+		{
+			name:   "Regexp ACL is appended",
+			rawACL: "minio, stolon",
+			in: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+			},
+			want: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+				{Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "minio|stolon"},
+			},
+		},
+		{
+			name:   "Deduplication",
+			rawACL: "min.*",
+			dedup:  true,
+			in: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "minio"},
+			},
+			want: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "minio"},
+			},
+		},
+		{
+			name:   "Negative regexps are merged",
+			rawACL: "!kube-system",
+			in: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_NRE, Name: "namespace", Value: "vault"},
+			},
+			want: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_NRE, Name: "namespace", Value: "vault|kube-system"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:                 acl,
+				EnableDeduplication: tt.dedup,
+			}
+
+			req := &prompb.ReadRequest{
+				Queries: []*prompb.Query{
+					{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: tt.in},
+					{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: tt.in},
+				},
+			}
+
+			err = qm.ModifyReadRequest(req)
+			assert.Nil(t, err)
+			for _, q := range req.Queries {
+				assert.Equal(t, tt.want, q.Matchers)
+			}
+		})
+	}
+
+	t.Run("Unknown matcher type", func(t *testing.T) {
+		acl, err := NewACL("minio")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qm := QueryModifier{ACL: acl}
+		req := &prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{Matchers: []*prompb.LabelMatcher{{Type: 42, Name: "namespace", Value: "minio"}}},
+			},
+		}
+
+		assert.NotNil(t, qm.ModifyReadRequest(req))
+	})
+}
@@ -0,0 +1,146 @@
+package querymodifier
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RolePatternSymbols is used to determine whether a role name in acl.yaml is a pattern. Dots are excluded, so that role names like team.admin are still treated literally.
+const RolePatternSymbols = `+*?^$()[]{}|\`
+
+// rolePatternForbiddenSymbols cannot appear in captured values, as they would be interpreted by the rule syntax (separator, exclusion) after expansion
+const rolePatternForbiddenSymbols = ",! \t\r\n"
+
+// RolePattern stores a role definition, which applies to all roles matching the pattern. Rules may refer to capture groups of the pattern ($1, ${name}).
+type RolePattern struct {
+	// Name is the pattern as it's defined in acl.yaml
+	Name string
+	// Regexp is the anchored version of the pattern
+	Regexp *regexp.Regexp
+	// RawACLs contains rule templates per label
+	RawACLs map[string]string
+	// Template contains per-role settings, which are copied to every ACL generated from the pattern. Its label filters are built from the templates with placeholder values, thus they're used only for validation.
+	Template ACL
+}
+
+// isRolePattern returns true if the role name should be treated as a pattern.
+func isRolePattern(role string) bool {
+	return strings.ContainsAny(role, RolePatternSymbols)
+}
+
+// NewRolePattern returns a RolePattern. Rule templates are validated by expanding them with placeholder values.
+func NewRolePattern(name string, rawACLs map[string]string) (RolePattern, error) {
+	// Same as with label filters, patterns are fully anchored
+	re, err := regexp.Compile("^(?:" + name + ")$")
+	if err != nil {
+		return RolePattern{}, fmt.Errorf("incorrect role pattern: %s", err)
+	}
+
+	p := RolePattern{
+		Name:    name,
+		Regexp:  re,
+		RawACLs: rawACLs,
+	}
+
+	placeholders := make([]string, re.NumSubexp()+1)
+	for i := range placeholders {
+		placeholders[i] = "placeholder"
+	}
+
+	expanded, err := p.expand(placeholders, nil)
+	if err != nil {
+		return RolePattern{}, err
+	}
+
+	template, err := NewMultiLabelACL(expanded)
+	if err != nil {
+		return RolePattern{}, err
+	}
+	p.Template = template
+
+	return p, nil
+}
+
+// expand returns rules with references to capture groups replaced with the respective values from submatches. Values are escaped, so that a role name cannot inject a regular expression into the rules. Values of referenced groups, which are empty or contain separators, exclusions or whitespace, are rejected, as they would change the meaning of the rules (e.g. team-!kube-viewer would turn into an exclusion). Groups that are not referenced by the rules or, according to skipped, didn't participate in the match are not checked.
+func (p RolePattern) expand(submatches []string, skipped []bool) (map[string]string, error) {
+	referenced := p.referencedGroups()
+
+	match := make([]int, 0, 2*len(submatches))
+	src := ""
+	for i, s := range submatches {
+		isSkipped := i < len(skipped) && skipped[i]
+		if referenced[i] && !isSkipped && (s == "" || strings.ContainsAny(s, rolePatternForbiddenSymbols)) {
+			return nil, fmt.Errorf("incorrect value %q of capture group %d, it must be non-empty and cannot contain commas, exclamation marks or whitespace", s, i)
+		}
+
+		escaped := regexp.QuoteMeta(s)
+		match = append(match, len(src), len(src)+len(escaped))
+		src += escaped
+	}
+
+	rawACLs := make(map[string]string, len(p.RawACLs))
+	for label, rawACL := range p.RawACLs {
+		rawACLs[label] = string(p.Regexp.ExpandString(nil, rawACL, src, match))
+	}
+
+	return rawACLs, nil
+}
+
+// referencedGroups returns which capture groups are referenced by the rules ($1, ${name}, etc.). A group is considered referenced if its value changes the expanded rules.
+func (p RolePattern) referencedGroups() []bool {
+	n := p.Regexp.NumSubexp() + 1
+	referenced := make([]bool, n)
+
+	// All groups are empty in the baseline, then each group is set to "x" in turn
+	const src = "x"
+	match := make([]int, 2*n)
+
+	for _, rawACL := range p.RawACLs {
+		baseline := string(p.Regexp.ExpandString(nil, rawACL, src, match))
+		for i := range referenced {
+			match[2*i+1] = len(src)
+			if string(p.Regexp.ExpandString(nil, rawACL, src, match)) != baseline {
+				referenced[i] = true
+			}
+			match[2*i+1] = 0
+		}
+	}
+
+	return referenced
+}
+
+// apply returns an ACL for the role if it matches the pattern. The second value is false if the role doesn't match.
+func (p RolePattern) apply(role string) (ACL, bool, error) {
+	loc := p.Regexp.FindStringSubmatchIndex(role)
+	if loc == nil {
+		return ACL{}, false, nil
+	}
+
+	submatches := make([]string, len(loc)/2)
+	skipped := make([]bool, len(loc)/2)
+	for i := range submatches {
+		if loc[2*i] < 0 {
+			skipped[i] = true
+			continue
+		}
+		submatches[i] = role[loc[2*i]:loc[2*i+1]]
+	}
+
+	rawACLs, err := p.expand(submatches, skipped)
+	if err != nil {
+		return ACL{}, true, fmt.Errorf("%s role (matched %s): %w", role, p.Name, err)
+	}
+
+	expanded, err := NewMultiLabelACL(rawACLs)
+	if err != nil {
+		return ACL{}, true, fmt.Errorf("%s role (matched %s): %w", role, p.Name, err)
+	}
+
+	acl := p.Template
+	acl.Fullaccess = expanded.Fullaccess
+	acl.LabelFilters = expanded.LabelFilters
+	acl.RawACLs = expanded.RawACLs
+
+	return acl, true, nil
+}
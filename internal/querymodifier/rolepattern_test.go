@@ -0,0 +1,168 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isRolePattern(t *testing.T) {
+	assert.False(t, isRolePattern("grafana-admin"))
+	assert.False(t, isRolePattern("team.admin"))
+	assert.True(t, isRolePattern("team-(.+)-viewer"))
+	assert.True(t, isRolePattern("team-.*"))
+}
+
+func Test_NewRolePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		rawACLs map[string]string
+		fail    bool
+	}{
+		{
+			name:    "Capture group",
+			pattern: "team-(.+)-viewer",
+			rawACLs: map[string]string{"namespace": "$1-prod, $1-stage"},
+		},
+		{
+			name:    "Named capture group and multiple labels",
+			pattern: "(?P<team>[a-z]+)-(?P<env>prod|stage)",
+			rawACLs: map[string]string{"namespace": "${team}", "env": "${env}"},
+		},
+		{
+			name:    "Incorrect pattern",
+			pattern: "team-(.+",
+			rawACLs: map[string]string{"namespace": "$1"},
+			fail:    true,
+		},
+		{
+			name:    "Incorrect rules",
+			pattern: "team-(.+)",
+			rawACLs: map[string]string{"namespace": "$1-["},
+			fail:    true,
+		},
+		{
+			name:    "Incorrect label name",
+			pattern: "team-(.+)",
+			rawACLs: map[string]string{"name-space": "$1"},
+			fail:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRolePattern(tt.pattern, tt.rawACLs)
+			if tt.fail {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestRolePattern_apply(t *testing.T) {
+	p, err := NewRolePattern("team-(.+)-viewer", map[string]string{"namespace": "$1-prod, $1-stage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Matching role", func(t *testing.T) {
+		want := ACL{
+			Fullaccess: false,
+			LabelFilters: []metricsql.LabelFilter{
+				{
+					Label:      "namespace",
+					Value:      "payments-prod|payments-stage",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+			},
+			RawACLs: map[string]string{"namespace": "payments-prod, payments-stage"},
+		}
+
+		got, matched, err := p.apply("team-payments-viewer")
+		assert.True(t, matched)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Pattern is anchored", func(t *testing.T) {
+		_, matched, err := p.apply("team-payments-viewer-admin")
+		assert.False(t, matched)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Captured values are escaped", func(t *testing.T) {
+		got, matched, err := p.apply("team-.*-viewer")
+		assert.True(t, matched)
+		assert.Nil(t, err)
+		assert.False(t, got.Fullaccess)
+		assert.Equal(t, `namespace=~"\\.\\*-prod|\\.\\*-stage"`, got.LabelFiltersString())
+	})
+
+	t.Run("Captured values cannot add exclusions", func(t *testing.T) {
+		_, matched, err := p.apply("team-!kube-viewer")
+		assert.True(t, matched)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Captured values cannot add rules", func(t *testing.T) {
+		_, matched, err := p.apply("team-x,kube-system,y-viewer")
+		assert.True(t, matched)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Captured values cannot contain whitespace", func(t *testing.T) {
+		_, matched, err := p.apply("team-x kube-viewer")
+		assert.True(t, matched)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Captured values cannot be empty", func(t *testing.T) {
+		p, err := NewRolePattern("team-(a*)-viewer", map[string]string{"namespace": "$1-ns"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, matched, err := p.apply("team--viewer")
+		assert.True(t, matched)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Optional groups may not participate in the match", func(t *testing.T) {
+		p, err := NewRolePattern("team-(.+)-viewer(-ro)?", map[string]string{"namespace": "$1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, matched, err := p.apply("team-a-viewer")
+		assert.True(t, matched)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace="a"`, got.LabelFiltersString())
+	})
+
+	t.Run("Groups not referenced by the rules are not checked", func(t *testing.T) {
+		p, err := NewRolePattern("team-([a-z]+)-(.*)", map[string]string{"namespace": "${1}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, matched, err := p.apply("team-a-viewer, admin")
+		assert.True(t, matched)
+		assert.Nil(t, err)
+		assert.Equal(t, `namespace="a"`, got.LabelFiltersString())
+	})
+
+	t.Run("Per-role settings are copied from the template", func(t *testing.T) {
+		p := p
+		p.Template.AllowedEndpoints = []string{"/api/v1/query"}
+
+		got, matched, err := p.apply("team-payments-viewer")
+		assert.True(t, matched)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"/api/v1/query"}, got.AllowedEndpoints)
+	})
+}
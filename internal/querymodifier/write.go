@@ -0,0 +1,85 @@
+package querymodifier
+
+import (
+	"regexp"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// SeriesEnforcer checks label sets (e.g. of written series or alerts) against an ACL. Regular expressions are compiled once, so that the same enforcer can be used for all series of a request.
+type SeriesEnforcer struct {
+	acl     ACL
+	rewrite bool
+	// regexps contains compiled regular expressions for regexp label filters of the ACL (nil for non-regexp ones)
+	regexps []*regexp.Regexp
+}
+
+// NewSeriesEnforcer returns a SeriesEnforcer for the ACL. If rewrite is true, then labels restricted by the ACL to a single value are set to that value instead of being checked.
+func NewSeriesEnforcer(acl ACL, rewrite bool) (*SeriesEnforcer, error) {
+	e := &SeriesEnforcer{
+		acl:     acl,
+		rewrite: rewrite,
+		regexps: make([]*regexp.Regexp, len(acl.LabelFilters)),
+	}
+
+	for i, lf := range acl.LabelFilters {
+		if !lf.IsRegexp {
+			continue
+		}
+
+		re, err := metricsql.CompileRegexpAnchored(lf.Value)
+		if err != nil {
+			return nil, err
+		}
+		e.regexps[i] = re
+	}
+
+	return e, nil
+}
+
+// Enforce returns true if the series with the labels is allowed by the ACL. Labels are modified in place in rewrite mode. Missing labels are treated as empty ones, as in PromQL.
+func (e *SeriesEnforcer) Enforce(labels map[string]string) bool {
+	if e.acl.Fullaccess {
+		return true
+	}
+
+	for i, lf := range e.acl.LabelFilters {
+		if e.rewrite && !lf.IsRegexp && !lf.IsNegative {
+			labels[lf.Label] = lf.Value
+			continue
+		}
+
+		if !e.matches(i, labels[lf.Label]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Violates returns true if any of the labels has a value not allowed by the ACL. Unlike Enforce, missing and empty labels are not checked, so that series without labels restricted by the ACL (e.g. results of aggregations) are not treated as violations.
+func (e *SeriesEnforcer) Violates(labels map[string]string) bool {
+	if e.acl.Fullaccess {
+		return false
+	}
+
+	for i, lf := range e.acl.LabelFilters {
+		if value := labels[lf.Label]; value != "" && !e.matches(i, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if the value satisfies the i-th label filter of the ACL.
+func (e *SeriesEnforcer) matches(i int, value string) bool {
+	lf := e.acl.LabelFilters[i]
+
+	matched := lf.Value == value
+	if re := e.regexps[i]; re != nil {
+		matched = re.MatchString(value)
+	}
+
+	return matched != lf.IsNegative
+}
@@ -0,0 +1,180 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesEnforcer_Enforce(t *testing.T) {
+	tests := []struct {
+		name       string
+		rawACLs    map[string]string
+		rewrite    bool
+		labels     map[string]string
+		want       bool
+		wantLabels map[string]string
+	}{
+		{
+			name:       "Full access",
+			rawACLs:    map[string]string{"namespace": ".*"},
+			labels:     map[string]string{"__name__": "up"},
+			want:       true,
+			wantLabels: map[string]string{"__name__": "up"},
+		},
+		{
+			name:       "Matching label",
+			rawACLs:    map[string]string{"namespace": "minio"},
+			labels:     map[string]string{"__name__": "up", "namespace": "minio"},
+			want:       true,
+			wantLabels: map[string]string{"__name__": "up", "namespace": "minio"},
+		},
+		{
+			name:    "Label with another value",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{"__name__": "up", "namespace": "stolon"},
+			want:    false,
+		},
+		{
+			name:    "Missing label",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{"__name__": "up"},
+			want:    false,
+		},
+		{
+			name:       "Regexp",
+			rawACLs:    map[string]string{"namespace": "min.*, stolon"},
+			labels:     map[string]string{"namespace": "minio-prod"},
+			want:       true,
+			wantLabels: map[string]string{"namespace": "minio-prod"},
+		},
+		{
+			name:    "Regexp is anchored",
+			rawACLs: map[string]string{"namespace": "min.*, stolon"},
+			labels:  map[string]string{"namespace": "stolon-prod"},
+			want:    false,
+		},
+		{
+			name:    "Exclusion",
+			rawACLs: map[string]string{"namespace": "!kube-system"},
+			labels:  map[string]string{"namespace": "kube-system"},
+			want:    false,
+		},
+		{
+			name:       "Multiple labels",
+			rawACLs:    map[string]string{"namespace": "minio", "cluster": "eu-.*"},
+			labels:     map[string]string{"namespace": "minio", "cluster": "eu-1"},
+			want:       true,
+			wantLabels: map[string]string{"namespace": "minio", "cluster": "eu-1"},
+		},
+		{
+			name:       "Rewrite sets a single-value label",
+			rawACLs:    map[string]string{"namespace": "minio"},
+			rewrite:    true,
+			labels:     map[string]string{"__name__": "up", "namespace": "stolon"},
+			want:       true,
+			wantLabels: map[string]string{"__name__": "up", "namespace": "minio"},
+		},
+		{
+			name:    "Rewrite doesn't pick one of multiple values",
+			rawACLs: map[string]string{"namespace": "minio, stolon"},
+			rewrite: true,
+			labels:  map[string]string{"namespace": "vault"},
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewMultiLabelACL(tt.rawACLs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := NewSeriesEnforcer(acl, tt.rewrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := e.Enforce(tt.labels)
+			assert.Equal(t, tt.want, got)
+			if tt.want {
+				assert.Equal(t, tt.wantLabels, tt.labels)
+			}
+		})
+	}
+}
+
+func TestSeriesEnforcer_Violates(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawACLs map[string]string
+		labels  map[string]string
+		want    bool
+	}{
+		{
+			name:    "Full access",
+			rawACLs: map[string]string{"namespace": ".*"},
+			labels:  map[string]string{"namespace": "stolon"},
+			want:    false,
+		},
+		{
+			name:    "Matching label",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{"__name__": "up", "namespace": "minio"},
+			want:    false,
+		},
+		{
+			name:    "Label with another value",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{"__name__": "up", "namespace": "stolon"},
+			want:    true,
+		},
+		{
+			name:    "Missing label",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{},
+			want:    false,
+		},
+		{
+			name:    "Empty label",
+			rawACLs: map[string]string{"namespace": "minio"},
+			labels:  map[string]string{"namespace": ""},
+			want:    false,
+		},
+		{
+			name:    "Regexp is anchored",
+			rawACLs: map[string]string{"namespace": "min.*, stolon"},
+			labels:  map[string]string{"namespace": "stolon-prod"},
+			want:    true,
+		},
+		{
+			name:    "Exclusion",
+			rawACLs: map[string]string{"namespace": "!kube-system"},
+			labels:  map[string]string{"namespace": "kube-system"},
+			want:    true,
+		},
+		{
+			name:    "One of multiple labels",
+			rawACLs: map[string]string{"namespace": "minio", "cluster": "eu-.*"},
+			labels:  map[string]string{"namespace": "minio", "cluster": "us-1"},
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewMultiLabelACL(tt.rawACLs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := NewSeriesEnforcer(acl, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.want, e.Violates(tt.labels))
+		})
+	}
+}